@@ -0,0 +1,159 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported formats.
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Decisions of an Entry.
+const (
+	DecisionAllow = "allow"
+	DecisionBlock = "block"
+)
+
+type (
+	// A Logger writes the access log entries, one per line.
+	Logger struct {
+		format string
+		mu     sync.Mutex
+		w      io.Writer
+	}
+
+	// An Entry summarizes a connection (a TCP relay or an UDP flow) or a rejected connection.
+	Entry struct {
+		Time     time.Time
+		Endpoint string
+		Client   string // ip:port
+		Country  string
+		Decision string
+		Rule     string // Empty when the default action applied.
+		Backend  string // Empty when no backend has been reached.
+		BytesIn  int64  // Bytes received from the client.
+		BytesOut int64  // Bytes sent to the client.
+		Duration time.Duration
+		Error    string
+	}
+
+	jsonEntry struct {
+		Time     string  `json:"time"`
+		Endpoint string  `json:"endpoint"`
+		Client   string  `json:"client"`
+		Country  string  `json:"country"`
+		Decision string  `json:"decision"`
+		Rule     string  `json:"rule"`
+		Backend  string  `json:"backend"`
+		BytesIn  int64   `json:"bytes_in"`
+		BytesOut int64   `json:"bytes_out"`
+		Duration float64 `json:"duration"` // Seconds
+		Error    string  `json:"error,omitempty"`
+	}
+)
+
+// New returns a new Logger writing the entries with the given format (json when empty).
+func New(w io.Writer, format string) (*Logger, error) {
+	switch format {
+	case "":
+		format = FormatJSON
+	case FormatJSON, FormatLogfmt:
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+
+	return &Logger{
+		format: format,
+		w:      w,
+	}, nil
+}
+
+// Log writes the given entry.
+func (l *Logger) Log(e Entry) error {
+	var line []byte
+	var err error
+
+	switch l.format {
+	case FormatLogfmt:
+		line = e.logfmt()
+	default:
+		line, err = e.json()
+		if err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.w.Write(line)
+	return err
+}
+
+func (e Entry) json() ([]byte, error) {
+	payload, err := json.Marshal(jsonEntry{
+		Time:     e.Time.Format(time.RFC3339Nano),
+		Endpoint: e.Endpoint,
+		Client:   e.Client,
+		Country:  e.Country,
+		Decision: e.Decision,
+		Rule:     e.Rule,
+		Backend:  e.Backend,
+		BytesIn:  e.BytesIn,
+		BytesOut: e.BytesOut,
+		Duration: e.Duration.Seconds(),
+		Error:    e.Error,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(payload, '\n'), nil
+}
+
+func (e Entry) logfmt() []byte {
+	var b bytes.Buffer
+
+	pair := func(key, value string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+
+		if value == "" || strings.ContainsAny(value, " =\"\\") || strings.ContainsFunc(value, isControl) {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(value)
+	}
+
+	pair("time", e.Time.Format(time.RFC3339Nano))
+	pair("endpoint", e.Endpoint)
+	pair("client", e.Client)
+	pair("country", e.Country)
+	pair("decision", e.Decision)
+	pair("rule", e.Rule)
+	pair("backend", e.Backend)
+	pair("bytes_in", strconv.FormatInt(e.BytesIn, 10))
+	pair("bytes_out", strconv.FormatInt(e.BytesOut, 10))
+	pair("duration", e.Duration.String())
+	if e.Error != "" {
+		pair("error", e.Error)
+	}
+
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
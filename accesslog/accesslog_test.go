@@ -0,0 +1,76 @@
+package accesslog_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/accesslog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var entry = accesslog.Entry{
+	Time:     time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+	Endpoint: "tcp://0.0.0.0:22",
+	Client:   "1.2.3.4:5678",
+	Country:  "FR",
+	Decision: accesslog.DecisionAllow,
+	Rule:     "country FR",
+	Backend:  "10.0.0.1:22",
+	BytesIn:  120,
+	BytesOut: 4096,
+	Duration: 1500 * time.Millisecond,
+}
+
+func TestLogger_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := accesslog.New(&buf, "")
+	require.NoError(t, err)
+
+	require.NoError(t, l.Log(entry))
+	require.NoError(t, l.Log(accesslog.Entry{Time: entry.Time, Decision: accesslog.DecisionBlock, Error: "boom"}))
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	var v map[string]any
+	require.NoError(t, json.Unmarshal(lines[0], &v))
+	assert.Equal(t, map[string]any{
+		"time":      "2024-03-01T12:30:00Z",
+		"endpoint":  "tcp://0.0.0.0:22",
+		"client":    "1.2.3.4:5678",
+		"country":   "FR",
+		"decision":  "allow",
+		"rule":      "country FR",
+		"backend":   "10.0.0.1:22",
+		"bytes_in":  float64(120),
+		"bytes_out": float64(4096),
+		"duration":  1.5,
+	}, v)
+
+	v = nil
+	require.NoError(t, json.Unmarshal(lines[1], &v))
+	assert.Equal(t, "block", v["decision"])
+	assert.Equal(t, "boom", v["error"])
+}
+
+func TestLogger_Logfmt(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := accesslog.New(&buf, accesslog.FormatLogfmt)
+	require.NoError(t, err)
+
+	require.NoError(t, l.Log(entry))
+	e := entry
+	e.Backend = ""
+	e.Error = `dial "tcp": refused`
+	require.NoError(t, l.Log(e))
+
+	assert.Equal(t, `time=2024-03-01T12:30:00Z endpoint=tcp://0.0.0.0:22 client=1.2.3.4:5678 country=FR decision=allow rule="country FR" backend=10.0.0.1:22 bytes_in=120 bytes_out=4096 duration=1.5s
+time=2024-03-01T12:30:00Z endpoint=tcp://0.0.0.0:22 client=1.2.3.4:5678 country=FR decision=allow rule="country FR" backend="" bytes_in=120 bytes_out=4096 duration=1.5s error="dial \"tcp\": refused"
+`, buf.String())
+
+	_, err = accesslog.New(&buf, "xml")
+	assert.Error(t, err)
+}
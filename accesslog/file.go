@@ -0,0 +1,151 @@
+package accesslog
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// Default rotation settings.
+const (
+	DefaultMaxSize    = 100 << 20 // 100MB
+	DefaultMaxBackups = 5
+)
+
+// A File is a log file rotated when it reaches its maximum size.
+// The rotated files are renamed path.1 (the most recent), path.2, etc.
+type File struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu     sync.Mutex
+	f      *os.File // nil when it must be reopened after a failed rotation
+	size   int64
+	closed bool
+}
+
+// OpenFile opens the file at the given path in append mode.
+// It is rotated before exceeding maxSize bytes (DefaultMaxSize when zero)
+// and maxBackups rotated files are kept (DefaultMaxBackups when zero, none when negative).
+func OpenFile(path string, maxSize int64, maxBackups int) (*File, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxBackups == 0 {
+		maxBackups = DefaultMaxBackups
+	}
+
+	f := &File{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: max(maxBackups, 0),
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write appends the given data to the file, rotating it first when the data does not fit.
+// When the rotation fails, the data is still appended to the file and the rotation error is returned,
+// the rotation is retried on the next write.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+
+	var rerr error
+	if f.f != nil && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		rerr = f.rotate()
+	}
+
+	if f.f == nil {
+		if err := f.open(); err != nil {
+			return 0, errors.Join(rerr, err) // Reopened on the next write.
+		}
+	}
+
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, rerr
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	if f.f == nil {
+		return nil
+	}
+
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.f = file
+	f.size = fi.Size()
+	return nil
+}
+
+// rotate shifts the rotated files, renames the current one and opens a new one.
+// On error, the file is left closed.
+func (f *File) rotate() error {
+	err := f.f.Close()
+	f.f = nil
+	if err != nil {
+		return err
+	}
+
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return f.open()
+	}
+
+	for i := f.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(f.backup(i), f.backup(i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := os.Rename(f.path, f.backup(1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *File) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
@@ -0,0 +1,80 @@
+package accesslog_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdouchement/geoblock-proxy/accesslog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	require.NoError(t, os.WriteFile(path, []byte("old\n"), 0o644))
+
+	f, err := accesslog.OpenFile(path, 10, 2)
+	require.NoError(t, err)
+
+	for _, line := range []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n"} {
+		_, err = f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+
+	assertContent(t, path, "line-4\n")
+	assertContent(t, path+".1", "line-3\n")
+	assertContent(t, path+".2", "line-2\n")
+	assert.NoFileExists(t, path+".3", "only 2 backups are kept")
+
+	_, err = f.Write([]byte("closed\n"))
+	assert.Error(t, err)
+}
+
+func TestFile_RotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	// The backup cannot be replaced by the current file.
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "busy"), 0o755))
+
+	f, err := accesslog.OpenFile(path, 10, 1)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.Write([]byte("line-1\n"))
+	require.NoError(t, err)
+
+	n, err := f.Write([]byte("line-2\n"))
+	assert.Error(t, err, "the rotation failed")
+	assert.Equal(t, len("line-2\n"), n, "the line is written anyway")
+	assertContent(t, path, "line-1\nline-2\n")
+
+	// The rotation is retried.
+	require.NoError(t, os.RemoveAll(path+".1"))
+	_, err = f.Write([]byte("line-3\n"))
+	require.NoError(t, err)
+	assertContent(t, path, "line-3\n")
+	assertContent(t, path+".1", "line-1\nline-2\n")
+}
+
+func TestFile_Append(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	require.NoError(t, os.WriteFile(path, []byte("old\n"), 0o644))
+
+	f, err := accesslog.OpenFile(path, 0, -1)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("new\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assertContent(t, path, "old\nnew\n")
+}
+
+func assertContent(t *testing.T, path, expected string) {
+	t.Helper()
+
+	payload, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(payload))
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/banlist"
+	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/mdouchement/geoblock-proxy/netset"
+	"github.com/mdouchement/geoblock-proxy/proxy"
+	"github.com/mdouchement/logger"
+)
+
+type (
+	adminEndpoint struct {
+		Name        string         `json:"name"`
+		Protocol    string         `json:"protocol"`
+		Policy      string         `json:"policy"`
+		Backends    []adminBackend `json:"backends"`
+		Routes      []adminRoute   `json:"routes,omitempty"`
+		Connections int            `json:"connections"`
+	}
+
+	adminRoute struct {
+		Countries []string       `json:"countries,omitempty"`
+		CIDRs     []string       `json:"cidrs,omitempty"`
+		Backends  []adminBackend `json:"backends"`
+	}
+
+	adminBackend struct {
+		Address string `json:"address"`
+		Up      *bool  `json:"up"` // Null when the health checks are disabled
+	}
+
+	adminConnection struct {
+		ID       uint64    `json:"id"`
+		Endpoint string    `json:"endpoint"`
+		Client   string    `json:"client"`
+		Country  string    `json:"country"`
+		Backend  string    `json:"backend"`
+		BytesIn  int64     `json:"bytes_in"`
+		BytesOut int64     `json:"bytes_out"`
+		Start    time.Time `json:"start"`
+		Duration float64   `json:"duration"` // Seconds
+	}
+
+	adminPolicy struct {
+		Name           string        `json:"name"`
+		DefaultAction  string        `json:"default_action"`
+		LookupStrategy string        `json:"lookup_strategy"`
+		Allowlist      []ruleSummary `json:"allowlist"`
+		Blocklist      []ruleSummary `json:"blocklist"`
+	}
+
+	adminEvaluation struct {
+		IP     string `json:"ip"`
+		Policy string `json:"policy"` // The default policy when empty
+	}
+
+	adminBanRequest struct {
+		CIDR   string `json:"cidr"`   // CIDR or IP
+		TTL    string `json:"ttl"`    // Duration of the ban (e.g. 1h), forever when empty
+		Reason string `json:"reason"` // Optional
+		Kill   bool   `json:"kill"`   // Also kill the active connections of the banned clients
+	}
+
+	adminBan struct {
+		Ban    banlist.Ban `json:"ban"`
+		Killed int         `json:"killed"` // Killed connections
+	}
+
+	adminStatus struct {
+		Status string `json:"status,omitempty"`
+		Error  string `json:"error,omitempty"`
+	}
+
+	namedProxy struct {
+		name  string // Name of the endpoint
+		proxy proxy.Proxy
+	}
+)
+
+// adminHandler returns the handler of the admin API, the requests must be authenticated with the bearer token
+// of the current configuration.
+func (c *controller) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/endpoints", c.adminEndpoints)
+	mux.HandleFunc("GET /api/connections", c.adminConnections)
+	mux.HandleFunc("POST /api/connections/{id}/kill", c.adminKill)
+	mux.HandleFunc("GET /api/rules", c.adminRules)
+	mux.HandleFunc("POST /api/evaluate", c.adminEvaluate)
+	mux.HandleFunc("POST /api/reload", c.adminReload)
+	mux.HandleFunc("GET /api/bans", c.adminBans)
+	mux.HandleFunc("POST /api/bans", c.adminBan)
+	mux.HandleFunc("DELETE /api/bans/{cidr...}", c.adminUnban)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := c.adminToken.Load()
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == nil || subtle.ConstantTimeCompare([]byte(bearer), []byte(*token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="geoblock-proxy"`)
+			writeJSON(w, http.StatusUnauthorized, adminStatus{Error: "unauthorized"})
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminEndpoints lists the endpoints with their backends and health.
+func (c *controller) adminEndpoints(w http.ResponseWriter, _ *http.Request) {
+	endpoints := []adminEndpoint{}
+	for _, s := range c.runningServices() {
+		endpoint := adminEndpoint{
+			Name:        s.name,
+			Protocol:    s.endpoint.Protocol,
+			Policy:      s.endpoint.PolicyName(),
+			Backends:    s.balancing.backends(s.balancing.lb),
+			Connections: len(s.proxy.Connections()),
+		}
+
+		if s.balancing.router != nil {
+			for i, rt := range s.balancing.router.routes {
+				endpoint.Routes = append(endpoint.Routes, adminRoute{
+					Countries: s.endpoint.Routes[i].Countries,
+					CIDRs:     s.endpoint.Routes[i].CIDRs,
+					Backends:  s.balancing.backends(rt.backends),
+				})
+			}
+		}
+
+		endpoints = append(endpoints, endpoint)
+	}
+
+	writeJSON(w, http.StatusOK, endpoints)
+}
+
+// adminConnections lists the active connections of all the endpoints, including the ones replaced by a reload.
+func (c *controller) adminConnections(w http.ResponseWriter, _ *http.Request) {
+	connections := []adminConnection{}
+	for _, p := range c.activeProxies() {
+		for _, conn := range p.proxy.Connections() {
+			connections = append(connections, adminConnection{
+				ID:       conn.ID,
+				Endpoint: p.name,
+				Client:   conn.Client.String(),
+				Country:  conn.Country,
+				Backend:  conn.Backend.String(),
+				BytesIn:  conn.In,
+				BytesOut: conn.Out,
+				Start:    conn.Start,
+				Duration: time.Since(conn.Start).Seconds(),
+			})
+		}
+	}
+
+	slices.SortFunc(connections, func(a, b adminConnection) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	writeJSON(w, http.StatusOK, connections)
+}
+
+// adminKill closes an active connection.
+func (c *controller) adminKill(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminStatus{Error: "invalid connection id"})
+		return
+	}
+
+	for _, p := range c.activeProxies() {
+		if p.proxy.Kill(id) {
+			logger.LogWith(c.ctx).Infof("Connection %d of %s killed by the admin API", id, p.name)
+			writeJSON(w, http.StatusOK, adminStatus{Status: "killed"})
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusNotFound, adminStatus{Error: "unknown connection"})
+}
+
+// adminRules lists the effective rules of the policies.
+func (c *controller) adminRules(w http.ResponseWriter, _ *http.Request) {
+	policies := []adminPolicy{}
+	for name, evaluator := range *c.evaluators.Load() {
+		policy := evaluator.Policy()
+		policies = append(policies, adminPolicy{
+			Name:           name,
+			DefaultAction:  policy.DefaultAction,
+			LookupStrategy: evaluator.Strategy(),
+			Allowlist:      summarize(policy.Allowlist),
+			Blocklist:      summarize(policy.Blocklist),
+		})
+	}
+
+	slices.SortFunc(policies, func(a, b adminPolicy) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	writeJSON(w, http.StatusOK, policies)
+}
+
+// adminEvaluate explains the decision taken for an IP.
+func (c *controller) adminEvaluate(w http.ResponseWriter, r *http.Request) {
+	var payload adminEvaluation
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminStatus{Error: "invalid payload: " + err.Error()})
+		return
+	}
+
+	if payload.Policy == "" {
+		payload.Policy = DefaultPolicy
+	}
+
+	c.evaluating.RLock()
+	evaluator, ok := (*c.evaluators.Load())[payload.Policy]
+	if !ok {
+		c.evaluating.RUnlock()
+		writeJSON(w, http.StatusNotFound, adminStatus{Error: "unknown policy " + payload.Policy})
+		return
+	}
+
+	x := explain(evaluator, payload.IP)
+	c.evaluating.RUnlock()
+
+	writeJSON(w, http.StatusOK, x)
+}
+
+// adminReload reloads the configuration file.
+func (c *controller) adminReload(w http.ResponseWriter, r *http.Request) {
+	done := make(chan error, 1)
+
+	select {
+	case c.reloads <- done:
+	case <-r.Context().Done():
+		return
+	}
+
+	if err := <-done; err != nil {
+		writeJSON(w, http.StatusInternalServerError, adminStatus{Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, adminStatus{Status: "reloaded"})
+}
+
+// adminBans lists the active bans.
+func (c *controller) adminBans(w http.ResponseWriter, _ *http.Request) {
+	bans := c.bans.Bans()
+	if bans == nil {
+		bans = []banlist.Ban{}
+	}
+
+	writeJSON(w, http.StatusOK, bans)
+}
+
+// adminBan bans a CIDR and optionally kills the active connections of its clients.
+func (c *controller) adminBan(w http.ResponseWriter, r *http.Request) {
+	var payload adminBanRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminStatus{Error: "invalid payload: " + err.Error()})
+		return
+	}
+
+	var ttl time.Duration
+	if payload.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(payload.TTL)
+		if err != nil || ttl < 0 {
+			writeJSON(w, http.StatusBadRequest, adminStatus{Error: "invalid ttl: " + payload.TTL})
+			return
+		}
+	}
+
+	block, err := netset.ParseBlock(payload.CIDR)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminStatus{Error: err.Error()})
+		return
+	}
+
+	ban, err := c.bans.Add(block.String(), ttl, payload.Reason)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, adminStatus{Error: err.Error()})
+		return
+	}
+
+	log := logger.LogWith(c.ctx)
+	if ban.Expires != nil {
+		log.Infof("%s banned by the admin API until %s", ban.CIDR, ban.Expires.Format(time.RFC3339))
+	} else {
+		log.Infof("%s banned by the admin API", ban.CIDR)
+	}
+
+	var killed int
+	if payload.Kill {
+		killed = c.killClients(block)
+	}
+
+	writeJSON(w, http.StatusCreated, adminBan{Ban: ban, Killed: killed})
+}
+
+// adminUnban lifts the ban of a CIDR.
+func (c *controller) adminUnban(w http.ResponseWriter, r *http.Request) {
+	block, err := netset.ParseBlock(r.PathValue("cidr"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminStatus{Error: err.Error()})
+		return
+	}
+
+	removed, err := c.bans.Remove(block.String())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, adminStatus{Error: err.Error()})
+		return
+	}
+
+	if !removed {
+		writeJSON(w, http.StatusNotFound, adminStatus{Error: "unknown ban"})
+		return
+	}
+
+	logger.LogWith(c.ctx).Infof("%s unbanned by the admin API", block)
+	writeJSON(w, http.StatusOK, adminStatus{Status: "unbanned"})
+}
+
+// killClients kills the active connections of the clients in the given block and returns their number.
+func (c *controller) killClients(block *net.IPNet) int {
+	var killed int
+	for _, p := range c.activeProxies() {
+		for _, conn := range p.proxy.Connections() {
+			var ip net.IP
+			switch addr := conn.Client.(type) {
+			case *net.TCPAddr:
+				ip = addr.IP
+			case *net.UDPAddr:
+				ip = addr.IP
+			}
+
+			if block.Contains(ip) && p.proxy.Kill(conn.ID) {
+				killed++
+			}
+		}
+	}
+	return killed
+}
+
+// runningServices returns the running services sorted by name.
+func (c *controller) runningServices() []*service {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	services := make([]*service, 0, len(c.services))
+	for _, s := range c.services {
+		services = append(services, s)
+	}
+
+	slices.SortFunc(services, func(a, b *service) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return services
+}
+
+// activeProxies returns the proxies of the running services and the ones removed by a reload that are still
+// relaying their connections, sorted by name.
+func (c *controller) activeProxies() []namedProxy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	proxies := make([]namedProxy, 0, len(c.services)+len(c.retired))
+	for _, s := range c.services {
+		proxies = append(proxies, namedProxy{name: s.name, proxy: s.proxy})
+	}
+	for p, name := range c.retired {
+		proxies = append(proxies, namedProxy{name: name, proxy: p})
+	}
+
+	slices.SortFunc(proxies, func(a, b namedProxy) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return proxies
+}
+
+// backends returns the backends of the given loadbalancer with their health.
+func (b *balancing) backends(addresser proxy.Addresser) []adminBackend {
+	lb, ok := addresser.(loadbalancer.Loadbalancer)
+	if !ok {
+		return nil
+	}
+
+	backends := []adminBackend{}
+	for _, backend := range lb.Backends() {
+		backends = append(backends, adminBackend{
+			Address: backend.String(),
+			Up:      b.healthy(backend),
+		})
+	}
+	return backends
+}
+
+// healthy returns the health of the given backend, nil when the health checks are disabled.
+func (b *balancing) healthy(backend net.Addr) *bool {
+	if len(b.health) == 0 {
+		return nil
+	}
+
+	up := true
+	for _, health := range b.health {
+		up = up && health.Healthy(backend)
+	}
+	return &up
+}
+
+func summarize(rules []Rule) []ruleSummary {
+	summaries := make([]ruleSummary, len(rules))
+	for i, rule := range rules {
+		summaries[i] = ruleSummary{Type: rule.Type, Value: rule.Value}
+	}
+	return summaries
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) //nolint:errcheck
+}
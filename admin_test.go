@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/banlist"
+	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/mdouchement/geoblock-proxy/proxy"
+	"github.com/mdouchement/logger"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandler(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	logr := logrus.New()
+	logr.SetOutput(io.Discard)
+	c := &controller{
+		ctx:      logger.WithLogger(context.Background(), logger.WrapLogrus(logr)),
+		services: make(map[string]*service),
+		reloads:  make(chan chan error),
+	}
+
+	bans, err := banlist.Open("")
+	require.NoError(t, err)
+	c.bans = bans
+
+	e, err := NewEvaluator(DefaultPolicy, Policy{
+		DefaultAction: DefaultActionBlock,
+		Allowlist:     []Rule{{Type: RuleTypeCountry, Value: "FR"}},
+		Blocklist:     []Rule{{Type: RuleTypeCIDR, Value: "192.0.2.0/24"}},
+	}, "")
+	require.NoError(t, err)
+	e.AddLookup("country.mmdb", &fakeLookup{country: "fr"}, false)
+	e.SetBans(c.bans)
+	c.evaluators.Store(&map[string]*Evaluator{DefaultPolicy: e})
+
+	endpoint := Endpoint{Protocol: "tcp", Listen: "127.0.0.1:0", Backends: []Backend{{Address: backend.Addr().String()}}}
+	lb, err := loadbalancer.New("", endpoint.Protocol, endpoint.Listen, endpoint.Upstreams())
+	require.NoError(t, err)
+	p, err := proxy.NewTCPProxy(c.ctx, lb, func(context.Context, net.IP) proxy.Decision {
+		return proxy.Decision{Allowed: true, Country: "FR"}
+	}, proxy.Options{})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background()) //nolint:errcheck
+
+	c.services[endpoint.key()] = &service{
+		name:      endpoint.Frontend(),
+		endpoint:  endpoint,
+		proxy:     p,
+		balancing: &balancing{lb: lb},
+	}
+
+	token := "secret"
+	c.adminToken.Store(&token)
+
+	server := httptest.NewServer(c.adminHandler())
+	defer server.Close()
+
+	request := func(method, path, token, body string) (int, string) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		payload, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(payload)
+	}
+
+	t.Run("authentication", func(t *testing.T) {
+		status, _ := request(http.MethodGet, "/api/endpoints", "", "")
+		assert.Equal(t, http.StatusUnauthorized, status)
+
+		status, _ = request(http.MethodGet, "/api/endpoints", "wrong", "")
+		assert.Equal(t, http.StatusUnauthorized, status)
+
+		rotated := "rotated"
+		c.adminToken.Store(&rotated) // By a reload.
+		defer c.adminToken.Store(&token)
+
+		status, _ = request(http.MethodGet, "/api/endpoints", "secret", "")
+		assert.Equal(t, http.StatusUnauthorized, status)
+		status, _ = request(http.MethodGet, "/api/endpoints", "rotated", "")
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("endpoints", func(t *testing.T) {
+		status, body := request(http.MethodGet, "/api/endpoints", "secret", "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `[{
+			"name": "tcp://127.0.0.1:0",
+			"protocol": "tcp",
+			"policy": "default",
+			"backends": [{"address": "`+backend.Addr().String()+`", "up": null}],
+			"connections": 0
+		}]`, body)
+	})
+
+	t.Run("connections", func(t *testing.T) {
+		client, err := net.Dial("tcp", p.FrontendAddr().String())
+		require.NoError(t, err)
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+		_, err = client.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		_, err = bufio.NewReader(client).ReadString('\n')
+		require.NoError(t, err)
+
+		var connections []adminConnection
+		assert.Eventually(t, func() bool {
+			status, body := request(http.MethodGet, "/api/connections", "secret", "")
+			connections = nil
+			return status == http.StatusOK && json.Unmarshal([]byte(body), &connections) == nil &&
+				len(connections) == 1 && connections[0].BytesOut == 6
+		}, 5*time.Second, 10*time.Millisecond)
+
+		conn := connections[0]
+		assert.Equal(t, "tcp://127.0.0.1:0", conn.Endpoint)
+		assert.Equal(t, client.LocalAddr().String(), conn.Client)
+		assert.Equal(t, "FR", conn.Country)
+		assert.Equal(t, backend.Addr().String(), conn.Backend)
+		assert.Equal(t, int64(6), conn.BytesIn)
+
+		status, _ := request(http.MethodPost, "/api/connections/not-an-id/kill", "secret", "")
+		assert.Equal(t, http.StatusBadRequest, status)
+
+		status, body := request(http.MethodPost, "/api/connections/"+itoa(conn.ID)+"/kill", "secret", "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `{"status": "killed"}`, body)
+
+		_, err = client.Read(make([]byte, 1))
+		assert.Error(t, err)
+
+		status, _ = request(http.MethodPost, "/api/connections/"+itoa(conn.ID)+"/kill", "secret", "")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("rules", func(t *testing.T) {
+		status, body := request(http.MethodGet, "/api/rules", "secret", "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `[{
+			"name": "default",
+			"default_action": "block",
+			"lookup_strategy": "first",
+			"allowlist": [{"type": "country", "value": "FR"}],
+			"blocklist": [{"type": "cidr", "value": "192.0.2.0/24"}]
+		}]`, body)
+	})
+
+	t.Run("evaluate", func(t *testing.T) {
+		status, body := request(http.MethodPost, "/api/evaluate", "secret", `{"ip": "198.51.100.1"}`)
+		assert.Equal(t, http.StatusOK, status)
+
+		var x explanation
+		require.NoError(t, json.Unmarshal([]byte(body), &x))
+		assert.Equal(t, "allowed", x.Verdict)
+		assert.Equal(t, "allowed_country", x.Decision)
+
+		status, _ = request(http.MethodPost, "/api/evaluate", "secret", `{"ip": "198.51.100.1", "policy": "unknown"}`)
+		assert.Equal(t, http.StatusNotFound, status)
+
+		status, _ = request(http.MethodPost, "/api/evaluate", "secret", `not json`)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("bans", func(t *testing.T) {
+		client, err := net.Dial("tcp", p.FrontendAddr().String())
+		require.NoError(t, err)
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+		_, err = client.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		_, err = bufio.NewReader(client).ReadString('\n')
+		require.NoError(t, err)
+
+		status, body := request(http.MethodGet, "/api/bans", "secret", "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `[]`, body)
+
+		status, _ = request(http.MethodPost, "/api/bans", "secret", `{"cidr": "not-an-ip"}`)
+		assert.Equal(t, http.StatusBadRequest, status)
+		status, _ = request(http.MethodPost, "/api/bans", "secret", `{"cidr": "127.0.0.1", "ttl": "-1h"}`)
+		assert.Equal(t, http.StatusBadRequest, status)
+
+		status, body = request(http.MethodPost, "/api/bans", "secret", `{"cidr": "127.0.0.0/8", "ttl": "1h", "reason": "test", "kill": true}`)
+		assert.Equal(t, http.StatusCreated, status)
+
+		var ban adminBan
+		require.NoError(t, json.Unmarshal([]byte(body), &ban))
+		assert.Equal(t, "127.0.0.0/8", ban.Ban.CIDR)
+		assert.Equal(t, "test", ban.Ban.Reason)
+		require.NotNil(t, ban.Ban.Expires)
+		assert.Equal(t, 1, ban.Killed)
+
+		_, err = client.Read(make([]byte, 1))
+		assert.Error(t, err, "the connection of the banned client is killed")
+
+		status, body = request(http.MethodPost, "/api/evaluate", "secret", `{"ip": "127.0.0.1"}`)
+		assert.Equal(t, http.StatusOK, status)
+		var x explanation
+		require.NoError(t, json.Unmarshal([]byte(body), &x))
+		assert.Equal(t, "blocked_ban", x.Decision)
+
+		status, body = request(http.MethodGet, "/api/bans", "secret", "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, `"cidr":"127.0.0.0/8"`)
+
+		status, body = request(http.MethodDelete, "/api/bans/127.0.0.0/8", "secret", "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `{"status": "unbanned"}`, body)
+
+		status, _ = request(http.MethodDelete, "/api/bans/127.0.0.0/8", "secret", "")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		go func() {
+			(<-c.reloads) <- nil
+			(<-c.reloads) <- errors.New("invalid configuration")
+		}()
+
+		status, body := request(http.MethodPost, "/api/reload", "secret", "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `{"status": "reloaded"}`, body)
+
+		status, body = request(http.MethodPost, "/api/reload", "secret", "")
+		assert.Equal(t, http.StatusInternalServerError, status)
+		assert.JSONEq(t, `{"error": "invalid configuration"}`, body)
+	})
+}
+
+func TestAdminHandler_ReplacedEndpoint(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	a := freeAddr(t)
+	c := testController(t, configuration(backend, a))
+
+	bans, err := banlist.Open("")
+	require.NoError(t, err)
+	c.bans = bans
+
+	token := "secret"
+	c.adminToken.Store(&token)
+	handler := c.adminHandler()
+
+	request := func(method, path, payload string) (int, string) {
+		t.Helper()
+
+		r := httptest.NewRequest(method, path, strings.NewReader(payload))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	relay := func() *bufio.Reader {
+		conn, err := net.Dial("tcp", a)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+		r := bufio.NewReader(conn)
+		_, err = conn.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		_, err = r.ReadString('\n')
+		require.NoError(t, err)
+		return r
+	}
+	r1, r2 := relay(), relay()
+
+	// The endpoint is replaced with other options, its proxy keeps relaying the connections while it drains.
+	writeConfiguration(t, c.cfg, configuration(backend)+"- tcp://"+a+"?backend="+backend.Addr().String()+"&policy=default\n")
+	require.NoError(t, c.reload())
+
+	status, body := request(http.MethodGet, "/api/connections", "")
+	assert.Equal(t, http.StatusOK, status)
+
+	var connections []adminConnection
+	require.NoError(t, json.Unmarshal([]byte(body), &connections))
+	require.Len(t, connections, 2, "the connections of the replaced endpoint are listed")
+	assert.Equal(t, "tcp://"+a, connections[0].Endpoint)
+
+	status, _ = request(http.MethodPost, "/api/connections/"+itoa(connections[0].ID)+"/kill", "")
+	assert.Equal(t, http.StatusOK, status)
+
+	_, err = r1.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF, "the connection is killed")
+
+	status, body = request(http.MethodPost, "/api/bans", `{"cidr": "127.0.0.1", "kill": true}`)
+	assert.Equal(t, http.StatusCreated, status)
+
+	var ban adminBan
+	require.NoError(t, json.Unmarshal([]byte(body), &ban))
+	assert.Equal(t, 1, ban.Killed, "the other connection of the replaced endpoint is killed")
+
+	_, err = r2.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c) //nolint:errcheck
+			}()
+		}
+	}()
+
+	return l
+}
+
+func itoa(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
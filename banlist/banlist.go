@@ -0,0 +1,276 @@
+package banlist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/iptrie"
+	"github.com/mdouchement/geoblock-proxy/netset"
+)
+
+type (
+	// A List is a set of banned CIDR blocks, optionally persisted to a JSON file.
+	// The expired bans are ignored and removed by Prune.
+	List struct {
+		path string // Not persisted when empty
+
+		mu  sync.Mutex // Serializes the changes
+		set atomic.Pointer[set]
+	}
+
+	// A Ban blocks the IPs of a CIDR block until it expires.
+	Ban struct {
+		CIDR    string     `json:"cidr"`
+		Reason  string     `json:"reason,omitempty"`
+		Created time.Time  `json:"created"`
+		Expires *time.Time `json:"expires,omitempty"` // Never expires when nil.
+	}
+
+	set struct {
+		trie *iptrie.Trie   // Only the bans active when the set was built
+		bans map[string]Ban // Indexed by CIDR
+	}
+)
+
+// Open reads the bans persisted to the given file, which is created on the first change.
+// When path is empty, the bans are only kept in memory.
+func Open(path string) (*List, error) {
+	l := &List{
+		path: path,
+	}
+
+	var bans []Ban
+	if path != "" {
+		payload, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		if len(payload) > 0 {
+			if err = json.Unmarshal(payload, &bans); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+
+	s, err := newSet(bans)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	l.set.Store(s)
+	return l, nil
+}
+
+// Path returns the path of the file, empty when the bans are not persisted.
+func (l *List) Path() string {
+	return l.path
+}
+
+// Match returns the active ban containing the given IP.
+// A nil List matches nothing.
+func (l *List) Match(ip net.IP) (Ban, bool) {
+	if l == nil {
+		return Ban{}, false
+	}
+
+	for {
+		s := l.set.Load()
+		block := s.trie.Match(ip)
+		if block == nil {
+			return Ban{}, false
+		}
+
+		if ban := s.bans[block.String()]; !ban.Expired(time.Now()) {
+			return ban, true
+		}
+
+		// The longest block has expired, the trie is rebuilt without it so a shorter one may match.
+		// The expired bans are kept until Prune removes and persists them.
+		rebuilt, err := newSet(slices.Collect(maps.Values(s.bans)))
+		if err != nil {
+			return Ban{}, false // Not reached, the bans have already been parsed.
+		}
+		l.set.CompareAndSwap(s, rebuilt)
+	}
+}
+
+// Bans returns the active bans sorted by CIDR.
+func (l *List) Bans() []Ban {
+	now := time.Now()
+
+	var bans []Ban
+	for _, ban := range l.set.Load().bans {
+		if !ban.Expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+
+	slices.SortFunc(bans, func(a, b Ban) int {
+		return strings.Compare(a.CIDR, b.CIDR)
+	})
+	return bans
+}
+
+// Add bans the given CIDR or IP for ttl (forever when zero) and persists the list.
+// An existing ban of the same block is replaced.
+func (l *List) Add(cidr string, ttl time.Duration, reason string) (Ban, error) {
+	block, err := netset.ParseBlock(cidr)
+	if err != nil {
+		return Ban{}, err
+	}
+
+	if ttl < 0 {
+		return Ban{}, errors.New("ttl must be positive")
+	}
+
+	ban := Ban{
+		CIDR:    block.String(),
+		Reason:  reason,
+		Created: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		expires := ban.Created.Add(ttl)
+		ban.Expires = &expires
+	}
+
+	return ban, l.update(func(bans map[string]Ban) bool {
+		bans[ban.CIDR] = ban
+		return true
+	})
+}
+
+// Remove lifts the ban of the given CIDR or IP and persists the list.
+// It returns false when the block is not banned.
+func (l *List) Remove(cidr string) (bool, error) {
+	block, err := netset.ParseBlock(cidr)
+	if err != nil {
+		return false, err
+	}
+
+	var removed bool
+	err = l.update(func(bans map[string]Ban) bool {
+		_, removed = bans[block.String()]
+		delete(bans, block.String())
+		return removed
+	})
+	return removed, err
+}
+
+// Prune removes the expired bans and returns their number.
+func (l *List) Prune() (int, error) {
+	var pruned int
+	err := l.update(func(bans map[string]Ban) bool {
+		now := time.Now()
+		for cidr, ban := range bans {
+			if ban.Expired(now) {
+				delete(bans, cidr)
+				pruned++
+			}
+		}
+		return pruned > 0
+	})
+	return pruned, err
+}
+
+// update applies the given change to a copy of the bans, then persists and swaps them when the change returns true.
+func (l *List) update(change func(bans map[string]Ban) bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bans := make(map[string]Ban)
+	for cidr, ban := range l.set.Load().bans {
+		bans[cidr] = ban
+	}
+
+	if !change(bans) {
+		return nil
+	}
+
+	s, err := newSet(slices.Collect(maps.Values(bans)))
+	if err != nil {
+		return err
+	}
+
+	if err = l.save(s); err != nil {
+		return err
+	}
+
+	l.set.Store(s)
+	return nil
+}
+
+// save writes atomically the bans to the file.
+func (l *List) save(s *set) error {
+	if l.path == "" {
+		return nil
+	}
+
+	bans := make([]Ban, 0, len(s.bans))
+	for _, ban := range s.bans {
+		bans = append(bans, ban)
+	}
+	slices.SortFunc(bans, func(a, b Ban) int {
+		return strings.Compare(a.CIDR, b.CIDR)
+	})
+
+	payload, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(append(payload, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), l.path)
+}
+
+// Expired returns true when the ban has expired at the given time.
+func (b Ban) Expired(now time.Time) bool {
+	return b.Expires != nil && !now.Before(*b.Expires)
+}
+
+func newSet(bans []Ban) (*set, error) {
+	s := &set{
+		trie: iptrie.New(),
+		bans: make(map[string]Ban, len(bans)),
+	}
+
+	now := time.Now()
+	for _, ban := range bans {
+		block, err := netset.ParseBlock(ban.CIDR)
+		if err != nil {
+			return nil, err
+		}
+
+		ban.CIDR = block.String()
+		if !ban.Expired(now) {
+			s.trie.Insert(block)
+		}
+		s.bans[ban.CIDR] = ban
+	}
+
+	return s, nil
+}
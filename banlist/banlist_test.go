@@ -0,0 +1,142 @@
+package banlist_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/banlist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+
+	l, err := banlist.Open(path)
+	require.NoError(t, err)
+	assert.Equal(t, path, l.Path())
+	assert.Empty(t, l.Bans())
+
+	_, ok := l.Match(net.ParseIP("192.0.2.1"))
+	assert.False(t, ok)
+
+	ban, err := l.Add("192.0.2.0/24", 0, "scanner")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.0/24", ban.CIDR)
+	assert.Nil(t, ban.Expires)
+
+	ban, err = l.Add("2001:db8::1", time.Hour, "")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1/128", ban.CIDR, "a single IP is banned as a block")
+	require.NotNil(t, ban.Expires)
+	assert.Equal(t, time.Hour, ban.Expires.Sub(ban.Created))
+
+	_, err = l.Add("not-an-ip", 0, "")
+	assert.Error(t, err)
+	_, err = l.Add("192.0.2.1", -time.Hour, "")
+	assert.Error(t, err)
+
+	ban, ok = l.Match(net.ParseIP("192.0.2.1"))
+	assert.True(t, ok)
+	assert.Equal(t, "scanner", ban.Reason)
+	_, ok = l.Match(net.ParseIP("2001:db8::1"))
+	assert.True(t, ok)
+	_, ok = l.Match(net.ParseIP("198.51.100.1"))
+	assert.False(t, ok)
+
+	// The bans survive a restart.
+	l, err = banlist.Open(path)
+	require.NoError(t, err)
+	require.Len(t, l.Bans(), 2)
+	assert.Equal(t, "192.0.2.0/24", l.Bans()[0].CIDR)
+	assert.Equal(t, "2001:db8::1/128", l.Bans()[1].CIDR)
+
+	removed, err := l.Remove("192.0.2.0/24")
+	require.NoError(t, err)
+	assert.True(t, removed)
+	removed, err = l.Remove("192.0.2.0/24")
+	require.NoError(t, err)
+	assert.False(t, removed)
+
+	_, ok = l.Match(net.ParseIP("192.0.2.1"))
+	assert.False(t, ok)
+
+	l, err = banlist.Open(path)
+	require.NoError(t, err)
+	assert.Len(t, l.Bans(), 1)
+}
+
+func TestList_Expiration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	l, err := banlist.Open(path)
+	require.NoError(t, err)
+
+	_, err = l.Add("192.0.2.0/24", 50*time.Millisecond, "")
+	require.NoError(t, err)
+	_, err = l.Add("192.0.2.1", 0, "")
+	require.NoError(t, err)
+
+	_, ok := l.Match(net.ParseIP("192.0.2.2"))
+	assert.True(t, ok)
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, ok = l.Match(net.ParseIP("192.0.2.2"))
+	assert.False(t, ok, "the ban has expired")
+
+	ban, ok := l.Match(net.ParseIP("192.0.2.1"))
+	assert.True(t, ok, "the longer block is still banned")
+	assert.Equal(t, "192.0.2.1/32", ban.CIDR)
+	assert.Len(t, l.Bans(), 1)
+
+	pruned, err := l.Prune()
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned, "the expired ban is kept until pruned")
+
+	l, err = banlist.Open(path)
+	require.NoError(t, err)
+	assert.Len(t, l.Bans(), 1)
+	_, ok = l.Match(net.ParseIP("192.0.2.1"))
+	assert.True(t, ok)
+}
+
+func TestList_ExpirationLongestBlock(t *testing.T) {
+	l, err := banlist.Open(filepath.Join(t.TempDir(), "bans.json"))
+	require.NoError(t, err)
+
+	_, err = l.Add("192.0.2.0/24", 0, "")
+	require.NoError(t, err)
+	_, err = l.Add("192.0.2.1", 50*time.Millisecond, "")
+	require.NoError(t, err)
+
+	ban, ok := l.Match(net.ParseIP("192.0.2.1"))
+	assert.True(t, ok)
+	assert.Equal(t, "192.0.2.1/32", ban.CIDR)
+
+	time.Sleep(100 * time.Millisecond)
+
+	for range 2 {
+		ban, ok = l.Match(net.ParseIP("192.0.2.1"))
+		assert.True(t, ok, "the shorter block is still banned")
+		assert.Equal(t, "192.0.2.0/24", ban.CIDR)
+	}
+
+	pruned, err := l.Prune()
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned, "the expired ban is kept until pruned")
+}
+
+func TestOpen_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"cidr": "not-an-ip"}]`), 0o644))
+
+	_, err := banlist.Open(path)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{`), 0o644))
+	_, err = banlist.Open(path)
+	assert.Error(t, err)
+}
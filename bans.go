@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/banlist"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// An adminClient requests the admin API of a running proxy.
+type adminClient struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+func newBansCommand(cfg *string) *cobra.Command {
+	var endpoint string
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "bans",
+		Short: "Manages the runtime bans of the running proxy through its admin API",
+	}
+	cmd.PersistentFlags().StringVar(&endpoint, "admin", "", "URL of the admin API (guessed from the configuration when empty)")
+
+	client := func() (*adminClient, error) {
+		return newAdminClient(*cfg, endpoint)
+	}
+
+	list := &cobra.Command{
+		Use:           "list",
+		Short:         "Lists the active bans",
+		Args:          cobra.ExactArgs(0),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			a, err := client()
+			if err != nil {
+				return err
+			}
+
+			var bans []banlist.Ban
+			if err = a.do(http.MethodGet, "/api/bans", nil, &bans); err != nil {
+				return err
+			}
+
+			if asJSON {
+				encoder := json.NewEncoder(cmd.OutOrStdout())
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(bans)
+			}
+
+			printBans(cmd.OutOrStdout(), bans)
+			return nil
+		},
+	}
+	list.Flags().BoolVar(&asJSON, "json", false, "Output as JSON")
+
+	var ttl time.Duration
+	var reason string
+	var kill bool
+
+	add := &cobra.Command{
+		Use:           "add CIDR [CIDR...]",
+		Short:         "Bans the given CIDRs or IPs",
+		Args:          cobra.MinimumNArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			a, err := client()
+			if err != nil {
+				return err
+			}
+
+			for _, cidr := range args {
+				request := adminBanRequest{CIDR: cidr, Reason: reason, Kill: kill}
+				if ttl > 0 {
+					request.TTL = ttl.String()
+				}
+
+				var response adminBan
+				if err = a.do(http.MethodPost, "/api/bans", request, &response); err != nil {
+					return errors.Wrap(err, cidr)
+				}
+
+				fmt.Fprintf(cmd.OutOrStdout(), "%s banned %s", response.Ban.CIDR, expiration(response.Ban))
+				if kill {
+					fmt.Fprintf(cmd.OutOrStdout(), ", %d connection(s) killed", response.Killed)
+				}
+				fmt.Fprintln(cmd.OutOrStdout())
+			}
+			return nil
+		},
+	}
+	add.Flags().DurationVar(&ttl, "ttl", 0, "Duration of the ban (forever when zero)")
+	add.Flags().StringVar(&reason, "reason", "", "Reason of the ban")
+	add.Flags().BoolVar(&kill, "kill", false, "Also kill the active connections of the banned clients")
+
+	remove := &cobra.Command{
+		Use:           "remove CIDR [CIDR...]",
+		Short:         "Lifts the bans of the given CIDRs or IPs",
+		Args:          cobra.MinimumNArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			a, err := client()
+			if err != nil {
+				return err
+			}
+
+			for _, cidr := range args {
+				if err = a.do(http.MethodDelete, "/api/bans/"+cidr, nil, nil); err != nil {
+					return errors.Wrap(err, cidr)
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s unbanned\n", cidr)
+			}
+			return nil
+		},
+	}
+
+	cmd.AddCommand(list, add, remove)
+	return cmd
+}
+
+// newAdminClient returns a client of the admin API defined in the given configuration file.
+// When endpoint is empty, the API is requested on the loopback interface of its listen address.
+func newAdminClient(cfg, endpoint string) (*adminClient, error) {
+	if cfg == "" {
+		cfg = "geoblock-proxy.yml"
+	}
+
+	payload, err := os.ReadFile(cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read configuration file %s", cfg)
+	}
+
+	var config Configuration
+	if err = yaml.Unmarshal(payload, &config); err != nil {
+		return nil, errors.Wrapf(err, "could not parse configuration file %s", cfg)
+	}
+
+	if config.Admin == nil {
+		return nil, errors.Errorf("%s: the admin API is disabled", cfg)
+	}
+
+	if endpoint == "" {
+		listen := config.Admin.Listen
+		if listen == "" {
+			listen = config.Metrics
+		}
+
+		host, port, err := net.SplitHostPort(listen)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: invalid admin listen address", cfg)
+		}
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		endpoint = "http://" + net.JoinHostPort(host, port)
+	}
+
+	return &adminClient{
+		url:   strings.TrimSuffix(endpoint, "/"),
+		token: config.Admin.Token,
+		http:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// do sends the request with the given JSON payload (none when nil) and decodes the response into out (ignored when nil).
+func (a *adminClient) do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, a.url+(&url.URL{Path: path}).EscapedPath(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var status adminStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil || status.Error == "" {
+			return errors.Errorf("admin API: %s", resp.Status)
+		}
+		return errors.Errorf("admin API: %s", status.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func printBans(w io.Writer, bans []banlist.Ban) {
+	if len(bans) == 0 {
+		fmt.Fprintln(w, "No active ban")
+		return
+	}
+
+	for _, ban := range bans {
+		fmt.Fprintf(w, "%s %s", ban.CIDR, expiration(ban))
+		if ban.Reason != "" {
+			fmt.Fprintf(w, " (%s)", ban.Reason)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func expiration(ban banlist.Ban) string {
+	if ban.Expires == nil {
+		return "forever"
+	}
+	return "until " + ban.Expires.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdouchement/geoblock-proxy/banlist"
+	"github.com/mdouchement/logger"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBansCommand(t *testing.T) {
+	logr := logrus.New()
+	logr.SetOutput(io.Discard)
+	c := &controller{
+		ctx:      logger.WithLogger(context.Background(), logger.WrapLogrus(logr)),
+		services: make(map[string]*service),
+	}
+
+	bans, err := banlist.Open(filepath.Join(t.TempDir(), "bans.json"))
+	require.NoError(t, err)
+	c.bans = bans
+
+	token := "secret"
+	c.adminToken.Store(&token)
+
+	server := httptest.NewServer(c.adminHandler())
+	defer server.Close()
+
+	cfg := filepath.Join(t.TempDir(), "geoblock-proxy.yml")
+	require.NoError(t, os.WriteFile(cfg, []byte("admin:\n  listen: 127.0.0.1:9096\n  token: secret\n"), 0o644))
+
+	execute := func(args ...string) (string, error) {
+		t.Helper()
+
+		var w bytes.Buffer
+		cmd := newBansCommand(&cfg)
+		cmd.SetOut(&w)
+		cmd.SetArgs(append(args, "--admin", server.URL))
+		err := cmd.Execute()
+		return w.String(), err
+	}
+
+	out, err := execute("list")
+	require.NoError(t, err)
+	assert.Equal(t, "No active ban\n", out)
+
+	out, err = execute("add", "192.0.2.1", "2001:db8::/32", "--reason", "scanner")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1/32 banned forever\n2001:db8::/32 banned forever\n", out)
+
+	out, err = execute("add", "198.51.100.0/24", "--ttl", "1h", "--kill")
+	require.NoError(t, err)
+	assert.Contains(t, out, "198.51.100.0/24 banned until ")
+	assert.Contains(t, out, ", 0 connection(s) killed")
+
+	_, err = execute("add", "not-an-ip")
+	assert.ErrorContains(t, err, "not-an-ip: admin API: invalid IP address")
+
+	out, err = execute("list")
+	require.NoError(t, err)
+	assert.Contains(t, out, "192.0.2.1/32 forever (scanner)\n")
+	assert.Contains(t, out, "2001:db8::/32 forever (scanner)\n")
+	assert.Len(t, bans.Bans(), 3)
+
+	out, err = execute("remove", "2001:db8::/32", "192.0.2.1")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::/32 unbanned\n192.0.2.1 unbanned\n", out)
+	assert.Len(t, bans.Bans(), 1)
+
+	_, err = execute("remove", "192.0.2.1")
+	assert.ErrorContains(t, err, "unknown ban")
+}
+
+func TestNewAdminClient(t *testing.T) {
+	cfg := filepath.Join(t.TempDir(), "geoblock-proxy.yml")
+
+	require.NoError(t, os.WriteFile(cfg, []byte("metrics: 0.0.0.0:9095\nadmin:\n  token: secret\n"), 0o644))
+	a, err := newAdminClient(cfg, "")
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:9095", a.url)
+	assert.Equal(t, "secret", a.token)
+
+	require.NoError(t, os.WriteFile(cfg, []byte("admin:\n  listen: 10.0.0.1:9096\n  token: secret\n"), 0o644))
+	a, err = newAdminClient(cfg, "")
+	require.NoError(t, err)
+	assert.Equal(t, "http://10.0.0.1:9096", a.url)
+
+	require.NoError(t, os.WriteFile(cfg, []byte("metrics: 0.0.0.0:9095\n"), 0o644))
+	_, err = newAdminClient(cfg, "")
+	assert.ErrorContains(t, err, "the admin API is disabled")
+}
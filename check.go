@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+func newCheckCommand(cfg *string) *cobra.Command {
+	return &cobra.Command{
+		Use:           "check",
+		Short:         "Validates the configuration without starting the server",
+		Long:          "Validates the configuration without starting the server.\nIn a section containing a value that cannot be decoded, only the problems found before this value are reported.",
+		Args:          cobra.ExactArgs(0),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			problems := checkConfiguration(*cfg)
+			for _, problem := range problems {
+				fmt.Fprintln(cmd.OutOrStdout(), problem)
+			}
+
+			if len(problems) > 0 {
+				return errors.Errorf("%s: %d problem(s) found", *cfg, len(problems))
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: configuration is valid\n", *cfg)
+			return nil
+		},
+	}
+}
+
+// checkConfiguration validates the given configuration file and returns all the problems found.
+func checkConfiguration(filename string) []error {
+	payload, err := os.ReadFile(filename)
+	if err != nil {
+		return []error{err}
+	}
+
+	var node yaml.Node
+	if err = yaml.Unmarshal(payload, &node); err != nil {
+		return []error{err}
+	}
+
+	problems := unknownFields(&node, reflect.TypeOf(Configuration{}), "")
+
+	var config Configuration
+	problems = append(problems, decodeConfiguration(&node, &config)...)
+
+	//
+
+	if config.Logger != "" {
+		if _, err := logrus.ParseLevel(config.Logger); err != nil {
+			problems = append(problems, errors.Wrap(err, "logger"))
+		}
+	}
+
+	if _, err := newFormatter(config.LogFormat); err != nil {
+		problems = append(problems, errors.Wrap(err, "log_format"))
+	}
+
+	if config.AccessLog != nil {
+		if err := config.AccessLog.Validate(); err != nil {
+			problems = append(problems, errors.Wrap(err, "access_log"))
+		}
+	}
+
+	if config.Admin != nil {
+		if err := config.Admin.Validate(); err != nil {
+			problems = append(problems, errors.Wrap(err, "admin"))
+		}
+		if config.Admin.Listen == "" && config.Metrics == "" {
+			problems = append(problems, errors.New("admin: listen is required when metrics is disabled"))
+		}
+	}
+
+	switch config.LookupStrategy {
+	case "", LookupStrategyFirst, LookupStrategyMajority:
+	default:
+		problems = append(problems, errors.Errorf("lookup_strategy: invalid lookup strategy: %s", config.LookupStrategy))
+	}
+
+	//
+
+	policies := map[string]Policy{DefaultPolicy: config.Policy}
+	for name, policy := range config.Policies {
+		if name == DefaultPolicy {
+			problems = append(problems, errors.Errorf("policies.%s: reserved for the root rules", DefaultPolicy))
+			continue
+		}
+		policies[name] = policy
+	}
+
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	asn := false
+	for _, name := range names {
+		policy := policies[name]
+		problems = append(problems, checkPolicy(name, policy)...)
+
+		for _, r := range append(policy.Allowlist, policy.Blocklist...) {
+			asn = asn || r.Type == RuleTypeASN
+		}
+	}
+
+	//
+
+	for i, endpoint := range config.Endpoints {
+		if err := endpoint.Validate(); err != nil {
+			problems = append(problems, errors.Wrapf(err, "endpoints[%d]", i))
+			continue
+		}
+
+		if _, ok := policies[endpoint.PolicyName()]; !ok {
+			problems = append(problems, errors.Errorf("endpoints[%d]: unknown policy %s", i, endpoint.PolicyName()))
+		}
+
+		if _, err := loadbalancer.Resolve(endpoint.Protocol, endpoint.Listen); err != nil {
+			problems = append(problems, errors.Wrapf(err, "endpoints[%d]: listen", i))
+		}
+
+		for j, backend := range endpoint.Backends {
+			if err := resolveBackend(endpoint.Protocol, backend); err != nil {
+				problems = append(problems, errors.Wrapf(err, "endpoints[%d]: backends[%d]", i, j))
+			}
+		}
+
+		for j, route := range endpoint.Routes {
+			for k, backend := range route.Backends {
+				if err := resolveBackend(endpoint.Protocol, backend); err != nil {
+					problems = append(problems, errors.Wrapf(err, "endpoints[%d]: routes[%d]: backends[%d]", i, j, k))
+				}
+			}
+		}
+	}
+
+	//
+
+	asndb := false
+	for i, database := range config.Databases {
+		var l any
+		if database.ASN {
+			asndb = true
+			l, err = openASNDatabase(database)
+		} else {
+			l, err = openDatabase(database)
+		}
+
+		if err != nil {
+			problems = append(problems, errors.Wrapf(err, "databases[%d]", i))
+			continue
+		}
+
+		if closer, ok := l.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
+	if asn && !asndb {
+		problems = append(problems, errors.New("databases: asn rules require an ASN database"))
+	}
+
+	return problems
+}
+
+// decodeConfiguration decodes each section of the configuration separately,
+// so a value that cannot be decoded does not hide the problems of the other sections.
+func decodeConfiguration(node *yaml.Node, config *Configuration) []error {
+	if node.Kind == yaml.DocumentNode && len(node.Content) == 1 {
+		node = node.Content[0]
+	}
+
+	if node.Kind != yaml.MappingNode {
+		if err := node.Decode(config); err != nil {
+			return []error{err}
+		}
+		return nil
+	}
+
+	var problems []error
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		section := &yaml.Node{
+			Kind:    yaml.MappingNode,
+			Tag:     "!!map",
+			Content: node.Content[i : i+2],
+		}
+
+		err := section.Decode(config)
+
+		var terr *yaml.TypeError
+		switch {
+		case errors.As(err, &terr):
+			for _, message := range terr.Errors {
+				problems = append(problems, errors.New(message))
+			}
+		case err != nil:
+			problems = append(problems, err)
+		}
+	}
+
+	return problems
+}
+
+// checkPolicy validates each rule of the given policy.
+func checkPolicy(name string, policy Policy) []error {
+	var problems []error
+
+	switch policy.DefaultAction {
+	case "", DefaultActionAllow, DefaultActionBlock:
+	default:
+		problems = append(problems, errors.Errorf("%s: invalid default action: %s", name, policy.DefaultAction))
+	}
+
+	e := &Evaluator{name: name}
+	check := func(list string, rules []Rule) {
+		for i, r := range rules {
+			if _, err := e.list([]Rule{r}); err != nil {
+				problems = append(problems, errors.Wrapf(err, "%s[%d]", list, i))
+			}
+		}
+	}
+	check("allowlist", policy.Allowlist)
+	check("blocklist", policy.Blocklist)
+
+	return problems
+}
+
+// unknownFields returns an error for each mapping key of the node that does not match a field of the given type.
+func unknownFields(node *yaml.Node, t reflect.Type, path string) []error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var problems []error
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			problems = append(problems, unknownFields(n, t, path)...)
+		}
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+
+		for i, n := range node.Content {
+			problems = append(problems, unknownFields(n, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			p := strings.TrimPrefix(path+"."+key.Value, ".")
+
+			switch t.Kind() {
+			case reflect.Map:
+				problems = append(problems, unknownFields(value, t.Elem(), p)...)
+			case reflect.Struct:
+				field, ok := yamlFields(t)[key.Value]
+				if !ok {
+					problems = append(problems, errors.Errorf("line %d: %s: unknown field", key.Line, p))
+					continue
+				}
+
+				problems = append(problems, unknownFields(value, field, p)...)
+			}
+		}
+	}
+
+	return problems
+}
+
+// yamlFields returns the types of the struct fields indexed by their YAML name.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+
+		if strings.Contains(options, "inline") {
+			for k, v := range yamlFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+
+	return fields
+}
+
+// resolveBackend checks that the backend resolves to at least one address.
+func resolveBackend(protocol string, backend Backend) error {
+	backends, err := loadbalancer.Lookup(context.Background(), net.DefaultResolver, loadbalancer.Backend{Address: backend.Address})
+	if err != nil {
+		return err
+	}
+
+	for _, b := range backends {
+		if _, err := loadbalancer.Resolve(protocol, b.Address); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
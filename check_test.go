@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConfiguration(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "geoblock-proxy.yml")
+
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(filename, []byte(content), 0o644))
+	}
+
+	write(`
+logger: info
+endpoints:
+- tcp://127.0.0.1:7777?backend=127.0.0.1:7778
+- protocol: udp
+  listen: 127.0.0.1:7777
+  backends:
+  - 127.0.0.1:7778
+default_action: block
+allowlist:
+- type: cidr
+  value: 127.0.0.0/8
+`)
+	assert.Empty(t, checkConfiguration(filename))
+
+	write(`
+logger: verbose
+metric: 127.0.0.1:9095
+endpoints:
+- tcp://127.0.0.1:7777?backend=127.0.0.1:7778&policy=missing
+- protocol: udp
+  listen: 127.0.0.1:7777
+  backend:
+  - 127.0.0.1:7778
+databases:
+- path: missing.mmdb
+default_action: drop
+allowlist:
+- type: cidr
+  value: 127.0.0.0/33
+- type: asn
+  value: AS14061
+policies:
+  ssh:
+    blocklist:
+    - type: region
+      value: eu
+`)
+
+	var messages []string
+	for _, problem := range checkConfiguration(filename) {
+		messages = append(messages, problem.Error())
+	}
+
+	expected := []string{
+		"line 3: metric: unknown field",
+		"line 8: endpoints[1].backend: unknown field",
+		"logger: not a valid logrus Level",
+		"default: invalid default action: drop",
+		"allowlist[0]: default: invalid cidr rule: invalid CIDR address: 127.0.0.0/33",
+		"blocklist[0]: ssh: invalid rule type: region",
+		"endpoints[0]: unknown policy missing",
+		"endpoints[1]: missing backends",
+		"databases[0]: mmdb: missing.mmdb",
+		"databases: asn rules require an ASN database",
+	}
+
+	require.Len(t, messages, len(expected), "%q", messages)
+	for i, message := range expected {
+		assert.Contains(t, messages[i], message)
+	}
+
+	// The decoding errors do not hide the problems of the other sections.
+	write(`
+drain_timeout: soon
+endpoints:
+- tcp://127.0.0.1:7777?backend=127.0.0.1:7778&policy=missing
+- tcp://127.0.0.1:7777?backend=127.0.0.1:7778;weight=0
+watch: [1m]
+default_action: drop
+`)
+
+	messages = nil
+	for _, problem := range checkConfiguration(filename) {
+		messages = append(messages, problem.Error())
+	}
+
+	expected = []string{
+		"line 2: cannot unmarshal !!str `soon` into time.Duration",
+		"endpoints[1]: invalid endpoint DSN: 127.0.0.1:7778: invalid weight",
+		"line 6: cannot unmarshal !!seq into time.Duration",
+		"default: invalid default action: drop",
+		"endpoints[0]: unknown policy missing",
+	}
+
+	require.Len(t, messages, len(expected), "%q", messages)
+	for i, message := range expected {
+		assert.Contains(t, messages[i], message)
+	}
+
+	assert.NotEmpty(t, checkConfiguration(filepath.Join(t.TempDir(), "missing.yml")))
+}
@@ -2,12 +2,56 @@ package main
 
 // Based on https://github.com/mdouchement/geoblock
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/accesslog"
+	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/mdouchement/geoblock-proxy/netset"
+	"github.com/mdouchement/geoblock-proxy/proxy"
+	"gopkg.in/yaml.v3"
+)
+
 // Rule data types.
 const (
 	RuleTypeCountry RuleType = "country"
 	RuleTypeCIDR    RuleType = "cidr"
+	RuleTypeASN     RuleType = "asn"
+	RuleTypeFile    RuleType = "file" // FireHOL-style netset file (one CIDR or IP per line)
+	RuleTypeBan     RuleType = "ban"  // Runtime ban added with the admin API, it cannot be configured.
+)
+
+// Supported database types.
+const (
+	DatabaseTypeIP2location DatabaseType = "ip2location"
+	DatabaseTypeMMDB        DatabaseType = "mmdb"
+)
+
+// Supported lookup strategies.
+const (
+	LookupStrategyFirst    = "first"
+	LookupStrategyMajority = "majority"
 )
 
+// DefaultDialTimeout is the default maximum duration to connect a TCP backend.
+const DefaultDialTimeout = 10 * time.Second
+
+// DefaultDialAttempts is the default maximum number of backends tried to connect a TCP client.
+const DefaultDialAttempts = 3
+
+// DefaultDrainTimeout is the default maximum duration to wait for the active connections on shutdown.
+const DefaultDrainTimeout = 30 * time.Second
+
+// DefaultPolicy is the name of the policy defined at the root of the configuration.
+const DefaultPolicy = "default"
+
 // Supported default actions.
 const (
 	DefaultActionAllow = "allow"
@@ -17,13 +61,115 @@ const (
 type (
 	// A Configuration defines the proxy configuration.
 	Configuration struct {
-		Endpoints     []string `yaml:"endpoints"`
-		Metrics       string   `yaml:"metrics"`
-		Logger        string   `yaml:"logger"`
-		Databases     []string `yaml:"databases"`      // Path to ip2location database files.
-		DefaultAction string   `yaml:"default_action"` // Default action to perform when there is no specified rule.
-		Allowlist     []Rule   `yaml:"allowlist"`
-		Blocklist     []Rule   `yaml:"blocklist"`
+		Endpoints      Endpoints         `yaml:"endpoints"`
+		Metrics        string            `yaml:"metrics"`
+		Logger         string            `yaml:"logger"`
+		LogFormat      string            `yaml:"log_format"`    // text, json or logfmt (default text).
+		LogOutput      string            `yaml:"log_output"`    // stderr, stdout, syslog or the path of a file (default stderr).
+		Watch          time.Duration     `yaml:"watch"`         // Interval used to check configuration file changes, disabled when zero.
+		DrainTimeout   time.Duration     `yaml:"drain_timeout"` // Maximum duration to wait for the active connections on shutdown (default 30s).
+		AccessLog      *AccessLog        `yaml:"access_log"`    // Log of the connections, disabled when omitted.
+		Admin          *Admin            `yaml:"admin"`         // Admin API, disabled when omitted.
+		BanFile        string            `yaml:"ban_file"`      // File persisting the runtime bans, kept in memory when empty.
+		Databases      []Database        `yaml:"databases"`
+		LookupStrategy string            `yaml:"lookup_strategy"` // How the answers of the databases are combined (first or majority).
+		ListsRefresh   time.Duration     `yaml:"lists_refresh"`   // Interval used to check the `file' rules changes (default 1m).
+		Policy         `yaml:",inline"`  // The default policy.
+		Policies       map[string]Policy `yaml:"policies"` // Named policies that can be attached to endpoints.
+	}
+
+	// A Policy defines the rules applied to the incoming connections of an endpoint.
+	Policy struct {
+		DefaultAction string `yaml:"default_action"` // Default action to perform when there is no specified rule.
+		Allowlist     []Rule `yaml:"allowlist"`
+		Blocklist     []Rule `yaml:"blocklist"`
+	}
+
+	// Endpoints is the list of the proxy endpoints.
+	Endpoints []Endpoint
+
+	// An Endpoint defines a proxy frontend and the backends it forwards to.
+	// It can be written as a DSN: protocol://frontend?backend=backend-1&backend=backend-2&policy=name
+	Endpoint struct {
+		Protocol string          `yaml:"protocol"` // tcp or udp
+		Listen   string          `yaml:"listen"`   // Frontend address
+		Backends []Backend       `yaml:"backends"` // Default backends, used when no route matches.
+		Routes   []Route         `yaml:"routes"`   // Evaluated in order, the first matching route is used.
+		Options  EndpointOptions `yaml:"options"`
+	}
+
+	// A Route forwards the clients located in one of its countries or CIDRs to its own backends.
+	Route struct {
+		Countries []string  `yaml:"countries"`
+		CIDRs     []string  `yaml:"cidrs"` // CIDRs or IPs
+		Backends  []Backend `yaml:"backends"`
+	}
+
+	// A Backend defines an upstream service protected by the proxy.
+	// It can be written as a plain address, optionally followed by its attributes (e.g. host:port;weight=3).
+	Backend struct {
+		Address string `yaml:"address"`
+		Weight  int    `yaml:"weight"` // Relative share of the connections with the weighted strategies (default 1).
+	}
+
+	// EndpointOptions defines the optional settings of an endpoint.
+	EndpointOptions struct {
+		Policy      string        `yaml:"policy"`       // Name of the policy applied to the incoming connections.
+		Balance     string        `yaml:"balance"`      // Loadbalancing strategy (round_robin, weighted_round_robin, least_connections or source_hash).
+		DialTimeout time.Duration `yaml:"dial_timeout"` // Maximum duration to connect a TCP backend (default 10s).
+		UDPTimeout  time.Duration `yaml:"udp_timeout"`  // Duration after which an idle UDP flow is forgotten.
+		// Maximum number of backends tried to connect a TCP client (default 3).
+		DialAttempts int `yaml:"dial_attempts"`
+		// A TCP backend is ejected for fail_timeout (default 30s) after max_fails (default 3) consecutive connection failures.
+		MaxFails    int           `yaml:"max_fails"`
+		FailTimeout time.Duration `yaml:"fail_timeout"`
+		// PROXY protocol version (1 or 2) used to send the client address to the backends, disabled when zero.
+		// UDP only supports the version 2.
+		ProxyProtocol int `yaml:"proxy_protocol"`
+		// Networks (CIDR or IP) of the load balancers chained in front of the endpoint (TCP only).
+		// Their connections must start with a PROXY protocol header carrying the client address.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+		// Active health checks of the backends, disabled when omitted.
+		HealthCheck *HealthCheck `yaml:"health_check"`
+		// Duration between two DNS resolutions of the backends defined by hostname or SRV record (default 30s).
+		ResolveInterval time.Duration `yaml:"resolve_interval"`
+	}
+
+	// A HealthCheck defines how the backends of an endpoint are probed.
+	// A TCP backend is healthy when it accepts connections and an UDP backend when it answers to the sent payload.
+	HealthCheck struct {
+		Interval time.Duration `yaml:"interval"` // Duration between two probes (default 10s).
+		Timeout  time.Duration `yaml:"timeout"`  // Maximum duration of a probe (default 2s).
+		Rise     int           `yaml:"rise"`     // Consecutive successful probes needed to mark a backend up (default 2).
+		Fall     int           `yaml:"fall"`     // Consecutive failed probes needed to mark a backend down (default 3).
+		Send     string        `yaml:"send"`     // Payload sent to the backend, required for UDP.
+		Expect   string        `yaml:"expect"`   // Expected beginning of the backend response.
+	}
+
+	// An AccessLog defines where and how the connections are logged.
+	AccessLog struct {
+		Format     string `yaml:"format"`      // json (default) or logfmt.
+		Output     string `yaml:"output"`      // stdout (default) or the path of a file.
+		MaxSize    int    `yaml:"max_size"`    // Size in megabytes after which the file is rotated (default 100).
+		MaxBackups int    `yaml:"max_backups"` // Number of rotated files kept (default 5).
+	}
+
+	// An Admin defines the admin API.
+	Admin struct {
+		Listen string `yaml:"listen"` // Listen address, the metrics one when empty.
+		Token  string `yaml:"token"`  // Bearer token required by all the requests.
+	}
+
+	// A DatabaseType defines the format of a database file.
+	DatabaseType string
+
+	// A Database defines a database file used to lookup IP addresses.
+	// It can be written as a plain path, the type is then guessed from the file extension.
+	Database struct {
+		Path         string       `yaml:"path"`
+		Type         DatabaseType `yaml:"type"`
+		ASN          bool         `yaml:"asn"`           // Use the database for Autonomous System lookups instead of country ones.
+		IgnoreErrors bool         `yaml:"ignore_errors"` // Skip the database when the lookup fails instead of failing the evaluation.
 	}
 
 	// A RuleType defines the type of a rule.
@@ -35,3 +181,322 @@ type (
 		Value string
 	}
 )
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *Database) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		d.Path = value.Value
+		return nil
+	}
+
+	type database Database // Avoid recursive calls to UnmarshalYAML
+	return value.Decode((*database)(d))
+}
+
+// Kind returns the type of the database, guessed from the file extension when not specified.
+func (d Database) Kind() DatabaseType {
+	if d.Type != "" {
+		return d.Type
+	}
+
+	if strings.EqualFold(filepath.Ext(d.Path), ".mmdb") {
+		return DatabaseTypeMMDB
+	}
+	return DatabaseTypeIP2location
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+// The errors of an endpoint are prefixed by its index, like the validation ones.
+func (e *Endpoints) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.SequenceNode {
+		type endpoints Endpoints // Avoid recursive calls to UnmarshalYAML
+		return value.Decode((*endpoints)(e))
+	}
+
+	*e = make(Endpoints, len(value.Content))
+
+	terr := &yaml.TypeError{}
+	for i, n := range value.Content {
+		err := n.Decode(&(*e)[i])
+
+		var te *yaml.TypeError
+		switch {
+		case errors.As(err, &te):
+			terr.Errors = append(terr.Errors, te.Errors...) // Keep decoding like yaml does
+		case err != nil:
+			*e = (*e)[:i] // Only the decoded endpoints
+			return fmt.Errorf("endpoints[%d]: %w", i, err)
+		}
+	}
+
+	if len(terr.Errors) > 0 {
+		return terr
+	}
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (e *Endpoint) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		protocol, frontend, backends, err := loadbalancer.ParseDSN(value.Value)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint DSN: %w", err)
+		}
+
+		u, _ := url.Parse(value.Value) // Already validated by ParseDSN.
+
+		e.Protocol = protocol
+		e.Listen = frontend
+		e.Options.Policy = u.Query().Get("policy")
+		for _, backend := range backends {
+			b, err := loadbalancer.ParseBackend(backend)
+			if err != nil {
+				return fmt.Errorf("invalid endpoint DSN: %w", err)
+			}
+			e.Backends = append(e.Backends, Backend{Address: b.Address, Weight: b.Weight})
+		}
+		return nil
+	}
+
+	type endpoint Endpoint // Avoid recursive calls to UnmarshalYAML
+	return value.Decode((*endpoint)(e))
+}
+
+// Validate checks the endpoint definition.
+func (e Endpoint) Validate() error {
+	switch e.Protocol {
+	case loadbalancer.ProtocolTCP, loadbalancer.ProtocolUDP:
+	default:
+		return fmt.Errorf("unsupported protocol: %q", e.Protocol)
+	}
+
+	if e.Listen == "" {
+		return errors.New("missing listen address")
+	}
+
+	if err := validateBackends(e.Backends); err != nil {
+		return err
+	}
+
+	for i, route := range e.Routes {
+		if err := route.Validate(); err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+	}
+
+	switch e.Options.Balance {
+	case "", loadbalancer.StrategyRoundRobin, loadbalancer.StrategyWeightedRoundRobin, loadbalancer.StrategyLeastConnections,
+		loadbalancer.StrategySourceHash:
+	default:
+		return fmt.Errorf("unsupported balance strategy: %q", e.Options.Balance)
+	}
+
+	if e.Options.DialTimeout < 0 || e.Options.UDPTimeout < 0 || e.Options.FailTimeout < 0 || e.Options.ResolveInterval < 0 {
+		return errors.New("timeouts must be positive")
+	}
+
+	if e.Options.DialAttempts < 0 || e.Options.MaxFails < 0 {
+		return errors.New("dial_attempts and max_fails must be positive")
+	}
+
+	switch e.Options.ProxyProtocol {
+	case 0, proxy.ProxyProtocolV2:
+	case proxy.ProxyProtocolV1:
+		if e.Protocol == loadbalancer.ProtocolUDP {
+			return errors.New("proxy_protocol: version 1 does not support udp")
+		}
+	default:
+		return fmt.Errorf("unsupported proxy_protocol version: %d", e.Options.ProxyProtocol)
+	}
+
+	if len(e.Options.TrustedProxies) > 0 && e.Protocol != loadbalancer.ProtocolTCP {
+		return fmt.Errorf("trusted_proxies: unsupported protocol: %q", e.Protocol)
+	}
+
+	if _, err := e.TrustedProxies(); err != nil {
+		return err
+	}
+
+	if hc := e.Options.HealthCheck; hc != nil {
+		if hc.Interval < 0 || hc.Timeout < 0 || hc.Rise < 0 || hc.Fall < 0 {
+			return errors.New("health_check: values must be positive")
+		}
+
+		if e.Protocol == loadbalancer.ProtocolUDP && hc.Send == "" {
+			return errors.New("health_check: send is required for udp")
+		}
+	}
+
+	return nil
+}
+
+// PolicyName returns the name of the policy attached to the endpoint.
+func (e Endpoint) PolicyName() string {
+	if e.Options.Policy == "" {
+		return DefaultPolicy
+	}
+	return e.Options.Policy
+}
+
+// Upstreams returns the loadbalancer representation of the backends.
+func (e Endpoint) Upstreams() []loadbalancer.Backend {
+	return upstreams(e.Backends)
+}
+
+// Frontend returns the protocol and listen address of the endpoint (e.g. tcp://0.0.0.0:22).
+func (e Endpoint) Frontend() string {
+	return e.Protocol + "://" + e.Listen
+}
+
+// TrustedProxies returns the parsed networks of the trusted load balancers.
+func (e Endpoint) TrustedProxies() ([]*net.IPNet, error) {
+	blocks := make([]*net.IPNet, 0, len(e.Options.TrustedProxies))
+	for i, s := range e.Options.TrustedProxies {
+		block, err := netset.ParseBlock(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies[%d]: %w", i, err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// String returns the DSN representation of the endpoint.
+func (e Endpoint) String() string {
+	q := url.Values{}
+	for _, upstream := range e.Upstreams() {
+		q.Add("backend", upstream.String())
+	}
+	if e.Options.Policy != "" {
+		q.Set("policy", e.Options.Policy)
+	}
+
+	u := url.URL{
+		Scheme:   e.Protocol,
+		Host:     e.Listen,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// key returns a representation of the whole endpoint definition, used to detect changes.
+func (e Endpoint) key() string {
+	payload, _ := json.Marshal(e) // Cannot fail, only plain types
+	return string(payload)
+}
+
+// Validate checks the route definition.
+func (r Route) Validate() error {
+	if len(r.Countries) == 0 && len(r.CIDRs) == 0 {
+		return errors.New("missing countries or cidrs")
+	}
+
+	for i, country := range r.Countries {
+		if len(country) != 2 {
+			return fmt.Errorf("countries[%d]: invalid country code: %q", i, country)
+		}
+	}
+
+	if _, err := r.Blocks(); err != nil {
+		return err
+	}
+
+	return validateBackends(r.Backends)
+}
+
+// Blocks returns the parsed CIDRs of the route.
+func (r Route) Blocks() ([]*net.IPNet, error) {
+	blocks := make([]*net.IPNet, 0, len(r.CIDRs))
+	for i, s := range r.CIDRs {
+		block, err := netset.ParseBlock(s)
+		if err != nil {
+			return nil, fmt.Errorf("cidrs[%d]: %w", i, err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// Upstreams returns the loadbalancer representation of the backends.
+func (r Route) Upstreams() []loadbalancer.Backend {
+	return upstreams(r.Backends)
+}
+
+func validateBackends(backends []Backend) error {
+	if len(backends) == 0 {
+		return errors.New("missing backends")
+	}
+
+	for i, backend := range backends {
+		if backend.Address == "" {
+			return fmt.Errorf("backends[%d]: missing address", i)
+		}
+
+		if backend.Weight < 0 {
+			return fmt.Errorf("backends[%d]: weight must be positive", i)
+		}
+	}
+
+	return nil
+}
+
+func upstreams(backends []Backend) []loadbalancer.Backend {
+	upstreams := make([]loadbalancer.Backend, len(backends))
+	for i, backend := range backends {
+		upstreams[i] = loadbalancer.Backend{Address: backend.Address, Weight: backend.Weight}
+	}
+	return upstreams
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (b *Backend) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		backend, err := loadbalancer.ParseBackend(value.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid backend: %w", value.Line, err)
+		}
+
+		b.Address = backend.Address
+		b.Weight = backend.Weight
+		return nil
+	}
+
+	type backend Backend // Avoid recursive calls to UnmarshalYAML
+	return value.Decode((*backend)(b))
+}
+
+// options returns the loadbalancer representation of the health check.
+func (hc HealthCheck) options() loadbalancer.HealthCheck {
+	return loadbalancer.HealthCheck{
+		Interval: hc.Interval,
+		Timeout:  hc.Timeout,
+		Rise:     hc.Rise,
+		Fall:     hc.Fall,
+		Send:     []byte(hc.Send),
+		Expect:   []byte(hc.Expect),
+	}
+}
+
+// Validate checks the access log definition.
+func (a AccessLog) Validate() error {
+	switch a.Format {
+	case "", accesslog.FormatJSON, accesslog.FormatLogfmt:
+	default:
+		return fmt.Errorf("unsupported format: %q", a.Format)
+	}
+
+	if a.MaxSize < 0 || a.MaxBackups < 0 {
+		return errors.New("max_size and max_backups must be positive")
+	}
+
+	return nil
+}
+
+// Validate checks the admin API definition.
+func (a Admin) Validate() error {
+	if a.Token == "" {
+		return errors.New("missing token")
+	}
+
+	return nil
+}
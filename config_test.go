@@ -0,0 +1,212 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestConfiguration_Endpoints(t *testing.T) {
+	var config Configuration
+	err := yaml.Unmarshal([]byte(`
+endpoints:
+- tcp://localhost:7777?backend=localhost:7778&backend=localhost:7779&policy=ssh
+- protocol: udp
+  listen: 0.0.0.0:27015
+  backends:
+  - 10.0.0.1:27015
+  - address: 10.0.0.2:27015
+  options:
+    policy: game
+    balance: round_robin
+    dial_timeout: 5s
+    udp_timeout: 2m
+`), &config)
+	require.NoError(t, err)
+	require.Len(t, config.Endpoints, 2)
+
+	assert.Equal(t, Endpoint{
+		Protocol: "tcp",
+		Listen:   "localhost:7777",
+		Backends: []Backend{{Address: "localhost:7778"}, {Address: "localhost:7779"}},
+		Options:  EndpointOptions{Policy: "ssh"},
+	}, config.Endpoints[0])
+	assert.Equal(t, "tcp://localhost:7777?backend=localhost%3A7778&backend=localhost%3A7779&policy=ssh", config.Endpoints[0].String())
+
+	assert.Equal(t, Endpoint{
+		Protocol: "udp",
+		Listen:   "0.0.0.0:27015",
+		Backends: []Backend{{Address: "10.0.0.1:27015"}, {Address: "10.0.0.2:27015"}},
+		Options: EndpointOptions{
+			Policy:      "game",
+			Balance:     "round_robin",
+			DialTimeout: 5 * time.Second,
+			UDPTimeout:  2 * time.Minute,
+		},
+	}, config.Endpoints[1])
+	assert.Equal(t, "game", config.Endpoints[1].PolicyName())
+
+	for _, endpoint := range config.Endpoints {
+		assert.NoError(t, endpoint.Validate())
+	}
+}
+
+func TestConfiguration_EndpointWeights(t *testing.T) {
+	var config Configuration
+	err := yaml.Unmarshal([]byte(`
+endpoints:
+- tcp://localhost:7777?backend=localhost:7778;weight=3&backend=localhost:7779
+- protocol: tcp
+  listen: localhost:8888
+  backends:
+  - localhost:8889;weight=2
+  - address: localhost:8890
+    weight: 5
+  options:
+    balance: least_connections
+`), &config)
+	require.NoError(t, err)
+	require.Len(t, config.Endpoints, 2)
+
+	assert.Equal(t, []Backend{{Address: "localhost:7778", Weight: 3}, {Address: "localhost:7779"}}, config.Endpoints[0].Backends)
+	assert.Equal(t, "tcp://localhost:7777?backend=localhost%3A7778%3Bweight%3D3&backend=localhost%3A7779", config.Endpoints[0].String())
+	assert.Equal(t, []Backend{{Address: "localhost:8889", Weight: 2}, {Address: "localhost:8890", Weight: 5}}, config.Endpoints[1].Backends)
+
+	for _, endpoint := range config.Endpoints {
+		assert.NoError(t, endpoint.Validate())
+	}
+
+	err = yaml.Unmarshal([]byte(`
+endpoints:
+- tcp://localhost:7777
+- tcp://localhost:7777?backend=localhost:7778;weight=0
+`), &config)
+	assert.ErrorContains(t, err, "endpoints[1]: invalid endpoint DSN: localhost:7778: invalid weight")
+
+	err = yaml.Unmarshal([]byte(`
+endpoints:
+- protocol: [tcp]
+- options: {dial_attempts: many}
+`), &config)
+	var terr *yaml.TypeError
+	require.ErrorAs(t, err, &terr)
+	assert.Len(t, terr.Errors, 2, "the type errors of all the endpoints are reported")
+}
+
+func TestConfiguration_EndpointRoutes(t *testing.T) {
+	var config Configuration
+	err := yaml.Unmarshal([]byte(`
+endpoints:
+- protocol: tcp
+  listen: localhost:8888
+  backends:
+  - localhost:8889
+  routes:
+  - countries: [FR, de]
+    backends:
+    - localhost:8890
+    - localhost:8891;weight=2
+  - cidrs: [10.0.0.0/8, 192.168.1.1]
+    backends:
+    - localhost:8892
+`), &config)
+	require.NoError(t, err)
+	require.Len(t, config.Endpoints, 1)
+
+	endpoint := config.Endpoints[0]
+	require.NoError(t, endpoint.Validate())
+	require.Len(t, endpoint.Routes, 2)
+
+	assert.Equal(t, []string{"FR", "de"}, endpoint.Routes[0].Countries)
+	assert.Equal(t, []Backend{{Address: "localhost:8890"}, {Address: "localhost:8891", Weight: 2}}, endpoint.Routes[0].Backends)
+
+	blocks, err := endpoint.Routes[1].Blocks()
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	assert.Equal(t, "10.0.0.0/8", blocks[0].String())
+	assert.Equal(t, "192.168.1.1/32", blocks[1].String())
+}
+
+func TestEndpoint_Validate(t *testing.T) {
+	valid := Endpoint{
+		Protocol: "tcp",
+		Listen:   "localhost:7777",
+		Backends: []Backend{{Address: "localhost:7778"}},
+	}
+	assert.NoError(t, valid.Validate())
+	assert.Equal(t, DefaultPolicy, valid.PolicyName())
+
+	tests := map[string]func(e *Endpoint){
+		"unsupported protocol":                         func(e *Endpoint) { e.Protocol = "sctp" },
+		"missing listen address":                       func(e *Endpoint) { e.Listen = "" },
+		"missing backends":                             func(e *Endpoint) { e.Backends = nil },
+		"backends[0]: missing address":                 func(e *Endpoint) { e.Backends[0].Address = "" },
+		"unsupported balance strategy":                 func(e *Endpoint) { e.Options.Balance = "random" },
+		"timeouts must be positive":                    func(e *Endpoint) { e.Options.DialTimeout = -time.Second },
+		"unsupported proxy_protocol":                   func(e *Endpoint) { e.Options.ProxyProtocol = 3 },
+		"dial_attempts and max_fails must be positive": func(e *Endpoint) { e.Options.MaxFails = -1 },
+		"does not support udp": func(e *Endpoint) {
+			e.Protocol = "udp"
+			e.Options.ProxyProtocol = 1
+		},
+		"trusted_proxies[1]: invalid IP address": func(e *Endpoint) { e.Options.TrustedProxies = []string{"10.0.0.0/8", "10.0.0"} },
+		"trusted_proxies: unsupported protocol": func(e *Endpoint) {
+			e.Protocol = "udp"
+			e.Options.TrustedProxies = []string{"10.0.0.0/8"}
+		},
+		"health_check: values must be positive": func(e *Endpoint) { e.Options.HealthCheck = &HealthCheck{Fall: -1} },
+		"health_check: send is required for udp": func(e *Endpoint) {
+			e.Protocol = "udp"
+			e.Options.HealthCheck = &HealthCheck{}
+		},
+		"routes[0]: missing countries or cidrs": func(e *Endpoint) {
+			e.Routes = []Route{{Backends: []Backend{{Address: "localhost:7779"}}}}
+		},
+		"routes[0]: countries[0]: invalid country code": func(e *Endpoint) {
+			e.Routes = []Route{{Countries: []string{"fra"}, Backends: []Backend{{Address: "localhost:7779"}}}}
+		},
+		"routes[0]: cidrs[0]: invalid IP address": func(e *Endpoint) {
+			e.Routes = []Route{{CIDRs: []string{"10.0.0"}, Backends: []Backend{{Address: "localhost:7779"}}}}
+		},
+		"routes[0]: missing backends": func(e *Endpoint) { e.Routes = []Route{{Countries: []string{"fr"}}} },
+	}
+
+	for expected, alter := range tests {
+		e := valid
+		e.Backends = append([]Backend{}, valid.Backends...)
+		alter(&e)
+
+		err := e.Validate()
+		if assert.Error(t, err, expected) {
+			assert.Contains(t, err.Error(), expected)
+		}
+	}
+}
+
+func TestAccessLog_Validate(t *testing.T) {
+	assert.NoError(t, AccessLog{}.Validate())
+	assert.NoError(t, AccessLog{Format: "logfmt", Output: "/var/log/geoblock-proxy/access.log", MaxSize: 10, MaxBackups: 3}.Validate())
+
+	err := AccessLog{Format: "xml"}.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unsupported format")
+	}
+
+	err = AccessLog{MaxBackups: -1}.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "must be positive")
+	}
+}
+
+func TestAdmin_Validate(t *testing.T) {
+	assert.NoError(t, Admin{Token: "secret"}.Validate())
+	assert.NoError(t, Admin{Listen: "127.0.0.1:9096", Token: "secret"}.Validate())
+
+	err := Admin{Listen: "127.0.0.1:9096"}.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "missing token")
+	}
+}
@@ -3,108 +3,411 @@ package main
 // https://github.com/mdouchement/geoblock/blob/main/evaluator.go
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"strings"
 
+	"github.com/mdouchement/geoblock-proxy/banlist"
+	"github.com/mdouchement/geoblock-proxy/iptrie"
+	"github.com/mdouchement/geoblock-proxy/netset"
 	"github.com/mdouchement/geoblock/lookup"
 )
 
-// An Evaluator evaluates whether an IP is allowed or blocked.
-type Evaluator struct {
-	name    string
-	lookups []lookup.Lookup
+type (
+	// An Evaluator evaluates whether an IP is allowed or blocked.
+	Evaluator struct {
+		name       string
+		policy     Policy
+		strategy   string
+		lookups    []source[string]
+		asnlookups []source[uint]
 
-	fallback       string
-	allowedCIDR    []*net.IPNet
-	allowedCountry map[string]bool
-	blockedCIDR    []*net.IPNet
-	blockedCountry map[string]bool
-}
+		fallback  string
+		bans      *banlist.List // Evaluated before the rules, none when nil.
+		databases *Databases    // Closed along with the evaluator, none when nil.
+		allowed   ruleset
+		blocked   ruleset
+	}
+
+	// Databases holds the database files shared by the evaluators of a configuration.
+	Databases struct {
+		closed  bool
+		closers []io.Closer
+	}
+
+	// An ASNLookup finds the Autonomous System Number of an IP.
+	ASNLookup interface {
+		ASN(ip net.IP) (uint, error)
+	}
+
+	// A Verdict is the result of an IP evaluation.
+	Verdict struct {
+		Allowed bool
+		Country string
+		ASN     uint     // Zero when unknown
+		Rule    *Rule    // The rule that decided the verdict, nil when the default action applied.
+		Answers []Answer // The answer of each database, only filled by Explain.
+	}
+
+	// An Answer is the result of a database lookup.
+	Answer struct {
+		Database string
+		Country  string
+		ASN      uint
+		Err      error
+	}
+
+	ruleset struct {
+		cidr    *iptrie.Trie
+		lists   []*netset.File
+		country map[string]bool
+		asn     map[uint]bool
+	}
+
+	source[T comparable] struct {
+		name         string
+		lookup       func(ip net.IP) (T, error)
+		ignoreErrors bool
+	}
+)
 
-// NewEvaluator returns a new Evaluator.
-func NewEvaluator(name string, c Configuration) (*Evaluator, error) {
+// NewEvaluator returns a new Evaluator for the given policy.
+func NewEvaluator(name string, p Policy, strategy string) (*Evaluator, error) {
 	e := &Evaluator{
 		name:     name,
-		fallback: c.DefaultAction,
+		policy:   p,
+		strategy: strategy,
+		fallback: p.DefaultAction,
+	}
+
+	switch e.strategy {
+	case "":
+		e.strategy = LookupStrategyFirst
+	case LookupStrategyFirst, LookupStrategyMajority:
+	default:
+		return nil, fmt.Errorf("%s: invalid lookup strategy: %s", e.name, e.strategy)
 	}
 
 	var err error
 
-	e.allowedCountry, e.allowedCIDR, err = e.list(c.Allowlist)
+	e.allowed, err = e.list(p.Allowlist)
 	if err != nil {
 		return nil, err
 	}
 
-	e.blockedCountry, e.blockedCIDR, err = e.list(c.Blocklist)
+	e.blocked, err = e.list(p.Blocklist)
 	return e, err
 }
 
-// AddLookup adds a lookup to the evaluator.
-func (e *Evaluator) AddLookup(l lookup.Lookup) {
-	e.lookups = append(e.lookups, l)
+// AddLookup adds a country lookup to the evaluator.
+// Lookups are queried in the order they are added.
+// When ignoreErrors is true, a failing lookup is skipped instead of failing the evaluation.
+func (e *Evaluator) AddLookup(name string, l lookup.Lookup, ignoreErrors bool) {
+	e.lookups = append(e.lookups, source[string]{
+		name:         name,
+		lookup:       l.Country,
+		ignoreErrors: ignoreErrors,
+	})
+}
+
+// AddASNLookup adds an ASN lookup to the evaluator.
+// Lookups are queried in the order they are added.
+// When ignoreErrors is true, a failing lookup is skipped instead of failing the evaluation.
+func (e *Evaluator) AddASNLookup(name string, l ASNLookup, ignoreErrors bool) {
+	e.asnlookups = append(e.asnlookups, source[uint]{
+		name:         name,
+		lookup:       l.ASN,
+		ignoreErrors: ignoreErrors,
+	})
+}
+
+// SetBans sets the runtime bans evaluated before the policy rules.
+func (e *Evaluator) SetBans(bans *banlist.List) {
+	e.bans = bans
+}
+
+// SetDatabases sets the databases of the lookups, closed by Close.
+func (e *Evaluator) SetDatabases(databases *Databases) {
+	e.databases = databases
+}
+
+// Close closes the databases of the evaluator, it must not be running evaluations anymore.
+// As they are shared, the other evaluators of the configuration are also closed.
+func (e *Evaluator) Close() error {
+	if e.databases == nil {
+		return nil
+	}
+	return e.databases.Close()
+}
+
+// Name returns the name of the evaluator.
+func (e *Evaluator) Name() string {
+	return e.name
+}
+
+// Policy returns the policy evaluated by the evaluator.
+func (e *Evaluator) Policy() Policy {
+	return e.policy
+}
+
+// Strategy returns the lookup strategy of the evaluator.
+func (e *Evaluator) Strategy() string {
+	return e.strategy
+}
+
+// Lists returns the list files used by the evaluator's rules.
+func (e *Evaluator) Lists() []*netset.File {
+	return append(append([]*netset.File{}, e.allowed.lists...), e.blocked.lists...)
+}
+
+// Validate checks that the evaluator has the lookups required by its rules.
+func (e *Evaluator) Validate() error {
+	if len(e.asnlookups) == 0 && (len(e.allowed.asn) > 0 || len(e.blocked.asn) > 0) {
+		return fmt.Errorf("%s: asn rules require an ASN database", e.name)
+	}
+
+	return nil
 }
 
 // Evaluate evaluates the state of the given IP.
-func (e *Evaluator) Evaluate(addr string) (allowed bool, country string, err error) {
+func (e *Evaluator) Evaluate(addr string) (Verdict, error) {
+	return e.evaluate(addr, false)
+}
+
+// Explain evaluates the state of the given IP like Evaluate and also returns the answer of every database.
+func (e *Evaluator) Explain(addr string) (Verdict, error) {
+	return e.evaluate(addr, true)
+}
+
+func (e *Evaluator) evaluate(addr string, explain bool) (v Verdict, err error) {
 	ip := net.ParseIP(addr)
 	if ip == nil {
-		return false, "", fmt.Errorf("%s: invalid IP address: %s", e.name, addr)
+		return v, fmt.Errorf("%s: invalid IP address: %s", e.name, addr)
+	}
+
+	if explain {
+		v.Answers = e.answers(ip)
 	}
 
 	//
 
-	for _, block := range e.blockedCIDR {
-		if block.Contains(ip) {
-			return false, "", nil
-		}
+	if ban, ok := e.bans.Match(ip); ok {
+		v.Rule = &Rule{Type: RuleTypeBan, Value: ban.CIDR}
+		return v, nil
 	}
 
-	for _, lookup := range e.lookups {
-		country, err = lookup.Country(ip)
-		if err != nil {
-			return false, "", fmt.Errorf("%s: country lookup: %w", e.name, err)
-		}
+	if v.Rule = e.blocked.match(ip); v.Rule != nil {
+		return v, nil
+	}
+
+	v.ASN, err = resolve(e.strategy, e.asnlookups, ip, func(asn uint) bool { return asn != 0 })
+	if err != nil {
+		return v, fmt.Errorf("%s: asn lookup: %w", e.name, err)
 	}
 
-	if e.blockedCountry[country] {
-		return false, country, nil
+	if e.blocked.asn[v.ASN] {
+		v.Rule = &Rule{Type: RuleTypeASN, Value: FormatASN(v.ASN)}
+		return v, nil
+	}
+
+	v.Country, err = resolve(e.strategy, e.lookups, ip, func(country string) bool { return country != "" && country != "-" })
+	if err != nil {
+		return v, fmt.Errorf("%s: country lookup: %w", e.name, err)
+	}
+
+	if e.blocked.country[v.Country] {
+		v.Rule = &Rule{Type: RuleTypeCountry, Value: strings.ToUpper(v.Country)}
+		return v, nil
 	}
 
 	//
 
-	for _, block := range e.allowedCIDR {
-		if block.Contains(ip) {
-			return true, country, nil
-		}
+	v.Allowed = true
+
+	if v.Rule = e.allowed.match(ip); v.Rule != nil {
+		return v, nil
 	}
 
-	if e.allowedCountry[country] {
-		return true, country, nil
+	if e.allowed.asn[v.ASN] {
+		v.Rule = &Rule{Type: RuleTypeASN, Value: FormatASN(v.ASN)}
+		return v, nil
 	}
 
-	return e.fallback == DefaultActionAllow, country, nil
+	if e.allowed.country[v.Country] {
+		v.Rule = &Rule{Type: RuleTypeCountry, Value: strings.ToUpper(v.Country)}
+		return v, nil
+	}
+
+	v.Allowed = e.fallback == DefaultActionAllow
+	return v, nil
+}
+
+// Add registers a database closed by Close.
+func (d *Databases) Add(c io.Closer) {
+	d.closers = append(d.closers, c)
 }
 
-func (e *Evaluator) list(list []Rule) (map[string]bool, []*net.IPNet, error) {
-	countries := make(map[string]bool)
-	blocks := make([]*net.IPNet, 0)
+// Close closes the databases, only the first call has an effect.
+func (d *Databases) Close() error {
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+
+	var errs []error
+	for _, c := range d.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// answers queries all the databases for the given IP.
+func (e *Evaluator) answers(ip net.IP) []Answer {
+	answers := make([]Answer, 0, len(e.lookups)+len(e.asnlookups))
+
+	for _, s := range e.lookups {
+		a := Answer{Database: s.name}
+		a.Country, a.Err = s.lookup(ip)
+		answers = append(answers, a)
+	}
+
+	for _, s := range e.asnlookups {
+		a := Answer{Database: s.name}
+		a.ASN, a.Err = s.lookup(ip)
+		answers = append(answers, a)
+	}
+
+	return answers
+}
+
+func (e *Evaluator) list(list []Rule) (ruleset, error) {
+	rs := ruleset{
+		cidr:    iptrie.New(),
+		country: make(map[string]bool),
+		asn:     make(map[uint]bool),
+	}
 
 	for _, r := range list {
 		switch r.Type {
 		case RuleTypeCountry:
-			countries[strings.ToLower(r.Value)] = true
+			rs.country[strings.ToLower(r.Value)] = true
 		case RuleTypeCIDR:
 			_, block, err := net.ParseCIDR(r.Value)
 			if err != nil {
-				return nil, nil, fmt.Errorf("%s: invalid rule type: %s", e.name, r.Type)
+				return rs, fmt.Errorf("%s: invalid cidr rule: %w", e.name, err)
+			}
+
+			rs.cidr.Insert(block)
+		case RuleTypeASN:
+			asn, err := ParseASN(r.Value)
+			if err != nil {
+				return rs, fmt.Errorf("%s: invalid asn rule: %w", e.name, err)
+			}
+
+			rs.asn[asn] = true
+		case RuleTypeFile:
+			list, err := netset.Open(r.Value)
+			if err != nil {
+				return rs, fmt.Errorf("%s: invalid file rule: %w", e.name, err)
 			}
 
-			blocks = append(blocks, block)
+			rs.lists = append(rs.lists, list)
 		default:
-			return nil, nil, fmt.Errorf("%s: invalid rule type: %s", e.name, r.Type)
+			return rs, fmt.Errorf("%s: invalid rule type: %s", e.name, r.Type)
 		}
 	}
 
-	return countries, blocks, nil
+	return rs, nil
+}
+
+// match returns the CIDR or file rule containing the given IP.
+func (rs ruleset) match(ip net.IP) *Rule {
+	if block := rs.cidr.Match(ip); block != nil {
+		return &Rule{Type: RuleTypeCIDR, Value: block.String()}
+	}
+
+	for _, list := range rs.lists {
+		if list.Contains(ip) {
+			return &Rule{Type: RuleTypeFile, Value: list.Path()}
+		}
+	}
+
+	return nil
+}
+
+// resolve queries the sources according to the given strategy.
+// An answer is known when the lookup found the IP in its database (e.g. ip2location answers "-" when not found).
+//
+//	first: the first known answer wins, the remaining sources are not queried.
+//	majority: the most frequent known answer wins, ties are broken by the sources order.
+//
+// When no source knows the IP, the first answer is returned.
+func resolve[T comparable](strategy string, sources []source[T], ip net.IP, known func(T) bool) (T, error) {
+	var (
+		answer  T
+		answers []T
+		votes   = make(map[T]int)
+		lasterr error
+	)
+
+	for _, s := range sources {
+		v, err := s.lookup(ip)
+		if err != nil {
+			if !s.ignoreErrors {
+				return answer, fmt.Errorf("%s: %w", s.name, err)
+			}
+
+			lasterr = fmt.Errorf("%s: %w", s.name, err)
+			continue
+		}
+
+		answers = append(answers, v)
+		if !known(v) {
+			continue
+		}
+
+		if strategy == LookupStrategyFirst {
+			return v, nil
+		}
+		votes[v]++
+	}
+
+	if len(answers) == 0 {
+		return answer, lasterr // All the sources failed (or there is no source at all).
+	}
+
+	answer = answers[0]
+	best := 0
+	for _, v := range answers {
+		if votes[v] > best {
+			answer = v
+			best = votes[v]
+		}
+	}
+
+	return answer, nil
+}
+
+// ParseASN parses an Autonomous System Number written as `AS14061' or `14061'.
+func ParseASN(s string) (uint, error) {
+	v := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "AS")
+
+	asn, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || asn == 0 {
+		return 0, fmt.Errorf("invalid ASN: %s", s)
+	}
+
+	return uint(asn), nil
+}
+
+// FormatASN returns the ASN as `AS14061', or an empty string when unknown.
+func FormatASN(asn uint) string {
+	if asn == 0 {
+		return ""
+	}
+
+	return "AS" + strconv.FormatUint(uint64(asn), 10)
 }
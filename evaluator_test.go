@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdouchement/geoblock-proxy/banlist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	fakeLookup struct {
+		country string
+		err     error
+		calls   int
+	}
+
+	fakeASNLookup struct {
+		asn uint
+		err error
+	}
+
+	fakeCloser struct {
+		closed int
+	}
+)
+
+func (l *fakeLookup) Country(net.IP) (string, error) {
+	l.calls++
+	return l.country, l.err
+}
+
+func (l *fakeASNLookup) ASN(net.IP) (uint, error) {
+	return l.asn, l.err
+}
+
+func (c *fakeCloser) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestEvaluator_Evaluate_FirstStrategy(t *testing.T) {
+	e, err := NewEvaluator("test", Policy{DefaultAction: DefaultActionBlock}, "")
+	require.NoError(t, err)
+
+	unknown := &fakeLookup{country: "-"}
+	empty := &fakeLookup{country: ""}
+	fr := &fakeLookup{country: "fr"}
+	de := &fakeLookup{country: "de"}
+
+	e.AddLookup("unknown", unknown, false)
+	e.AddLookup("empty", empty, false)
+	e.AddLookup("fr", fr, false)
+	e.AddLookup("de", de, false)
+
+	v, err := e.Evaluate("192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "fr", v.Country)
+	assert.Equal(t, 1, fr.calls)
+	assert.Equal(t, 0, de.calls, "remaining lookups must not be queried")
+}
+
+func TestEvaluator_Evaluate_MajorityStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		lookups  []string
+		expected string
+	}{
+		{name: "majority", lookups: []string{"de", "fr", "-", "fr"}, expected: "fr"},
+		{name: "tie resolved by order", lookups: []string{"de", "fr", "fr", "de"}, expected: "de"},
+		{name: "unknown answers do not vote", lookups: []string{"-", "-", "fr"}, expected: "fr"},
+		{name: "all unknown", lookups: []string{"-", ""}, expected: "-"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := NewEvaluator("test", Policy{}, LookupStrategyMajority)
+			require.NoError(t, err)
+
+			for _, country := range test.lookups {
+				e.AddLookup(country, &fakeLookup{country: country}, false)
+			}
+
+			v, err := e.Evaluate("192.0.2.1")
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, v.Country)
+		})
+	}
+}
+
+func TestEvaluator_Evaluate_Errors(t *testing.T) {
+	failure := errors.New("corrupted database")
+
+	t.Run("not tolerated", func(t *testing.T) {
+		e, err := NewEvaluator("test", Policy{}, "")
+		require.NoError(t, err)
+
+		e.AddLookup("broken", &fakeLookup{err: failure}, false)
+		e.AddLookup("fr", &fakeLookup{country: "fr"}, false)
+
+		_, err = e.Evaluate("192.0.2.1")
+		assert.ErrorIs(t, err, failure)
+	})
+
+	t.Run("tolerated", func(t *testing.T) {
+		e, err := NewEvaluator("test", Policy{}, "")
+		require.NoError(t, err)
+
+		e.AddLookup("broken", &fakeLookup{err: failure}, true)
+		e.AddLookup("fr", &fakeLookup{country: "fr"}, false)
+
+		v, err := e.Evaluate("192.0.2.1")
+		assert.NoError(t, err)
+		assert.Equal(t, "fr", v.Country)
+	})
+
+	t.Run("all tolerated lookups failed", func(t *testing.T) {
+		e, err := NewEvaluator("test", Policy{}, "")
+		require.NoError(t, err)
+
+		e.AddLookup("broken-1", &fakeLookup{err: failure}, true)
+		e.AddLookup("broken-2", &fakeLookup{err: failure}, true)
+
+		_, err = e.Evaluate("192.0.2.1")
+		assert.ErrorIs(t, err, failure)
+	})
+}
+
+func TestEvaluator_Evaluate_Rules(t *testing.T) {
+	e, err := NewEvaluator("test", Policy{
+		DefaultAction: DefaultActionBlock,
+		Allowlist: []Rule{
+			{Type: RuleTypeCountry, Value: "FR"},
+			{Type: RuleTypeCIDR, Value: "198.51.100.0/24"},
+			{Type: RuleTypeASN, Value: "AS64500"},
+		},
+		Blocklist: []Rule{
+			{Type: RuleTypeCIDR, Value: "192.0.2.0/24"},
+			{Type: RuleTypeASN, Value: "64501"},
+		},
+	}, "")
+	require.NoError(t, err)
+
+	country := &fakeLookup{country: "fr"}
+	asn := &fakeASNLookup{asn: 64500}
+	e.AddLookup("country", country, false)
+	e.AddASNLookup("asn", asn, false)
+
+	tests := []struct {
+		ip      string
+		country string
+		asn     uint
+		allowed bool
+		rule    *Rule
+	}{
+		{ip: "192.0.2.1", country: "fr", asn: 64500, allowed: false, rule: &Rule{Type: RuleTypeCIDR, Value: "192.0.2.0/24"}},
+		{ip: "203.0.113.1", country: "fr", asn: 64501, allowed: false, rule: &Rule{Type: RuleTypeASN, Value: "AS64501"}},
+		{ip: "198.51.100.1", country: "us", asn: 0, allowed: true, rule: &Rule{Type: RuleTypeCIDR, Value: "198.51.100.0/24"}},
+		{ip: "203.0.113.1", country: "us", asn: 64500, allowed: true, rule: &Rule{Type: RuleTypeASN, Value: "AS64500"}},
+		{ip: "203.0.113.1", country: "fr", asn: 0, allowed: true, rule: &Rule{Type: RuleTypeCountry, Value: "FR"}},
+		{ip: "203.0.113.1", country: "us", asn: 64502, allowed: false, rule: nil}, // default action
+		{ip: "2001:db8::1", country: "-", asn: 0, allowed: false, rule: nil},      // default action
+	}
+
+	for _, test := range tests {
+		country.country = test.country
+		asn.asn = test.asn
+
+		v, err := e.Evaluate(test.ip)
+		assert.NoError(t, err)
+		assert.Equal(t, test.allowed, v.Allowed, "%+v", test)
+		assert.Equal(t, test.rule, v.Rule, "%+v", test)
+		assert.Empty(t, v.Answers)
+	}
+
+	_, err = e.Evaluate("not-an-ip")
+	assert.Error(t, err)
+}
+
+func TestEvaluator_Evaluate_Bans(t *testing.T) {
+	e, err := NewEvaluator("test", Policy{
+		DefaultAction: DefaultActionBlock,
+		Allowlist:     []Rule{{Type: RuleTypeCIDR, Value: "192.0.2.0/24"}},
+	}, "")
+	require.NoError(t, err)
+	country := &fakeLookup{country: "fr"}
+	e.AddLookup("country", country, false)
+
+	v, err := e.Evaluate("192.0.2.1")
+	require.NoError(t, err)
+	assert.True(t, v.Allowed)
+
+	bans, err := banlist.Open("")
+	require.NoError(t, err)
+	e.SetBans(bans)
+	_, err = bans.Add("192.0.2.1", 0, "")
+	require.NoError(t, err)
+	country.calls = 0
+
+	v, err = e.Evaluate("192.0.2.1")
+	require.NoError(t, err)
+	assert.False(t, v.Allowed, "the bans are evaluated before the allowlist")
+	assert.Equal(t, &Rule{Type: RuleTypeBan, Value: "192.0.2.1/32"}, v.Rule)
+	assert.Zero(t, country.calls, "no lookup is needed")
+
+	v, err = e.Evaluate("192.0.2.2")
+	require.NoError(t, err)
+	assert.True(t, v.Allowed)
+}
+
+func TestEvaluator_Explain(t *testing.T) {
+	e, err := NewEvaluator("test", Policy{
+		DefaultAction: DefaultActionAllow,
+		Blocklist:     []Rule{{Type: RuleTypeCIDR, Value: "192.0.2.0/24"}},
+	}, "")
+	require.NoError(t, err)
+
+	failure := errors.New("corrupted database")
+	e.AddLookup("unknown", &fakeLookup{country: "-"}, false)
+	e.AddLookup("fr", &fakeLookup{country: "fr"}, false)
+	e.AddASNLookup("broken", &fakeASNLookup{err: failure}, true)
+
+	v, err := e.Explain("192.0.2.1")
+	assert.NoError(t, err)
+	assert.False(t, v.Allowed)
+	assert.Equal(t, &Rule{Type: RuleTypeCIDR, Value: "192.0.2.0/24"}, v.Rule)
+	assert.Equal(t, []Answer{
+		{Database: "unknown", Country: "-"},
+		{Database: "fr", Country: "fr"},
+		{Database: "broken", Err: failure},
+	}, v.Answers)
+}
+
+func TestEvaluator_Validate(t *testing.T) {
+	e, err := NewEvaluator("test", Policy{
+		Blocklist: []Rule{{Type: RuleTypeASN, Value: "AS64501"}},
+	}, "")
+	require.NoError(t, err)
+	assert.Error(t, e.Validate())
+
+	e.AddASNLookup("asn", &fakeASNLookup{}, false)
+	assert.NoError(t, e.Validate())
+
+	_, err = NewEvaluator("test", Policy{}, "random")
+	assert.Error(t, err)
+}
+
+func TestEvaluator_Evaluate_FileRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.netset")
+	require.NoError(t, os.WriteFile(path, []byte("# threats\n192.0.2.0/24\n"), 0o644))
+
+	e, err := NewEvaluator("test", Policy{
+		DefaultAction: DefaultActionAllow,
+		Blocklist:     []Rule{{Type: RuleTypeFile, Value: path}},
+	}, "")
+	require.NoError(t, err)
+	require.Len(t, e.Lists(), 1)
+
+	v, err := e.Evaluate("192.0.2.1")
+	assert.NoError(t, err)
+	assert.False(t, v.Allowed)
+
+	v, err = e.Evaluate("198.51.100.1")
+	assert.NoError(t, err)
+	assert.True(t, v.Allowed)
+
+	_, err = NewEvaluator("test", Policy{
+		Blocklist: []Rule{{Type: RuleTypeFile, Value: filepath.Join(t.TempDir(), "missing")}},
+	}, "")
+	assert.Error(t, err)
+}
+
+func TestEvaluator_Close(t *testing.T) {
+	databases := &Databases{}
+	db := &fakeCloser{}
+	databases.Add(db)
+
+	var evaluators []*Evaluator
+	for _, name := range []string{"a", "b"} {
+		e, err := NewEvaluator(name, Policy{}, "")
+		require.NoError(t, err)
+		e.SetDatabases(databases)
+		evaluators = append(evaluators, e)
+	}
+
+	for _, e := range evaluators {
+		assert.NoError(t, e.Close())
+	}
+	assert.Equal(t, 1, db.closed, "the shared databases are closed once")
+
+	e, err := NewEvaluator("c", Policy{}, "")
+	require.NoError(t, err)
+	assert.NoError(t, e.Close(), "without databases")
+}
@@ -3,14 +3,23 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
-	"regexp"
+	"os/signal"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/mdouchement/geoblock-proxy/accesslog"
+	"github.com/mdouchement/geoblock-proxy/banlist"
+	"github.com/mdouchement/geoblock-proxy/geodb"
 	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/mdouchement/geoblock-proxy/netset"
 	"github.com/mdouchement/geoblock-proxy/proxy"
 	"github.com/mdouchement/geoblock/lookup"
 	"github.com/mdouchement/logger"
@@ -23,124 +32,149 @@ import (
 )
 
 type controller struct {
-	cfg       string
-	config    Configuration
+	cfg        string
+	config     Configuration
+	ctx        context.Context
+	logr       *logrus.Logger
+	evaluators atomic.Pointer[map[string]*Evaluator] // Indexed by policy
+	evaluating sync.RWMutex                          // Held for reading while an evaluator is used
+
+	mu       sync.Mutex
+	services map[string]*service    // Indexed by endpoint key
+	retired  map[proxy.Proxy]string // Proxies removed by a reload with their name, until their connections end
+	reloads  chan chan error        // Reloads requested by the admin API
+	bans     *banlist.List
+
+	adminToken atomic.Pointer[string] // Token of the admin API, changed by a reload
+
+	allowed     *prometheus.CounterVec
+	rejected    *prometheus.CounterVec
+	listEntries *prometheus.GaugeVec
+	listErrors  *prometheus.GaugeVec
+	backendUp   *prometheus.GaugeVec
+
+	connections        *prometheus.GaugeVec
+	connectionDuration *prometheus.HistogramVec
+	traffic            *prometheus.CounterVec
+	dialDuration       *prometheus.HistogramVec
+	dialFailures       *prometheus.CounterVec
+	lookupDuration     *prometheus.HistogramVec
+	lookupErrors       *prometheus.CounterVec
+
+	accessLog       *accesslog.Logger // nil when disabled
+	accessLogOutput io.Closer
+}
+
+// A service is a running endpoint.
+type service struct {
+	key       string
+	name      string
+	endpoint  Endpoint
+	proxy     proxy.Proxy
+	balancing *balancing
+	health    []*loadbalancer.HealthChecker // Empty when health checks are disabled
+	discovery []*loadbalancer.Discovery     // Empty when all the backends are IP addresses
 	ctx       context.Context
-	evaluator *Evaluator
-	proxies   []proxy.Proxy
+	cancel    context.CancelFunc
+}
 
-	allowed  *prometheus.CounterVec
-	rejected *prometheus.CounterVec
+// A balancing holds the loadbalancers of an endpoint.
+type balancing struct {
+	lb        loadbalancer.Loadbalancer
+	router    *router
+	health    []*loadbalancer.HealthChecker
+	discovery []*loadbalancer.Discovery
 }
 
 func main() {
-	c := controller{
-		allowed: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: "geoblock",
-			Subsystem: "",
-			Name:      "allowed_total",
-			Help:      "Total of allowed requests.",
-		}, []string{"country"}),
-		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: "geoblock",
-			Subsystem: "",
-			Name:      "rejected_total",
-			Help:      "Total of rejected requests.",
-		}, []string{"country"}),
-	}
+	c := newController()
 
 	cmd := &cobra.Command{
 		Use:   "geoblock-proxy",
 		Short: "Starts the geoblock proxy server",
 		Args:  cobra.ExactArgs(0),
-		RunE: func(_ *cobra.Command, _ []string) error {
+		PersistentPreRun: func(_ *cobra.Command, _ []string) {
 			if c.cfg == "" {
 				c.cfg = "geoblock-proxy.yml"
 			}
-
-			logr := logrus.New()
-			logr.SetFormatter(&logger.LogrusTextFormatter{
-				DisableColors:   false,
-				ForceColors:     true,
-				ForceFormatting: true,
-				PrefixRE:        regexp.MustCompile(`^(\[.*?\])\s`),
-				FullTimestamp:   true,
-				TimestampFormat: "2006-01-02 15:04:05",
-			})
-			log := logger.WrapLogrus(logr)
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			c.logr = logrus.New()
+			formatter, _ := newFormatter(LogFormatText)
+			c.logr.SetFormatter(formatter)
+			log := logger.WrapLogrus(c.logr)
 			c.ctx = logger.WithLogger(context.Background(), log)
 
 			//
 
 			{
-
 				log.Infof("Reading configuration from %s", c.cfg)
-				payload, err := os.ReadFile(c.cfg)
+				config, evaluators, err := c.load()
 				if err != nil {
-					if err != nil {
-						return errors.Wrapf(err, "could not read configuration file %s", c.cfg)
-					}
+					return err
 				}
 
-				err = yaml.Unmarshal(payload, &c.config)
+				c.bans, err = banlist.Open(config.BanFile)
 				if err != nil {
-					if err != nil {
-						return errors.Wrapf(err, "could not parse configuration file %s", c.cfg)
-					}
+					return errors.Wrap(err, "could not open ban file")
+				}
+				for _, evaluator := range evaluators {
+					evaluator.SetBans(c.bans) // Opened after the first load.
 				}
 
-				c.evaluator, err = NewEvaluator("evaluator", c.config)
+				output, err := setupLogger(c.logr, config.LogFormat, config.LogOutput)
 				if err != nil {
-					return errors.Wrap(err, "could not create geoblock evaluator")
+					return errors.Wrap(err, "could not setup logger")
 				}
+				defer output.Close()
 
-				if c.config.Logger != "" {
-					l, err := logrus.ParseLevel(c.config.Logger)
-					if err != nil {
-						return errors.Wrapf(err, "could not parse logger level %s", c.cfg)
+				if config.AccessLog != nil {
+					if err := c.openAccessLog(*config.AccessLog); err != nil {
+						return errors.Wrap(err, "could not open access log")
 					}
-					logr.SetLevel(l)
+					defer c.accessLogOutput.Close()
 				}
 
-				if c.config.Metrics != "" {
-					prometheus.Register(c.allowed)  //nolint:errcheck
-					prometheus.Register(c.rejected) //nolint:errcheck
-
-					go func() {
-						log.Infof("Starting metrics endpoint on %s", c.config.Metrics)
-
-						http.Handle("/metrics", promhttp.Handler())
-						err := http.ListenAndServe(c.config.Metrics, nil)
-						if err != nil {
-							log.WithError(err).Error("Could not run metrics endpoint")
-						}
-					}()
+				if err := c.setup(config, evaluators); err != nil {
+					return err
 				}
-			}
 
-			if err := c.setup(); err != nil {
-				return err
-			}
-
-			defer c.close()
-
-			var wg sync.WaitGroup
-			for _, p := range c.proxies {
-				wg.Add(1)
+				if c.config.Metrics != "" {
+					prometheus.Register(c.allowed)            //nolint:errcheck
+					prometheus.Register(c.rejected)           //nolint:errcheck
+					prometheus.Register(c.listEntries)        //nolint:errcheck
+					prometheus.Register(c.listErrors)         //nolint:errcheck
+					prometheus.Register(c.backendUp)          //nolint:errcheck
+					prometheus.Register(c.connections)        //nolint:errcheck
+					prometheus.Register(c.connectionDuration) //nolint:errcheck
+					prometheus.Register(c.traffic)            //nolint:errcheck
+					prometheus.Register(c.dialDuration)       //nolint:errcheck
+					prometheus.Register(c.dialFailures)       //nolint:errcheck
+					prometheus.Register(c.lookupDuration)     //nolint:errcheck
+					prometheus.Register(c.lookupErrors)       //nolint:errcheck
 
-				go func(p proxy.Proxy) {
-					defer wg.Done()
-					defer p.Close()
+					mux := http.NewServeMux()
+					mux.Handle("/metrics", promhttp.Handler())
+					if c.config.Admin != nil && (c.config.Admin.Listen == "" || c.config.Admin.Listen == c.config.Metrics) {
+						mux.Handle("/api/", c.adminHandler())
+					}
+					c.listenHTTP("metrics", c.config.Metrics, mux)
+				}
 
-					p.Run()
-				}(p)
+				if c.config.Admin != nil && c.config.Admin.Listen != "" && c.config.Admin.Listen != c.config.Metrics {
+					c.listenHTTP("admin", c.config.Admin.Listen, c.adminHandler())
+				}
 			}
 
-			wg.Wait()
+			c.serve()
+			c.shutdown()
 			return nil
 		},
 	}
-	cmd.Flags().StringVarP(&c.cfg, "config", "c", os.Getenv("GEOBLOCK_PROXY_CONFIG"), "Server's configuration")
+	cmd.PersistentFlags().StringVarP(&c.cfg, "config", "c", os.Getenv("GEOBLOCK_PROXY_CONFIG"), "Server's configuration")
+	cmd.AddCommand(newCheckCommand(&c.cfg))
+	cmd.AddCommand(newLookupCommand(c))
+	cmd.AddCommand(newBansCommand(&c.cfg))
 
 	if err := cmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -148,60 +182,933 @@ func main() {
 	}
 }
 
-func (c *controller) setup() error {
-	for _, databasename := range c.config.Databases {
-		lookup, err := lookup.OpenIP2location(databasename)
-		if err != nil {
-			return errors.Wrapf(err, "ip2location: %s", databasename)
+// newController returns a controller with its metrics.
+func newController() *controller {
+	return &controller{
+		reloads: make(chan chan error),
+		allowed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "geoblock",
+			Subsystem: "",
+			Name:      "allowed_total",
+			Help:      "Total of allowed requests.",
+		}, []string{"policy", "country", "asn"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "geoblock",
+			Subsystem: "",
+			Name:      "rejected_total",
+			Help:      "Total of rejected requests.",
+		}, []string{"policy", "country", "asn"}),
+		listEntries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "geoblock",
+			Subsystem: "list",
+			Name:      "entries",
+			Help:      "Number of entries loaded from a list file.",
+		}, []string{"file"}),
+		listErrors: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "geoblock",
+			Subsystem: "list",
+			Name:      "errors",
+			Help:      "Number of lines of a list file that could not be parsed.",
+		}, []string{"file"}),
+		backendUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "geoblock",
+			Subsystem: "backend",
+			Name:      "up",
+			Help:      "Whether a backend passes its health checks (1) or not (0).",
+		}, []string{"endpoint", "backend"}),
+		connections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "geoblock",
+			Subsystem: "",
+			Name:      "connections_active",
+			Help:      "Number of active TCP connections and UDP flows.",
+		}, []string{"endpoint", "protocol", "backend"}),
+		connectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "geoblock",
+			Subsystem: "",
+			Name:      "connection_duration_seconds",
+			Help:      "Duration of the TCP connections and UDP flows.",
+			Buckets:   []float64{0.1, 1, 10, 60, 300, 900, 3600, 14400},
+		}, []string{"endpoint", "protocol", "backend"}),
+		traffic: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "geoblock",
+			Subsystem: "",
+			Name:      "traffic_bytes_total",
+			Help:      "Total of bytes received from the clients (in) and sent to them (out).",
+		}, []string{"endpoint", "protocol", "backend", "direction"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "geoblock",
+			Subsystem: "backend",
+			Name:      "dial_duration_seconds",
+			Help:      "Duration of the connections to the backends.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"endpoint", "protocol", "backend"}),
+		dialFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "geoblock",
+			Subsystem: "backend",
+			Name:      "dial_failures_total",
+			Help:      "Total of failed connections to the backends.",
+		}, []string{"endpoint", "protocol", "backend"}),
+		lookupDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "geoblock",
+			Subsystem: "lookup",
+			Name:      "duration_seconds",
+			Help:      "Duration of the evaluation of the incoming connections.",
+			Buckets:   []float64{0.00001, 0.0001, 0.001, 0.01, 0.1, 1},
+		}, []string{"endpoint", "protocol"}),
+		lookupErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "geoblock",
+			Subsystem: "lookup",
+			Name:      "errors_total",
+			Help:      "Total of incoming connections that could not be evaluated.",
+		}, []string{"endpoint", "protocol"}),
+	}
+}
+
+// load reads the configuration file and builds the evaluators of the policies it describes.
+// It has no side effect on the running controller.
+func (c *controller) load() (Configuration, map[string]*Evaluator, error) {
+	var config Configuration
+
+	payload, err := os.ReadFile(c.cfg)
+	if err != nil {
+		return config, nil, errors.Wrapf(err, "could not read configuration file %s", c.cfg)
+	}
+
+	err = yaml.Unmarshal(payload, &config)
+	if err != nil {
+		return config, nil, errors.Wrapf(err, "could not parse configuration file %s", c.cfg)
+	}
+
+	if config.Logger != "" {
+		if _, err := logrus.ParseLevel(config.Logger); err != nil {
+			return config, nil, errors.Wrapf(err, "could not parse logger level %s", c.cfg)
 		}
+	}
 
-		c.evaluator.AddLookup(lookup)
+	policies := map[string]Policy{DefaultPolicy: config.Policy}
+	for name, policy := range config.Policies {
+		if name == DefaultPolicy {
+			return config, nil, errors.Errorf("policy %s is reserved for the root rules", DefaultPolicy)
+		}
+		policies[name] = policy
 	}
 
-	//
+	if _, err := newFormatter(config.LogFormat); err != nil {
+		return config, nil, errors.Wrap(err, "log_format")
+	}
+
+	if config.AccessLog != nil {
+		if err := config.AccessLog.Validate(); err != nil {
+			return config, nil, errors.Wrap(err, "access_log")
+		}
+	}
+
+	if config.Admin != nil {
+		if err := config.Admin.Validate(); err != nil {
+			return config, nil, errors.Wrap(err, "admin")
+		}
+		if config.Admin.Listen == "" && config.Metrics == "" {
+			return config, nil, errors.New("admin: listen is required when metrics is disabled")
+		}
+	}
 
-	c.proxies = make([]proxy.Proxy, len(c.config.Endpoints))
-	for i, endpoint := range c.config.Endpoints {
-		lb, err := loadbalancer.NewRoundRobin(endpoint)
+	for i, endpoint := range config.Endpoints {
+		if err := endpoint.Validate(); err != nil {
+			return config, nil, errors.Wrapf(err, "endpoints[%d]", i)
+		}
+
+		if _, ok := policies[endpoint.PolicyName()]; !ok {
+			return config, nil, errors.Errorf("endpoints[%d]: unknown policy %s", i, endpoint.PolicyName())
+		}
+	}
+
+	databases := &Databases{}
+	evaluators := make(map[string]*Evaluator, len(policies))
+	for name, policy := range policies {
+		evaluators[name], err = NewEvaluator(name, policy, config.LookupStrategy)
 		if err != nil {
-			return errors.Wrap(err, "loadbalancer")
+			return config, nil, errors.Wrap(err, "could not create geoblock evaluator")
 		}
+		evaluators[name].SetBans(c.bans)
+		evaluators[name].SetDatabases(databases)
+	}
 
-		c.proxies[i], err = proxy.NewProxy(c.ctx, lb, func(ctx context.Context, ip net.IP) bool {
-			if ip == nil {
-				return false
-			}
+	if err = openDatabases(config.Databases, evaluators, databases); err != nil {
+		databases.Close() //nolint:errcheck
+		return config, nil, err
+	}
 
-			log := logger.LogWith(ctx)
+	for _, evaluator := range evaluators {
+		if err := evaluator.Validate(); err != nil {
+			databases.Close() //nolint:errcheck
+			return config, nil, errors.Wrap(err, "could not create geoblock evaluator")
+		}
+	}
 
-			allowed, country, err := c.evaluator.Evaluate(ip.String())
+	return config, evaluators, nil
+}
+
+// openDatabases adds the lookups of the given databases to the evaluators.
+// The opened database files are registered in databases so they can be closed.
+func openDatabases(list []Database, evaluators map[string]*Evaluator, databases *Databases) error {
+	for _, database := range list {
+		if database.ASN {
+			lookup, err := openASNDatabase(database)
 			if err != nil {
-				log.Infof("%s - %v", ip, err)
-				return false
+				return err
+			}
+			if closer, ok := lookup.(io.Closer); ok {
+				databases.Add(closer)
+			}
+
+			for _, evaluator := range evaluators {
+				evaluator.AddASNLookup(database.Path, lookup, database.IgnoreErrors)
+			}
+			continue
+		}
+
+		lookup, err := openDatabase(database)
+		if err != nil {
+			return err
+		}
+		if closer, ok := lookup.(io.Closer); ok {
+			databases.Add(closer)
+		}
+
+		for _, evaluator := range evaluators {
+			evaluator.AddLookup(database.Path, lookup, database.IgnoreErrors)
+		}
+	}
+
+	return nil
+}
+
+func openDatabase(database Database) (lookup.Lookup, error) {
+	switch database.Kind() {
+	case DatabaseTypeIP2location:
+		l, err := lookup.OpenIP2location(database.Path)
+		return l, errors.Wrapf(err, "ip2location: %s", database.Path)
+	case DatabaseTypeMMDB:
+		l, err := geodb.OpenMMDB(database.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "mmdb: %s", database.Path)
+		}
+		return l, nil
+	default:
+		return nil, errors.Errorf("%s: unsupported database type: %s", database.Path, database.Type)
+	}
+}
+
+// listenHTTP serves the given handler in background.
+func (c *controller) listenHTTP(name, addr string, h http.Handler) {
+	log := logger.LogWith(c.ctx)
+
+	go func() {
+		log.Infof("Starting %s endpoint on %s", name, addr)
+
+		err := http.ListenAndServe(addr, h)
+		if err != nil {
+			log.WithError(err).Errorf("Could not run %s endpoint", name)
+		}
+	}()
+}
+
+// openAccessLog opens the access log of the connections.
+func (c *controller) openAccessLog(a AccessLog) error {
+	var w io.WriteCloser = nopCloser{os.Stdout}
+	if a.Output != "" && a.Output != "stdout" {
+		f, err := accesslog.OpenFile(a.Output, int64(a.MaxSize)<<20, a.MaxBackups)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	l, err := accesslog.New(w, a.Format)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	c.accessLog = l
+	c.accessLogOutput = w
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func openASNDatabase(database Database) (ASNLookup, error) {
+	switch database.Kind() {
+	case DatabaseTypeIP2location:
+		l, err := geodb.OpenIP2locationASN(database.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ip2location: %s", database.Path)
+		}
+		return l, nil
+	case DatabaseTypeMMDB:
+		l, err := geodb.OpenMMDB(database.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "mmdb: %s", database.Path)
+		}
+		return l, nil
+	default:
+		return nil, errors.Errorf("%s: unsupported database type: %s", database.Path, database.Type)
+	}
+}
+
+// setup applies the given configuration to the running controller.
+// The new endpoints are bound before the configuration and the evaluators are swapped, then the removed endpoints
+// are stopped. On error, the previous configuration is kept running.
+func (c *controller) setup(config Configuration, evaluators map[string]*Evaluator) error {
+	log := logger.LogWith(c.ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.services == nil {
+		c.services = make(map[string]*service)
+	}
+
+	endpoints := make(map[string]bool, len(config.Endpoints))
+	for _, endpoint := range config.Endpoints {
+		endpoints[endpoint.key()] = true
+	}
+
+	// The removed endpoints, indexed by frontend, keep their address until a new endpoint needs it.
+	removed := make(map[string]*service)
+	for key, s := range c.services {
+		if !endpoints[key] {
+			removed[s.name] = s
+		}
+	}
+
+	var added, rebinding []*service // The new services binding the address of a removed endpoint come last.
+	for i, endpoint := range config.Endpoints {
+		key := endpoint.key()
+		if _, ok := c.services[key]; ok {
+			continue
+		}
+
+		s, err := newService(c.ctx, key, endpoint)
+		if err != nil {
+			for _, s := range append(added, rebinding...) {
+				s.cancel()
 			}
+			return errors.Wrapf(err, "endpoints[%d]", i)
+		}
+
+		if removed[s.name] != nil {
+			rebinding = append(rebinding, s)
+			continue
+		}
+		added = append(added, s)
+	}
+	added = append(added, rebinding...)
+
+	var released []*service
+	for _, s := range added {
+		if r, ok := removed[s.name]; ok {
+			r.proxy.Close() // Releases the address, the established TCP connections are still relayed.
+			released = append(released, r)
+			delete(removed, s.name)
+		}
 
-			if !allowed {
-				log.Infof("%s from %s is blocked", ip, strings.ToUpper(country))
-				c.rejected.WithLabelValues(country).Inc()
-				return false
+		err := c.bind(s)
+		if err == nil {
+			continue
+		}
+
+		for _, s := range added {
+			s.close()
+		}
+		for _, r := range released {
+			c.retire(r.name, r.proxy)
+			if err := c.bind(r); err != nil {
+				log.WithError(err).Errorf("Could not restore endpoint %s", r.name)
+				continue
 			}
+			c.run(r)
+		}
+		return err
+	}
+
+	//
+
+	if config.Logger != "" {
+		l, _ := logrus.ParseLevel(config.Logger) // Already validated by load.
+		c.logr.SetLevel(l)
+	}
+
+	c.config = config
+	if config.Admin != nil {
+		c.adminToken.Store(&config.Admin.Token)
+	}
+	previous := c.evaluators.Swap(&evaluators)
+	c.reportLists()
+
+	for key, s := range c.services {
+		if endpoints[key] {
+			continue
+		}
+
+		log.Infof("Removing endpoint %s", s.name)
+		s.close()
+		c.backendUp.DeletePartialMatch(prometheus.Labels{"endpoint": s.name}) // Set again when the endpoint is replaced.
+		c.retire(s.name, s.proxy)
+		delete(c.services, key)
+	}
+
+	for _, s := range added {
+		c.services[s.key] = s
+		c.start(s)
+	}
+
+	if previous != nil {
+		c.retireEvaluators(previous)
+	}
+
+	return nil
+}
 
-			c.allowed.WithLabelValues(country).Inc()
+// retire tracks the given closed proxy until its established connections end, so shutdown can drain them.
+// The metrics of the endpoint are then removed, unless it is still served (e.g. with other options).
+// c.mu must be held.
+func (c *controller) retire(name string, p proxy.Proxy) {
+	if c.retired == nil {
+		c.retired = make(map[proxy.Proxy]string)
+	}
+	c.retired[p] = name
+
+	go func() {
+		p.Shutdown(context.Background()) //nolint:errcheck // Never times out.
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		delete(c.retired, p)
+		if !c.serving(name) {
+			c.deleteMetrics(name)
+		}
+	}()
+}
+
+// serving returns true when a running or retired proxy has the given name.
+// c.mu must be held.
+func (c *controller) serving(name string) bool {
+	for _, s := range c.services {
+		if s.name == name {
 			return true
-		})
+		}
+	}
 
+	for _, n := range c.retired {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newService builds the loadbalancers of the given endpoint, its proxy is created by bind.
+func newService(ctx context.Context, key string, endpoint Endpoint) (*service, error) {
+	b := &balancing{}
+
+	lb, err := b.loadbalancer(endpoint, endpoint.Upstreams())
+	if err != nil {
+		return nil, errors.Wrap(err, "loadbalancer")
+	}
+	b.lb = lb
+
+	if len(endpoint.Routes) > 0 {
+		b.router = &router{}
+	}
+
+	for j, route := range endpoint.Routes {
+		lb, err := b.loadbalancer(endpoint, route.Upstreams())
 		if err != nil {
-			return errors.Wrap(err, "could not create proxy")
+			return nil, errors.Wrapf(err, "routes[%d]: loadbalancer", j)
+		}
+
+		if err = b.router.add(route, lb); err != nil {
+			return nil, errors.Wrapf(err, "routes[%d]", j)
 		}
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	return &service{
+		key:       key,
+		name:      endpoint.Frontend(),
+		endpoint:  endpoint,
+		balancing: b,
+		health:    b.health,
+		discovery: b.discovery,
+		ctx:       ctx,
+		cancel:    cancel,
+	}, nil
+}
+
+// bind creates the proxy of the service, listening on its frontend.
+func (c *controller) bind(s *service) error {
+	endpoint := s.endpoint
+
+	trusted, err := endpoint.TrustedProxies()
+	if err != nil {
+		return errors.Wrapf(err, "could not create proxy %s", endpoint)
+	}
+
+	timeout := endpoint.Options.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+
+	attempts := endpoint.Options.DialAttempts
+	if attempts == 0 {
+		attempts = DefaultDialAttempts
+	}
+
+	p, err := proxy.NewProxy(c.ctx, s.balancing.lb, c.acceptable(endpoint, s.balancing.router), proxy.Options{
+		DialTimeout:         timeout,
+		DialAttempts:        attempts,
+		UDPConnTrackTimeout: endpoint.Options.UDPTimeout,
+		ProxyProtocol:       endpoint.Options.ProxyProtocol,
+		TrustedProxies:      trusted,
+		Observer:            c.observer(endpoint),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not create proxy %s", endpoint)
+	}
+
+	s.proxy = p
 	return nil
 }
 
-func (c *controller) close() {
-	for _, proxy := range c.proxies {
-		if proxy != nil {
-			proxy.Close()
+// start runs the bound service with its health checks and discovery.
+func (c *controller) start(s *service) {
+	for _, health := range s.health {
+		c.watchHealth(s.ctx, s.name, health)
+	}
+
+	for _, discovery := range s.discovery {
+		c.watchDiscovery(s.ctx, s.name, discovery)
+	}
+
+	c.run(s)
+}
+
+// run serves the current proxy of the service in background.
+func (c *controller) run(s *service) {
+	log := logger.LogWith(c.ctx)
+	p := s.proxy
+
+	go func() {
+		if err := p.Run(s.ctx); err != nil {
+			log.WithError(err).Errorf("Proxy %s stopped", s.name)
+			p.Close()
+		}
+	}()
+}
+
+// loadbalancer returns the loadbalancer of the given backends according to the endpoint options.
+// Its health checker and discovery are added to the balancing.
+func (b *balancing) loadbalancer(endpoint Endpoint, backends []loadbalancer.Backend) (loadbalancer.Loadbalancer, error) {
+	var lb loadbalancer.Loadbalancer
+	var err error
+
+	if loadbalancer.Dynamic(backends) {
+		discovery, err := loadbalancer.NewDiscovery(endpoint.Options.Balance, endpoint.Protocol, endpoint.Listen, backends,
+			net.DefaultResolver, endpoint.Options.ResolveInterval)
+		if err != nil {
+			return nil, err
+		}
+		b.discovery = append(b.discovery, discovery)
+		lb = discovery
+	} else {
+		lb, err = loadbalancer.New(endpoint.Options.Balance, endpoint.Protocol, endpoint.Listen, backends)
+		if err != nil {
+			return nil, err
 		}
 	}
+
+	if endpoint.Options.HealthCheck != nil {
+		health, err := loadbalancer.NewHealthChecker(lb, endpoint.Protocol, endpoint.Options.HealthCheck.options())
+		if err != nil {
+			return nil, err
+		}
+		b.health = append(b.health, health)
+		lb = health
+	}
+
+	if endpoint.Protocol == loadbalancer.ProtocolTCP {
+		lb = loadbalancer.NewEjector(lb, endpoint.Options.MaxFails, endpoint.Options.FailTimeout)
+	}
+
+	return lb, nil
+}
+
+// watchHealth runs the health checks of the service backends and reports their state.
+func (c *controller) watchHealth(ctx context.Context, name string, health *loadbalancer.HealthChecker) {
+	log := logger.LogWith(c.ctx)
+
+	for _, backend := range health.Backends() {
+		c.backendUp.WithLabelValues(name, backend.String()).Set(1)
+	}
+
+	health.OnChange(func(backend net.Addr, up bool) {
+		if ctx.Err() != nil {
+			return // The service has been removed.
+		}
+
+		if up {
+			log.Infof("Backend %s of %s is up", backend, name)
+			c.backendUp.WithLabelValues(name, backend.String()).Set(1)
+			return
+		}
+
+		log.Warnf("Backend %s of %s is down", backend, name)
+		c.backendUp.WithLabelValues(name, backend.String()).Set(0)
+	})
+
+	health.OnUpdate(func(added, removed []net.Addr) {
+		if ctx.Err() != nil {
+			return // The service has been removed.
+		}
+
+		for _, backend := range added {
+			c.backendUp.WithLabelValues(name, backend.String()).Set(1)
+		}
+		for _, backend := range removed {
+			c.backendUp.DeleteLabelValues(name, backend.String())
+		}
+	})
+
+	go health.Run(ctx)
+}
+
+// watchDiscovery resolves periodically the service backends and reports their changes.
+func (c *controller) watchDiscovery(ctx context.Context, name string, discovery *loadbalancer.Discovery) {
+	log := logger.LogWith(c.ctx)
+
+	discovery.OnChange(func(backends []net.Addr) {
+		log.Infof("Backends of %s resolved to %v", name, backends)
+	})
+
+	discovery.OnError(func(err error) {
+		log.Warnf("Could not resolve backends of %s: %v", name, err)
+	})
+
+	go discovery.Run(ctx)
+}
+
+// close stops the service.
+func (s *service) close() {
+	s.cancel()
+	if s.proxy != nil {
+		s.proxy.Close()
+	}
+}
+
+// acceptable returns the handler evaluating the incoming connections with the endpoint policy
+// and routing them with the given router (nil when the endpoint has no route).
+func (c *controller) acceptable(endpoint Endpoint, r *router) proxy.AcceptableConnection {
+	policy := endpoint.PolicyName()
+	name := endpoint.Frontend()
+
+	return func(ctx context.Context, ip net.IP) (d proxy.Decision) {
+		if ip == nil {
+			return d
+		}
+
+		log := logger.LogWith(ctx)
+
+		c.evaluating.RLock()
+		evaluator, ok := (*c.evaluators.Load())[policy]
+		if !ok {
+			c.evaluating.RUnlock()
+			log.Infof("%s - unknown policy %s", ip, policy) // The policy has been removed by a reload.
+			return d
+		}
+
+		start := time.Now()
+		v, err := evaluator.Evaluate(ip.String())
+		c.evaluating.RUnlock()
+		c.lookupDuration.WithLabelValues(name, endpoint.Protocol).Observe(time.Since(start).Seconds())
+		if err != nil {
+			log.Infof("%s - %v", ip, err)
+			c.lookupErrors.WithLabelValues(name, endpoint.Protocol).Inc()
+			return d
+		}
+
+		asn := FormatASN(v.ASN)
+
+		d.Country = strings.ToUpper(v.Country)
+		if v.Rule != nil {
+			d.Rule = string(v.Rule.Type) + " " + v.Rule.Value
+		}
+
+		if !v.Allowed {
+			from := strings.ToUpper(v.Country)
+			if asn != "" {
+				from += " " + asn
+			}
+
+			log.Infof("%s from %s is blocked by policy %s", ip, from, policy)
+			c.rejected.WithLabelValues(policy, v.Country, asn).Inc()
+			return d
+		}
+
+		c.allowed.WithLabelValues(policy, v.Country, asn).Inc()
+
+		d.Allowed = true
+		d.Route = r.match(ip, v.Country)
+		return d
+	}
+}
+
+// reload re-reads the configuration file and applies it to the running controller.
+// When the new configuration is invalid, the previous one is kept.
+func (c *controller) reload() error {
+	log := logger.LogWith(c.ctx)
+	log.Infof("Reloading configuration from %s", c.cfg)
+
+	config, evaluators, err := c.load()
+	if err != nil {
+		log.WithError(err).Error("Could not reload configuration, keeping the previous one")
+		return err
+	}
+
+	if config.Metrics != c.config.Metrics {
+		log.Warnf("Metrics endpoint cannot be changed without a restart, keeping %s", c.config.Metrics)
+	}
+	if config.LogFormat != c.config.LogFormat || config.LogOutput != c.config.LogOutput {
+		log.Warn("Log format and output cannot be changed without a restart, keeping the previous ones")
+	}
+	if !reflect.DeepEqual(config.AccessLog, c.config.AccessLog) {
+		log.Warn("Access log cannot be changed without a restart, keeping the previous one")
+	}
+	if (config.Admin == nil) != (c.config.Admin == nil) || config.Admin != nil && config.Admin.Listen != c.config.Admin.Listen {
+		log.Warn("Admin API cannot be enabled, disabled or moved without a restart, keeping the previous one")
+	}
+	if config.BanFile != c.config.BanFile {
+		log.Warnf("Ban file cannot be changed without a restart, keeping %s", c.config.BanFile)
+	}
+	if config.Watch != c.config.Watch {
+		log.Warnf("Watch interval cannot be changed without a restart, keeping %s", c.config.Watch)
+	}
+
+	if err := c.setup(config, evaluators); err != nil {
+		log.WithError(err).Error("Could not apply configuration, keeping the previous one")
+		c.retireEvaluators(&evaluators)
+		return err
+	}
+
+	log.Info("Configuration reloaded")
+	return nil
+}
+
+// retireEvaluators closes the given evaluators, replaced by a reload, once their running evaluations are done.
+func (c *controller) retireEvaluators(evaluators *map[string]*Evaluator) {
+	log := logger.LogWith(c.ctx)
+
+	// The new evaluators have been stored, so the evaluations started after this barrier cannot use the retired ones.
+	c.evaluating.Lock()
+	c.evaluating.Unlock() //nolint:staticcheck
+
+	for _, evaluator := range *evaluators {
+		if err := evaluator.Close(); err != nil {
+			log.WithError(err).Warnf("Could not close the databases of policy %s", evaluator.Name())
+		}
+	}
+}
+
+// serve blocks until SIGINT or SIGTERM and reloads the configuration on SIGHUP or when the configuration file changes.
+func (c *controller) serve() {
+	log := logger.LogWith(c.ctx)
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigterm)
+
+	var watch <-chan time.Time
+	if c.config.Watch > 0 {
+		log.Infof("Watching %s every %s", c.cfg, c.config.Watch)
+
+		ticker := time.NewTicker(c.config.Watch)
+		defer ticker.Stop()
+		watch = ticker.C
+	}
+	modtime := c.modtime()
+
+	interval := c.listsRefresh()
+	refresh := time.NewTicker(interval)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case sig := <-sigterm:
+			log.Infof("Received %s", sig)
+			return
+		case <-sighup:
+			log.Info("Received SIGHUP")
+			c.reload() //nolint:errcheck
+			modtime = c.modtime()
+		case done := <-c.reloads:
+			log.Info("Reload requested by the admin API")
+			done <- c.reload()
+			modtime = c.modtime()
+		case <-watch:
+			if m := c.modtime(); !m.Equal(modtime) {
+				modtime = m
+				c.reload() //nolint:errcheck
+			}
+		case <-refresh.C:
+			c.refreshLists()
+			c.pruneBans()
+		}
+
+		if i := c.listsRefresh(); i != interval {
+			interval = i
+			refresh.Reset(interval)
+		}
+	}
+}
+
+func (c *controller) listsRefresh() time.Duration {
+	if c.config.ListsRefresh > 0 {
+		return c.config.ListsRefresh
+	}
+	return time.Minute
+}
+
+// refreshLists re-reads the list files that have been modified.
+func (c *controller) refreshLists() {
+	log := logger.LogWith(c.ctx)
+
+	for _, list := range c.lists() {
+		refreshed, err := list.Refresh()
+		if err != nil {
+			log.WithError(err).Errorf("Could not refresh list %s, keeping the previous entries", list.Path())
+			continue
+		}
+
+		if refreshed {
+			c.reportList(list)
+		}
+	}
+}
+
+// pruneBans removes the expired bans.
+func (c *controller) pruneBans() {
+	log := logger.LogWith(c.ctx)
+
+	pruned, err := c.bans.Prune()
+	if err != nil {
+		log.WithError(err).Error("Could not prune bans")
+		return
+	}
+
+	if pruned > 0 {
+		log.Infof("Removed %d expired ban(s)", pruned)
+	}
+}
+
+// lists returns the list files of all the policies.
+func (c *controller) lists() []*netset.File {
+	var lists []*netset.File
+	for _, evaluator := range *c.evaluators.Load() {
+		lists = append(lists, evaluator.Lists()...)
+	}
+	return lists
+}
+
+// reportLists logs and exports the state of all the evaluator's list files.
+func (c *controller) reportLists() {
+	c.listEntries.Reset()
+	c.listErrors.Reset()
+
+	for _, list := range c.lists() {
+		c.reportList(list)
+	}
+}
+
+func (c *controller) reportList(list *netset.File) {
+	log := logger.LogWith(c.ctx)
+
+	stats := list.Stats()
+	for _, err := range stats.Errors {
+		log.Debugf("%s: %s", list.Path(), err)
+	}
+
+	if len(stats.Errors) > 0 {
+		log.Warnf("Loaded %d entries from %s, %d lines could not be parsed", stats.Entries, list.Path(), len(stats.Errors))
+	} else {
+		log.Infof("Loaded %d entries from %s", stats.Entries, list.Path())
+	}
+
+	c.listEntries.WithLabelValues(list.Path()).Set(float64(stats.Entries))
+	c.listErrors.WithLabelValues(list.Path()).Set(float64(len(stats.Errors)))
+}
+
+func (c *controller) modtime() time.Time {
+	fi, err := os.Stat(c.cfg)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return fi.ModTime()
+}
+
+// shutdown stops accepting new connections and waits for the active ones until the drain timeout.
+func (c *controller) shutdown() {
+	log := logger.LogWith(c.ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	timeout := c.config.DrainTimeout
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+	log.Infof("Shutting down, waiting up to %s for the active connections", timeout)
+
+	ctx, cancel := context.WithTimeout(c.ctx, timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	drain := func(name string, p proxy.Proxy) {
+		if err := p.Shutdown(ctx); err != nil {
+			log.Warnf("Closing the remaining connections of %s: %v", name, err)
+		}
+	}
+
+	for _, s := range c.services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.cancel()
+
+			drain(s.name, s.proxy)
+		}()
+	}
+
+	// The endpoints removed by a reload may still relay connections.
+	for p, name := range c.retired {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			drain(name, p)
+		}()
+	}
+	wg.Wait()
+
+	log.Info("Shutdown complete")
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/logger"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestController_Reload(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	a, b := freeAddr(t), freeAddr(t)
+	c := testController(t, configuration(backend, a))
+	assertEcho(t, a)
+
+	require.Len(t, c.services, 1)
+	var key string
+	for k := range c.services {
+		key = k
+	}
+	p := c.services[key].proxy
+
+	writeConfiguration(t, c.cfg, configuration(backend, a, b))
+	require.NoError(t, c.reload())
+	assertEcho(t, a)
+	assertEcho(t, b)
+	assert.Len(t, c.services, 2)
+	assert.Same(t, p, c.services[key].proxy, "the unchanged endpoint keeps running")
+
+	writeConfiguration(t, c.cfg, configuration(backend, b))
+	require.NoError(t, c.reload())
+	assertRefused(t, a)
+	assertEcho(t, b)
+	assert.Len(t, c.services, 1)
+}
+
+func TestController_ReloadFailure(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	a := freeAddr(t)
+	c := testController(t, configuration(backend, a))
+	config, evaluators := c.config, c.evaluators.Load()
+
+	assertKept := func(t *testing.T) {
+		t.Helper()
+
+		assert.Equal(t, config, c.config)
+		assert.Same(t, evaluators, c.evaluators.Load())
+		assert.Len(t, c.services, 1)
+		assertEcho(t, a)
+	}
+
+	t.Run("invalid configuration", func(t *testing.T) {
+		writeConfiguration(t, c.cfg, "endpoints: [")
+		assert.Error(t, c.reload())
+		assertKept(t)
+	})
+
+	t.Run("address in use", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+
+		writeConfiguration(t, c.cfg, configuration(backend, a, l.Addr().String()))
+		assert.Error(t, c.reload())
+		assertKept(t)
+	})
+
+	t.Run("released address", func(t *testing.T) {
+		// Both replacements need the address of the removed endpoint, the second one cannot bind it.
+		endpoint := "- protocol: tcp\n  listen: " + a + "\n  backends: [" + backend.Addr().String() + "]\n"
+		writeConfiguration(t, c.cfg, configuration(backend)+
+			endpoint+"  options: {dial_attempts: 2}\n"+
+			endpoint+"  options: {dial_attempts: 3}\n")
+		assert.Error(t, c.reload())
+		assertKept(t)
+	})
+
+	writeConfiguration(t, c.cfg, configuration(backend, a))
+	require.NoError(t, c.reload())
+	assertEcho(t, a)
+}
+
+func TestController_ReloadAdminToken(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	c := testController(t, "metrics: 127.0.0.1:9095\nadmin:\n  token: secret\n"+configuration(backend))
+	assert.Equal(t, "secret", *c.adminToken.Load())
+
+	writeConfiguration(t, c.cfg, "metrics: 127.0.0.1:9095\nadmin:\n  token: rotated\n"+configuration(backend))
+	require.NoError(t, c.reload())
+	assert.Equal(t, "rotated", *c.adminToken.Load())
+}
+
+func TestController_ShutdownDrainsRemovedEndpoints(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	a, b := freeAddr(t), freeAddr(t)
+	c := testController(t, configuration(backend, a))
+
+	retired := func() int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		return len(c.retired)
+	}
+
+	relay := func(addr string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+		r := bufio.NewReader(conn)
+		_, err = conn.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		_, err = r.ReadString('\n')
+		require.NoError(t, err)
+		return conn, r
+	}
+
+	// The relays of a removed endpoint are tracked until they end.
+	conn, _ := relay(a)
+	writeConfiguration(t, c.cfg, configuration(backend, b))
+	require.NoError(t, c.reload())
+	assert.Equal(t, 1, retired())
+
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return retired() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Otherwise they are closed by the shutdown after the drain timeout.
+	conn, r := relay(b)
+	defer conn.Close()
+	writeConfiguration(t, c.cfg, configuration(backend, a))
+	require.NoError(t, c.reload())
+	assert.Equal(t, 1, retired())
+
+	start := time.Now()
+	c.shutdown()
+	assert.GreaterOrEqual(t, time.Since(start), time.Second, "the drain timeout is waited")
+
+	_, err := r.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF, "the relay of the removed endpoint is closed")
+}
+
+func TestController_ServeReloadsOnSIGHUP(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals are not supported")
+	}
+
+	// Prevents the signals from terminating the test before serve handles them.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	backend := echoServer(t)
+	defer backend.Close()
+
+	a, b := freeAddr(t), freeAddr(t)
+	c := testController(t, configuration(backend, a))
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		c.serve()
+	}()
+
+	writeConfiguration(t, c.cfg, configuration(backend, b))
+
+	process, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		require.NoError(t, process.Signal(syscall.SIGHUP))
+
+		conn, err := net.DialTimeout("tcp", b, 100*time.Millisecond)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assertEcho(t, b)
+	assertRefused(t, a)
+
+	require.NoError(t, process.Signal(syscall.SIGTERM))
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return on SIGTERM")
+	}
+}
+
+// testController returns a controller running the given configuration, it is shut down at the end of the test.
+func testController(t *testing.T, config string) *controller {
+	t.Helper()
+
+	c := newController()
+	c.cfg = filepath.Join(t.TempDir(), "geoblock-proxy.yml")
+	c.logr = logrus.New()
+	c.logr.SetOutput(io.Discard)
+	c.ctx = logger.WithLogger(context.Background(), logger.WrapLogrus(c.logr))
+
+	writeConfiguration(t, c.cfg, config)
+	cfg, evaluators, err := c.load()
+	require.NoError(t, err)
+	require.NoError(t, c.setup(cfg, evaluators))
+	t.Cleanup(c.shutdown)
+
+	return c
+}
+
+// configuration returns a configuration forwarding the given TCP frontends to the backend.
+func configuration(backend net.Listener, frontends ...string) string {
+	var b strings.Builder
+	b.WriteString("logger: error\ndrain_timeout: 1s\ndefault_action: allow\nendpoints:\n")
+	for _, frontend := range frontends {
+		b.WriteString("- tcp://" + frontend + "?backend=" + backend.Addr().String() + "\n")
+	}
+	return b.String()
+}
+
+func writeConfiguration(t *testing.T, filename, config string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filename, []byte(config), 0o644))
+}
+
+// freeAddr returns a TCP address that is not listened.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func assertEcho(t *testing.T, addr string) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+}
+
+func assertRefused(t *testing.T, addr string) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err == nil {
+		conn.Close()
+	}
+	assert.Error(t, err, "%s is not listened anymore", addr)
+}
@@ -0,0 +1,61 @@
+package geodb
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/ip2location/ip2location-go/v9"
+)
+
+// An IP2locationASN looks up Autonomous Systems from an IP2Location BIN file that includes the ASN fields (DB26).
+type IP2locationASN struct {
+	db *ip2location.DB
+}
+
+// asnPackages are the IP2Location packages including the ASN fields.
+var asnPackages = map[string]bool{"26": true}
+
+// OpenIP2locationASN opens the given IP2Location BIN file.
+// It fails when the file does not include the ASN fields.
+func OpenIP2locationASN(filename string) (*IP2locationASN, error) {
+	db, err := ip2location.OpenDB(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if !asnPackages[db.PackageVersion()] {
+		db.Close()
+		return nil, fmt.Errorf("DB%s does not include the ASN fields", db.PackageVersion())
+	}
+
+	return &IP2locationASN{
+		db: db,
+	}, nil
+}
+
+// ASN returns the Autonomous System Number of the given IP.
+// It returns zero when the IP is not found.
+func (l *IP2locationASN) ASN(ip net.IP) (uint, error) {
+	r, err := l.db.Get_asn(ip.String())
+	if err != nil {
+		return 0, err
+	}
+
+	if r.Asn == "-" {
+		return 0, nil
+	}
+
+	asn, err := strconv.ParseUint(r.Asn, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid ASN: %s", ip, r.Asn) // Or a message of the library (e.g. IPv6 address missing in IPv4 BIN.)
+	}
+
+	return uint(asn), nil
+}
+
+// Close closes the underlying database file.
+func (l *IP2locationASN) Close() error {
+	l.db.Close()
+	return nil
+}
@@ -0,0 +1,120 @@
+package geodb_test
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdouchement/geoblock-proxy/geodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIP2locationASN_ASN(t *testing.T) {
+	filename := generateIP2location(t, 26, []ip2locationRange{
+		{From: "0.0.0.0", ASN: "-"},
+		{From: "192.0.2.0", ASN: "14061"},
+		{From: "192.0.3.0", ASN: "-"},
+		{From: "198.51.100.0", ASN: "16276"},
+		{From: "198.51.101.0", ASN: "-"},
+		{From: "203.0.113.0", ASN: "n/a"},
+		{From: "203.0.114.0", ASN: "-"},
+	})
+
+	db, err := geodb.OpenIP2locationASN(filename)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tests := map[string]uint{
+		"192.0.2.42":      14061,
+		"198.51.100.42":   16276,
+		"192.0.3.42":      0,
+		"255.255.255.255": 0,
+	}
+
+	for ip, expected := range tests {
+		asn, err := db.ASN(net.ParseIP(ip))
+		assert.NoError(t, err, ip)
+		assert.Equal(t, expected, asn, ip)
+	}
+
+	_, err = db.ASN(net.ParseIP("203.0.113.42"))
+	assert.EqualError(t, err, "203.0.113.42: invalid ASN: n/a")
+
+	_, err = db.ASN(net.ParseIP("2001:db8::42"))
+	assert.EqualError(t, err, "2001:db8::42: invalid ASN: IPv6 address missing in IPv4 BIN.")
+}
+
+func TestOpenIP2locationASN_Unsupported(t *testing.T) {
+	filename := generateIP2location(t, 1, []ip2locationRange{
+		{From: "0.0.0.0"},
+	})
+
+	_, err := geodb.OpenIP2locationASN(filename)
+	assert.EqualError(t, err, "DB1 does not include the ASN fields")
+}
+
+type ip2locationRange struct {
+	From string // First IPv4 of the range, which ends before the next one.
+	ASN  string
+}
+
+// generateIP2location writes an IPv4 IP2Location BIN file of the given type (DB1 or DB26) with the given sorted ranges,
+// the first one must start at 0.0.0.0. Only the ASN field is filled, the others are set to "-".
+func generateIP2location(t *testing.T, dbtype byte, ranges []ip2locationRange) string {
+	t.Helper()
+
+	const (
+		header    = 64
+		asnColumn = 24
+	)
+
+	columns := map[byte]int{1: 2, 26: 25}[dbtype] // IP from and the fields of the package
+	require.NotZero(t, columns, "DB%d", dbtype)
+	rowsize := columns * 4
+
+	// The rows are followed by a last row holding the end of the last range, then by the strings.
+	rows := len(ranges)
+	base := header + rows*rowsize + rowsize
+
+	str := func(data []byte, s string) ([]byte, uint32) {
+		return append(append(data, byte(len(s))), s...), uint32(base + len(data)) // 0-based address
+	}
+	data, dash := str(nil, "-")
+
+	b := make([]byte, header, base)
+	b[0] = dbtype
+	b[1] = byte(columns)
+	b[2], b[3], b[4] = 24, 1, 1 // Date
+	binary.LittleEndian.PutUint32(b[5:], uint32(rows))
+	binary.LittleEndian.PutUint32(b[9:], header+1) // 1-based address
+	b[29] = 1                                      // IP2Location product
+
+	for _, r := range ranges {
+		ip := net.ParseIP(r.From).To4()
+		require.NotNil(t, ip, r.From)
+		b = binary.LittleEndian.AppendUint32(b, binary.BigEndian.Uint32(ip))
+
+		var asn uint32
+		data, asn = str(data, r.ASN)
+
+		for column := 2; column <= columns; column++ {
+			if column == asnColumn {
+				b = binary.LittleEndian.AppendUint32(b, asn)
+				continue
+			}
+			b = binary.LittleEndian.AppendUint32(b, dash)
+		}
+	}
+
+	b = binary.LittleEndian.AppendUint32(b, 0xFFFFFFFF)
+	b = append(b, make([]byte, rowsize-4)...)
+	b = append(b, data...)
+	binary.LittleEndian.PutUint32(b[31:], uint32(len(b)))
+
+	filename := filepath.Join(t.TempDir(), "IP2LOCATION-LITE-ASN.BIN")
+	require.NoError(t, os.WriteFile(filename, b, 0o644))
+	return filename
+}
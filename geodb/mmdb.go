@@ -0,0 +1,67 @@
+package geodb
+
+import (
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// An MMDB looks up countries or Autonomous Systems from a MaxMind DB file (e.g. GeoLite2-Country, GeoLite2-ASN).
+type MMDB struct {
+	reader *maxminddb.Reader
+}
+
+// OpenMMDB opens the given MaxMind DB file.
+func OpenMMDB(filename string) (*MMDB, error) {
+	reader, err := maxminddb.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MMDB{
+		reader: reader,
+	}, nil
+}
+
+// Country returns the lowercased ISO 3166-1 country code of the given IP.
+// The registered country is used when the IP is not located in a country (e.g. anycast networks).
+// It returns an empty string when the IP is not found.
+func (l *MMDB) Country(ip net.IP) (string, error) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+
+	err := l.reader.Lookup(ip, &record)
+	if err != nil {
+		return "", err
+	}
+
+	country := record.Country.ISOCode
+	if country == "" {
+		country = record.RegisteredCountry.ISOCode
+	}
+
+	return strings.ToLower(country), nil
+}
+
+// ASN returns the Autonomous System Number of the given IP.
+// It returns zero when the IP is not found.
+func (l *MMDB) ASN(ip net.IP) (uint, error) {
+	var record struct {
+		AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+	}
+
+	err := l.reader.Lookup(ip, &record)
+	return record.AutonomousSystemNumber, err
+}
+
+// Close closes the underlying database file.
+func (l *MMDB) Close() error {
+	return l.reader.Close()
+}
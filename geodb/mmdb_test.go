@@ -0,0 +1,105 @@
+package geodb_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/mdouchement/geoblock-proxy/geodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMMDB_Country(t *testing.T) {
+	filename := generateMMDB(t, "GeoLite2-Country", map[string]mmdbtype.Map{
+		"192.0.2.0/24": {
+			"country": mmdbtype.Map{"iso_code": mmdbtype.String("FR")},
+		},
+		"198.51.100.0/24": {
+			"registered_country": mmdbtype.Map{"iso_code": mmdbtype.String("DE")},
+		},
+		"2001:db8::/32": {
+			"country":            mmdbtype.Map{"iso_code": mmdbtype.String("CH")},
+			"registered_country": mmdbtype.Map{"iso_code": mmdbtype.String("DE")},
+		},
+	})
+
+	db, err := geodb.OpenMMDB(filename)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tests := map[string]string{
+		"192.0.2.42":    "fr",
+		"198.51.100.42": "de",
+		"2001:db8::42":  "ch",
+		"203.0.113.42":  "",
+	}
+
+	for ip, expected := range tests {
+		country, err := db.Country(net.ParseIP(ip))
+		assert.NoError(t, err, ip)
+		assert.Equal(t, expected, country, ip)
+	}
+}
+
+func TestMMDB_ASN(t *testing.T) {
+	filename := generateMMDB(t, "GeoLite2-ASN", map[string]mmdbtype.Map{
+		"192.0.2.0/24": {
+			"autonomous_system_number":       mmdbtype.Uint32(14061),
+			"autonomous_system_organization": mmdbtype.String("DIGITALOCEAN-ASN"),
+		},
+		"2001:db8::/32": {
+			"autonomous_system_number": mmdbtype.Uint32(16276),
+		},
+	})
+
+	db, err := geodb.OpenMMDB(filename)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tests := map[string]uint{
+		"192.0.2.42":   14061,
+		"2001:db8::42": 16276,
+		"203.0.113.42": 0,
+	}
+
+	for ip, expected := range tests {
+		asn, err := db.ASN(net.ParseIP(ip))
+		assert.NoError(t, err, ip)
+		assert.Equal(t, expected, asn, ip)
+	}
+}
+
+func TestOpenMMDB(t *testing.T) {
+	_, err := geodb.OpenMMDB(filepath.Join(t.TempDir(), "missing.mmdb"))
+	assert.Error(t, err)
+}
+
+func generateMMDB(t *testing.T, kind string, records map[string]mmdbtype.Map) string {
+	t.Helper()
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{
+		DatabaseType:            kind,
+		IncludeReservedNetworks: true,
+	})
+	require.NoError(t, err)
+
+	for cidr, record := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		require.NoError(t, tree.Insert(network, record))
+	}
+
+	filename := filepath.Join(t.TempDir(), kind+".mmdb")
+	f, err := os.Create(filename)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = tree.WriteTo(f)
+	require.NoError(t, err)
+
+	return filename
+}
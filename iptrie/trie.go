@@ -0,0 +1,119 @@
+package iptrie
+
+import (
+	"net"
+)
+
+type (
+	// A Trie is a set of CIDR blocks indexed by their prefix bits.
+	// Matching an IP costs at most 32 (IPv4) or 128 (IPv6) steps whatever the number of blocks.
+	// It follows the semantics of net.IPNet.Contains.
+	Trie struct {
+		v4  *node
+		v6  *node
+		len int
+	}
+
+	node struct {
+		children [2]*node
+		block    *net.IPNet // The block ending on this node.
+	}
+)
+
+// New returns a new empty Trie.
+func New() *Trie {
+	return &Trie{
+		v4: new(node),
+		v6: new(node),
+	}
+}
+
+// Insert adds the given block to the trie.
+func (t *Trie) Insert(block *net.IPNet) {
+	root, ip, bits := t.prefix(block)
+	if root == nil {
+		return
+	}
+	t.len++
+
+	n := root
+	for i := 0; i < bits; i++ {
+		b := bit(ip, i)
+		if n.children[b] == nil {
+			n.children[b] = new(node)
+		}
+		n = n.children[b]
+	}
+
+	n.block = block
+}
+
+// Contains reports whether one of the blocks contains the given IP.
+func (t *Trie) Contains(ip net.IP) bool {
+	return t.match(ip, false) != nil
+}
+
+// Match returns the block containing the given IP, or nil when there is none.
+// When several blocks contain the IP, the longest prefix is returned.
+func (t *Trie) Match(ip net.IP) *net.IPNet {
+	return t.match(ip, true)
+}
+
+// match walks down the trie following the bits of the IP, it stops at the first block unless longest is true.
+func (t *Trie) match(ip net.IP, longest bool) *net.IPNet {
+	root := t.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		root = t.v4
+		ip = ip4
+	} else if len(ip) != net.IPv6len {
+		return nil
+	}
+
+	var block *net.IPNet
+	n := root
+	for i := 0; n != nil; i++ {
+		if n.block != nil {
+			block = n.block
+			if !longest {
+				break
+			}
+		}
+
+		if i == len(ip)*8 {
+			break
+		}
+		n = n.children[bit(ip, i)]
+	}
+
+	return block
+}
+
+// Len returns the number of blocks inserted in the trie.
+func (t *Trie) Len() int {
+	return t.len
+}
+
+// prefix returns the root, the network number and the prefix length of the given block.
+// Like net.IPNet.Contains, IPv4-mapped IPv6 networks are matched as IPv4 networks.
+func (t *Trie) prefix(block *net.IPNet) (*node, net.IP, int) {
+	ones, size := block.Mask.Size()
+	if size == 0 {
+		return nil, nil, 0 // Non-canonical mask
+	}
+
+	if ip4 := block.IP.To4(); ip4 != nil {
+		if size == 8*net.IPv6len {
+			ones = max(ones-96, 0)
+		}
+		return t.v4, ip4, ones
+	}
+
+	if len(block.IP) != net.IPv6len || size != 8*net.IPv6len {
+		return nil, nil, 0
+	}
+	return t.v6, block.IP, ones
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,189 @@
+package iptrie_test
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/mdouchement/geoblock-proxy/iptrie"
+	"github.com/stretchr/testify/assert"
+)
+
+// linear is the reference implementation the trie is compared to.
+type linear []*net.IPNet
+
+func (l linear) Contains(ip net.IP) bool {
+	for _, block := range l {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTrie_Contains(t *testing.T) {
+	trie := iptrie.New()
+	for _, cidr := range []string{
+		"10.0.0.0/8",
+		"10.1.0.0/16", // Covered by 10.0.0.0/8
+		"192.168.1.0/24",
+		"203.0.113.42/32",
+		"2001:db8::/32",
+		"2001:db8:1::/48", // Covered by 2001:db8::/32
+		"fd00::1/128",
+	} {
+		_, block, err := net.ParseCIDR(cidr)
+		assert.NoError(t, err)
+		trie.Insert(block)
+	}
+
+	assert.Equal(t, 7, trie.Len())
+
+	tests := map[string]bool{
+		"10.0.0.1":         true,
+		"10.255.255.255":   true,
+		"11.0.0.1":         false,
+		"192.168.1.200":    true,
+		"192.168.2.1":      false,
+		"203.0.113.42":     true,
+		"203.0.113.43":     false,
+		"::ffff:10.0.0.1":  true, // IPv4-mapped
+		"2001:db8:ffff::1": true,
+		"2001:db9::1":      false,
+		"fd00::1":          true,
+		"fd00::2":          false,
+	}
+
+	for ip, expected := range tests {
+		assert.Equal(t, expected, trie.Contains(net.ParseIP(ip)), ip)
+	}
+
+	assert.False(t, trie.Contains(nil))
+	assert.False(t, iptrie.New().Contains(net.ParseIP("10.0.0.1")))
+}
+
+func TestTrie_Match(t *testing.T) {
+	trie := iptrie.New()
+	for _, cidr := range []string{"10.1.0.0/16", "10.0.0.0/8", "2001:db8::/32"} {
+		_, block, _ := net.ParseCIDR(cidr)
+		trie.Insert(block)
+	}
+
+	assert.Equal(t, "10.1.0.0/16", trie.Match(net.ParseIP("10.1.2.3")).String(), "the longest prefix")
+	assert.Equal(t, "10.0.0.0/8", trie.Match(net.ParseIP("10.2.2.3")).String())
+	assert.Equal(t, "2001:db8::/32", trie.Match(net.ParseIP("2001:db8::1")).String())
+	assert.Nil(t, trie.Match(net.ParseIP("192.0.2.1")))
+}
+
+func TestTrie_ContainsDefaultRoutes(t *testing.T) {
+	trie := iptrie.New()
+
+	_, block, _ := net.ParseCIDR("0.0.0.0/0")
+	trie.Insert(block)
+
+	assert.True(t, trie.Contains(net.ParseIP("203.0.113.1")))
+	assert.False(t, trie.Contains(net.ParseIP("2001:db8::1")))
+
+	_, block, _ = net.ParseCIDR("::/0")
+	trie.Insert(block)
+
+	assert.True(t, trie.Contains(net.ParseIP("2001:db8::1")))
+}
+
+func TestTrie_SameSemanticsAsLinear(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	blocks := generate(r, 1000)
+	blocks = append(blocks, &net.IPNet{ // IPv4-mapped IPv6 network
+		IP:   net.ParseIP("::ffff:198.51.100.0"),
+		Mask: net.CIDRMask(120, 128),
+	})
+
+	trie := iptrie.New()
+	for _, block := range blocks {
+		trie.Insert(block)
+	}
+	reference := linear(blocks)
+
+	for i := 0; i < 100000; i++ {
+		ip := randomIP(r)
+		assert.Equal(t, reference.Contains(ip), trie.Contains(ip), ip.String())
+	}
+
+	// Test the edges of the blocks.
+	for _, block := range blocks {
+		last := make(net.IP, len(block.IP))
+		for i := range block.IP {
+			last[i] = block.IP[i] | ^block.Mask[i]
+		}
+
+		assert.Equal(t, reference.Contains(block.IP), trie.Contains(block.IP), block.String())
+		assert.Equal(t, reference.Contains(last), trie.Contains(last), block.String())
+	}
+}
+
+func BenchmarkContains(b *testing.B) {
+	for _, size := range []int{10, 1000, 100000} {
+		r := rand.New(rand.NewSource(42))
+
+		blocks := generate(r, size)
+		ips := make([]net.IP, 1024)
+		for i := range ips {
+			ips[i] = randomIP(r)
+		}
+
+		trie := iptrie.New()
+		for _, block := range blocks {
+			trie.Insert(block)
+		}
+
+		b.Run(fmt.Sprintf("linear-%d", size), func(b *testing.B) {
+			l := linear(blocks)
+			for i := 0; i < b.N; i++ {
+				l.Contains(ips[i%len(ips)])
+			}
+		})
+
+		b.Run(fmt.Sprintf("trie-%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				trie.Contains(ips[i%len(ips)])
+			}
+		})
+	}
+}
+
+// generate returns random blocks, 3/4 of IPv4 and 1/4 of IPv6.
+func generate(r *rand.Rand, n int) []*net.IPNet {
+	blocks := make([]*net.IPNet, n)
+	for i := range blocks {
+		ip := randomIP(r)
+
+		bits := 8 * net.IPv4len
+		ones := 8 + r.Intn(25) // [8, 32]
+		if len(ip) == net.IPv6len {
+			bits = 8 * net.IPv6len
+			ones = 16 + r.Intn(113) // [16, 128]
+		}
+
+		mask := net.CIDRMask(ones, bits)
+		blocks[i] = &net.IPNet{
+			IP:   ip.Mask(mask),
+			Mask: mask,
+		}
+	}
+
+	return blocks
+}
+
+func randomIP(r *rand.Rand) net.IP {
+	if r.Intn(4) == 0 {
+		ip := make(net.IP, net.IPv6len)
+		r.Read(ip)
+		return ip
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	r.Read(ip)
+	return ip
+}
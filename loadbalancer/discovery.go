@@ -0,0 +1,281 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SRVScheme prefixes the backends discovered with DNS SRV records (e.g. `srv://_sip._udp.example.com').
+const SRVScheme = "srv://"
+
+// DefaultResolveInterval is the default duration between two resolutions of the backends.
+const DefaultResolveInterval = 30 * time.Second
+
+// A Resolver looks up the DNS records of the backends, it is implemented by *net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// A Discovery is a Loadbalancer which periodically resolves its backends defined by hostname or SRV record.
+// Every resolved address becomes an individual backend of a loadbalancer built with the given strategy.
+// When a resolution fails, the previously resolved backends are kept.
+type Discovery struct {
+	strategy string
+	protocol string
+	frontend string
+	backends []Backend
+	resolver Resolver
+	interval time.Duration
+	onChange func(backends []net.Addr)
+	onError  func(err error)
+
+	mu       sync.RWMutex
+	lb       Loadbalancer
+	resolved []Backend
+}
+
+// NewDiscovery returns a new Discovery resolving the backends every interval with the given resolver
+// (net.DefaultResolver when nil). The backends are resolved once before returning.
+func NewDiscovery(strategy, protocol, frontend string, backends []Backend, resolver Resolver, interval time.Duration) (*Discovery, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if interval <= 0 {
+		interval = DefaultResolveInterval
+	}
+
+	d := &Discovery{
+		strategy: strategy,
+		protocol: protocol,
+		frontend: frontend,
+		backends: backends,
+		resolver: resolver,
+		interval: interval,
+		onChange: func([]net.Addr) {},
+		onError:  func(error) {},
+	}
+
+	if err := d.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// OnChange registers the function called when the resolved backends change.
+// It must be called before Run.
+func (d *Discovery) OnChange(fn func(backends []net.Addr)) {
+	d.onChange = fn
+}
+
+// OnError registers the function called when a resolution fails.
+// It must be called before Run.
+func (d *Discovery) OnError(fn func(err error)) {
+	d.onError = fn
+}
+
+// Frontend returns the listening address of the proxy.
+func (d *Discovery) Frontend() net.Addr {
+	return d.current().Frontend()
+}
+
+// Backend returns the next backend's endpoint on which the data of the given client is forwarded to.
+func (d *Discovery) Backend(client net.Addr) net.Addr {
+	return d.current().Backend(client)
+}
+
+func (d *Discovery) pick(client net.Addr, available func(net.Addr) bool) net.Addr {
+	return pick(d.current(), client, available)
+}
+
+// Backends returns all backend's endpoints on which the data can be forwarded to.
+func (d *Discovery) Backends() []net.Addr {
+	return d.current().Backends()
+}
+
+// Connected reports a new connection to the given backend.
+func (d *Discovery) Connected(backend net.Addr) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	connected(d.lb, backend)
+}
+
+// Disconnected reports the end of a connection to the given backend.
+func (d *Discovery) Disconnected(backend net.Addr) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	disconnected(d.lb, backend)
+}
+
+func (d *Discovery) current() Loadbalancer {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.lb
+}
+
+// Run resolves the backends every interval until the context is done.
+func (d *Discovery) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := d.Refresh(ctx); err != nil && ctx.Err() == nil {
+			d.onError(err)
+		}
+	}
+}
+
+// Refresh resolves the backends once and rebuilds the loadbalancer when they have changed.
+func (d *Discovery) Refresh(ctx context.Context) error {
+	var resolved []Backend
+	seen := make(map[string]bool)
+
+	for _, backend := range d.backends {
+		backends, err := Lookup(ctx, d.resolver, backend)
+		if err != nil {
+			return fmt.Errorf("backend: %w", err)
+		}
+
+		for _, b := range backends {
+			if !seen[b.Address] {
+				seen[b.Address] = true
+				resolved = append(resolved, b)
+			}
+		}
+	}
+
+	if len(resolved) == 0 {
+		return fmt.Errorf("backend: no address found")
+	}
+
+	d.mu.RLock()
+	unchanged := slices.Equal(resolved, d.resolved)
+	d.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	lb, err := New(d.strategy, d.protocol, d.frontend, resolved)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	if next, ok := lb.(*LeastConnections); ok {
+		if prev, ok := d.lb.(*LeastConnections); ok {
+			next.inherit(prev) // The connections opened before the change are still reported.
+		}
+	}
+	d.lb = lb
+	d.resolved = resolved
+	d.mu.Unlock()
+
+	d.onChange(lb.Backends())
+	return nil
+}
+
+// Dynamic returns true when one of the backends is defined by hostname or SRV record.
+func Dynamic(backends []Backend) bool {
+	for _, backend := range backends {
+		if strings.HasPrefix(backend.Address, SRVScheme) {
+			return true
+		}
+
+		host, _, err := net.SplitHostPort(backend.Address)
+		if err == nil && host != "" && net.ParseIP(host) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup resolves the given backend into one backend per IP address, sorted by address.
+// A backend defined by SRV record uses the targets of the lowest priority with their weight and port.
+// A backend defined by IP address is returned as is.
+func Lookup(ctx context.Context, resolver Resolver, backend Backend) ([]Backend, error) {
+	if name, ok := strings.CutPrefix(backend.Address, SRVScheme); ok {
+		return lookupSRV(ctx, resolver, name)
+	}
+
+	host, port, err := net.SplitHostPort(backend.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if host == "" || net.ParseIP(host) != nil {
+		return []Backend{backend}, nil
+	}
+
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s: no address found", host)
+	}
+
+	backends := make([]Backend, len(addrs))
+	for i, addr := range addrs {
+		backends[i] = Backend{Address: net.JoinHostPort(addr.String(), port), Weight: backend.Weight}
+	}
+
+	slices.SortFunc(backends, func(a, b Backend) int {
+		return strings.Compare(a.Address, b.Address)
+	})
+	return backends, nil
+}
+
+func lookupSRV(ctx context.Context, resolver Resolver, name string) ([]Backend, error) {
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: no SRV record found", name)
+	}
+
+	priority := records[0].Priority
+	for _, record := range records {
+		priority = min(priority, record.Priority)
+	}
+
+	var backends []Backend
+	for _, record := range records {
+		if record.Priority != priority {
+			continue
+		}
+
+		target := Backend{
+			Address: net.JoinHostPort(strings.TrimSuffix(record.Target, "."), fmt.Sprint(record.Port)),
+			Weight:  max(int(record.Weight), 1),
+		}
+
+		resolved, err := Lookup(ctx, resolver, target)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, resolved...)
+	}
+
+	slices.SortFunc(backends, func(a, b Backend) int {
+		return strings.Compare(a.Address, b.Address)
+	})
+	return backends, nil
+}
@@ -0,0 +1,177 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type resolver struct {
+	mu    sync.Mutex
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+}
+
+func (r *resolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addrs, nil
+}
+
+func (r *resolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records, ok := r.srv[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, records, nil
+}
+
+func (r *resolver) set(host string, ips ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.hosts[host] = ips
+}
+
+func TestDynamic(t *testing.T) {
+	assert.False(t, loadbalancer.Dynamic([]loadbalancer.Backend{{Address: "127.0.0.1:80"}, {Address: "[::1]:80"}, {Address: ":80"}}))
+	assert.True(t, loadbalancer.Dynamic([]loadbalancer.Backend{{Address: "127.0.0.1:80"}, {Address: "backend:80"}}))
+	assert.True(t, loadbalancer.Dynamic([]loadbalancer.Backend{{Address: "srv://_http._tcp.example.com"}}))
+}
+
+func TestLookup(t *testing.T) {
+	r := &resolver{
+		hosts: map[string][]string{
+			"backend":           {"10.0.0.2", "10.0.0.1"},
+			"a.example.com":     {"10.0.1.1", "2001:db8::1"},
+			"b.example.com":     {"10.0.1.2"},
+			"spare.example.com": {"10.0.1.3"},
+		},
+		srv: map[string][]*net.SRV{
+			"_http._tcp.example.com": {
+				{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 3},
+				{Target: "b.example.com.", Port: 8081, Priority: 10, Weight: 0},
+				{Target: "spare.example.com.", Port: 8080, Priority: 20, Weight: 1},
+			},
+		},
+	}
+
+	backends, err := loadbalancer.Lookup(context.Background(), r, loadbalancer.Backend{Address: "10.0.0.3:80", Weight: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []loadbalancer.Backend{{Address: "10.0.0.3:80", Weight: 2}}, backends)
+
+	backends, err = loadbalancer.Lookup(context.Background(), r, loadbalancer.Backend{Address: "backend:80", Weight: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []loadbalancer.Backend{{Address: "10.0.0.1:80", Weight: 2}, {Address: "10.0.0.2:80", Weight: 2}}, backends)
+
+	backends, err = loadbalancer.Lookup(context.Background(), r, loadbalancer.Backend{Address: "srv://_http._tcp.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []loadbalancer.Backend{
+		{Address: "10.0.1.1:8080", Weight: 3},
+		{Address: "10.0.1.2:8081", Weight: 1},
+		{Address: "[2001:db8::1]:8080", Weight: 3},
+	}, backends, "only the lowest priority is used")
+
+	_, err = loadbalancer.Lookup(context.Background(), r, loadbalancer.Backend{Address: "unknown:80"})
+	assert.Error(t, err)
+
+	_, err = loadbalancer.Lookup(context.Background(), r, loadbalancer.Backend{Address: "srv://_unknown._tcp.example.com"})
+	assert.Error(t, err)
+}
+
+func TestDiscovery_Refresh(t *testing.T) {
+	r := &resolver{
+		hosts: map[string][]string{
+			"backend": {"10.0.0.1"},
+		},
+	}
+
+	d, err := loadbalancer.NewDiscovery(loadbalancer.StrategyLeastConnections, "tcp", "127.0.0.1:5050", []loadbalancer.Backend{
+		{Address: "backend:80"},
+		{Address: "10.0.0.9:80"},
+	}, r, 0)
+	require.NoError(t, err)
+
+	var changes [][]string
+	d.OnChange(func(backends []net.Addr) {
+		var addresses []string
+		for _, backend := range backends {
+			addresses = append(addresses, backend.String())
+		}
+		changes = append(changes, addresses)
+	})
+
+	assert.Equal(t, "127.0.0.1:5050", d.Frontend().String())
+	require.Len(t, d.Backends(), 2)
+	assert.Equal(t, "10.0.0.1:80", d.Backends()[0].String())
+	assert.Equal(t, "10.0.0.9:80", d.Backends()[1].String())
+
+	kept := d.Backends()[1]
+	d.Connected(kept)
+
+	// New addresses.
+	r.set("backend", "10.0.0.2", "10.0.0.3")
+	require.NoError(t, d.Refresh(context.Background()))
+	assert.Equal(t, [][]string{{"10.0.0.2:80", "10.0.0.3:80", "10.0.0.9:80"}}, changes)
+
+	// The connections are still tracked.
+	for i := 0; i < 6; i++ {
+		assert.NotEqual(t, kept.String(), d.Backend(nil).String())
+	}
+	d.Disconnected(kept)
+
+	// Nothing changed.
+	require.NoError(t, d.Refresh(context.Background()))
+	assert.Len(t, changes, 1)
+
+	// The resolution fails, the previous backends are kept.
+	r.set("backend")
+	assert.Error(t, d.Refresh(context.Background()))
+	r.mu.Lock()
+	delete(r.hosts, "backend")
+	r.mu.Unlock()
+	assert.Error(t, d.Refresh(context.Background()))
+	assert.Len(t, d.Backends(), 3)
+	assert.Len(t, changes, 1)
+}
+
+func TestDiscovery_Ejector(t *testing.T) {
+	r := &resolver{
+		hosts: map[string][]string{
+			"backend": {"10.0.0.1", "10.0.0.2"},
+		},
+	}
+
+	d, err := loadbalancer.NewDiscovery("", "tcp", "127.0.0.1:5050", []loadbalancer.Backend{{Address: "backend:80"}}, r, 0)
+	require.NoError(t, err)
+
+	e := loadbalancer.NewEjector(d, 1, 0)
+	e.DialFailed(d.Backends()[0])
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "10.0.0.2:80", e.Backend(nil).String())
+	}
+
+	_, err = loadbalancer.NewDiscovery("", "tcp", "127.0.0.1:5050", []loadbalancer.Backend{{Address: "unknown:80"}}, r, 0)
+	var dnserr *net.DNSError
+	assert.True(t, errors.As(err, &dnserr))
+}
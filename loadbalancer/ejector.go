@@ -0,0 +1,130 @@
+package loadbalancer
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Default passive health check settings.
+const (
+	DefaultMaxFails    = 3
+	DefaultFailTimeout = 30 * time.Second
+)
+
+// An Ejector is a Loadbalancer that temporarily ejects the backends of another Loadbalancer
+// after consecutive connection failures (a.k.a. passive health check).
+// The connection results are reported by the proxy.
+type Ejector struct {
+	lb          Loadbalancer
+	maxFails    int
+	failTimeout time.Duration
+
+	mu     sync.Mutex
+	states map[string]*ejection // Indexed by backend address
+}
+
+type ejection struct {
+	failures int
+	until    time.Time
+}
+
+// NewEjector returns a new Ejector which ejects a backend for failTimeout after maxFails consecutive failures.
+func NewEjector(lb Loadbalancer, maxFails int, failTimeout time.Duration) *Ejector {
+	if maxFails <= 0 {
+		maxFails = DefaultMaxFails
+	}
+	if failTimeout <= 0 {
+		failTimeout = DefaultFailTimeout
+	}
+
+	return &Ejector{
+		lb:          lb,
+		maxFails:    maxFails,
+		failTimeout: failTimeout,
+		states:      make(map[string]*ejection),
+	}
+}
+
+// Frontend returns the listening address of the proxy.
+func (e *Ejector) Frontend() net.Addr {
+	return e.lb.Frontend()
+}
+
+// Backend returns the next backend's endpoint which is not ejected.
+// When all the backends are ejected, the backend chosen by the underlying loadbalancer is returned.
+func (e *Ejector) Backend(client net.Addr) net.Addr {
+	if backend := e.pick(client, nil); backend != nil {
+		return backend
+	}
+	return e.lb.Backend(client)
+}
+
+// PickBackend returns the next backend of the client satisfying the predicate which is not ejected.
+// When all the satisfying backends are ejected, one of them is returned, nil when there is none.
+func (e *Ejector) PickBackend(client net.Addr, available func(net.Addr) bool) net.Addr {
+	if backend := e.pick(client, available); backend != nil {
+		return backend
+	}
+	return pick(e.lb, client, available)
+}
+
+func (e *Ejector) pick(client net.Addr, available func(net.Addr) bool) net.Addr {
+	return pick(e.lb, client, both(available, func(backend net.Addr) bool {
+		return !e.Ejected(backend)
+	}))
+}
+
+// Backends returns all backend's endpoints on which the data can be forwarded to.
+func (e *Ejector) Backends() []net.Addr {
+	return e.lb.Backends()
+}
+
+// Connected reports a new connection to the given backend.
+func (e *Ejector) Connected(backend net.Addr) {
+	connected(e.lb, backend)
+}
+
+// Disconnected reports the end of a connection to the given backend.
+func (e *Ejector) Disconnected(backend net.Addr) {
+	disconnected(e.lb, backend)
+}
+
+// Ejected returns true when the given backend is temporarily ejected.
+func (e *Ejector) Ejected(backend net.Addr) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	state, ok := e.states[backend.String()]
+	return ok && time.Now().Before(state.until)
+}
+
+// DialSucceeded reports a successful connection to the given backend.
+func (e *Ejector) DialSucceeded(backend net.Addr) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.states, backend.String())
+}
+
+// DialFailed reports a failed connection to the given backend.
+// It returns true when the backend has been ejected.
+func (e *Ejector) DialFailed(backend net.Addr) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	state, ok := e.states[backend.String()]
+	if !ok {
+		state = &ejection{}
+		e.states[backend.String()] = state
+	}
+
+	// Once ejected, a single failure is enough to eject again the backend when the timeout is over.
+	state.failures++
+	if state.failures < e.maxFails {
+		return false
+	}
+
+	state.until = time.Now().Add(e.failTimeout)
+	return true
+}
@@ -0,0 +1,66 @@
+package loadbalancer_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEjector(t *testing.T) {
+	lb := newRoundRobin(t, "tcp", "127.0.0.1:5000", "127.0.0.1:5001")
+	backend := lb.Backends()[0]
+
+	e := loadbalancer.NewEjector(lb, 2, 50*time.Millisecond)
+
+	assert.False(t, e.DialFailed(backend))
+	e.DialSucceeded(backend) // Resets the consecutive failures.
+	assert.False(t, e.DialFailed(backend))
+	assert.False(t, e.Ejected(backend))
+
+	assert.True(t, e.DialFailed(backend))
+	assert.True(t, e.Ejected(backend))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "127.0.0.1:5001", e.Backend(nil).String())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, e.Ejected(backend), "fail timeout is over")
+
+	assert.True(t, e.DialFailed(backend), "a single failure ejects again the backend")
+	e.DialSucceeded(backend)
+	assert.False(t, e.Ejected(backend))
+}
+
+func TestEjector_AllEjected(t *testing.T) {
+	lb := newRoundRobin(t, "tcp", "127.0.0.1:5000", "127.0.0.1:5001")
+
+	e := loadbalancer.NewEjector(lb, 1, time.Minute)
+	for _, backend := range lb.Backends() {
+		assert.True(t, e.DialFailed(backend))
+	}
+
+	assert.Equal(t, "127.0.0.1:5000", e.Backend(nil).String(), "the backends are still used when all of them are ejected")
+}
+
+func TestEjector_PickBackend(t *testing.T) {
+	lb := newRoundRobin(t, "tcp", "127.0.0.1:5000", "127.0.0.1:5001", "127.0.0.1:5002")
+	tried := map[string]bool{"127.0.0.1:5000": true}
+	untried := func(backend net.Addr) bool {
+		return !tried[backend.String()]
+	}
+
+	e := loadbalancer.NewEjector(lb, 1, time.Minute)
+	assert.True(t, e.DialFailed(lb.Backends()[1]))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "127.0.0.1:5002", e.PickBackend(nil, untried).String(), "tried and ejected backends are skipped")
+	}
+
+	tried["127.0.0.1:5002"] = true
+	assert.Equal(t, "127.0.0.1:5001", e.PickBackend(nil, untried).String(), "an ejected backend is used when it is the last one")
+
+	tried["127.0.0.1:5001"] = true
+	assert.Nil(t, e.PickBackend(nil, untried))
+}
@@ -0,0 +1,307 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Default health check settings.
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultHealthCheckRise     = 2
+	DefaultHealthCheckFall     = 3
+)
+
+// A HealthCheck defines how the backends are probed.
+//
+// A TCP backend is healthy when it accepts connections, an UDP backend is healthy when it answers to the Send payload.
+// When Send is not empty, it is written to the backend after the connection.
+// When Expect is not empty, the response of the backend must start with it.
+type HealthCheck struct {
+	Interval time.Duration // Duration between two probes of a backend.
+	Timeout  time.Duration // Maximum duration of a probe.
+	Rise     int           // Number of consecutive successful probes needed to mark a backend up.
+	Fall     int           // Number of consecutive failed probes needed to mark a backend down.
+	Send     []byte
+	Expect   []byte
+}
+
+// A HealthChecker is a Loadbalancer that probes the backends of another Loadbalancer
+// and skips the unhealthy ones.
+// The backends are considered healthy until they fail their probes.
+type HealthChecker struct {
+	lb       Loadbalancer
+	protocol string
+	check    HealthCheck
+	onChange func(backend net.Addr, up bool)
+	onUpdate func(added, removed []net.Addr)
+
+	mu     sync.RWMutex
+	states map[string]*healthState // Indexed by backend address
+}
+
+type healthState struct {
+	backend   net.Addr
+	up        bool
+	successes int
+	failures  int
+}
+
+// NewHealthChecker returns a new HealthChecker of the given loadbalancer.
+func NewHealthChecker(lb Loadbalancer, protocol string, check HealthCheck) (*HealthChecker, error) {
+	if check.Interval <= 0 {
+		check.Interval = DefaultHealthCheckInterval
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = DefaultHealthCheckTimeout
+	}
+	if check.Rise <= 0 {
+		check.Rise = DefaultHealthCheckRise
+	}
+	if check.Fall <= 0 {
+		check.Fall = DefaultHealthCheckFall
+	}
+
+	switch protocol {
+	case ProtocolTCP:
+	case ProtocolUDP:
+		if len(check.Send) == 0 {
+			return nil, errors.New("health check: a payload to send is required for udp")
+		}
+	default:
+		return nil, fmt.Errorf("health check: unsupported protocol: %s", protocol)
+	}
+
+	h := &HealthChecker{
+		lb:       lb,
+		protocol: protocol,
+		check:    check,
+		onChange: func(net.Addr, bool) {},
+		onUpdate: func(_, _ []net.Addr) {},
+		states:   make(map[string]*healthState),
+	}
+
+	for _, backend := range lb.Backends() {
+		h.states[backend.String()] = &healthState{backend: backend, up: true}
+	}
+
+	return h, nil
+}
+
+// OnChange registers the function called when a backend goes up or down.
+// It must be called before Run.
+func (h *HealthChecker) OnChange(fn func(backend net.Addr, up bool)) {
+	h.onChange = fn
+}
+
+// OnUpdate registers the function called when backends are added to or removed from the underlying loadbalancer
+// (e.g. by a Discovery), the added backends are healthy until they fail their probes.
+// It must be called before Run.
+func (h *HealthChecker) OnUpdate(fn func(added, removed []net.Addr)) {
+	h.onUpdate = fn
+}
+
+// Frontend returns the listening address of the proxy.
+func (h *HealthChecker) Frontend() net.Addr {
+	return h.lb.Frontend()
+}
+
+// Backend returns the next healthy backend's endpoint on which the data is forwarded to.
+// When all the backends are down, the backend chosen by the underlying loadbalancer is returned.
+func (h *HealthChecker) Backend(client net.Addr) net.Addr {
+	if backend := h.pick(client, nil); backend != nil {
+		return backend
+	}
+	return h.lb.Backend(client)
+}
+
+// pick returns the next healthy backend satisfying the predicate.
+// When all the backends are down, it picks among the whole pool like Backend.
+func (h *HealthChecker) pick(client net.Addr, available func(net.Addr) bool) net.Addr {
+	if backend := pick(h.lb, client, both(available, h.Healthy)); backend != nil || !h.allDown() {
+		return backend
+	}
+	return pick(h.lb, client, available)
+}
+
+// allDown returns true when none of the backends is healthy.
+func (h *HealthChecker) allDown() bool {
+	for _, backend := range h.lb.Backends() {
+		if h.Healthy(backend) {
+			return false
+		}
+	}
+	return true
+}
+
+// Backends returns all backend's endpoints on which the data can be forwarded to.
+func (h *HealthChecker) Backends() []net.Addr {
+	return h.lb.Backends()
+}
+
+// Connected reports a new connection to the given backend.
+func (h *HealthChecker) Connected(backend net.Addr) {
+	connected(h.lb, backend)
+}
+
+// Disconnected reports the end of a connection to the given backend.
+func (h *HealthChecker) Disconnected(backend net.Addr) {
+	disconnected(h.lb, backend)
+}
+
+// Healthy returns true when the given backend is up.
+func (h *HealthChecker) Healthy(backend net.Addr) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	state, ok := h.states[backend.String()]
+	return !ok || state.up
+}
+
+// Run probes the backends every interval until the context is done.
+func (h *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.check.Interval)
+	defer ticker.Stop()
+
+	for {
+		h.Check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check probes all the backends once and updates their state.
+func (h *HealthChecker) Check(ctx context.Context) {
+	backends := h.lb.Backends()
+	h.update(backends)
+
+	var wg sync.WaitGroup
+	for _, backend := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.report(backend, h.probe(ctx, backend))
+		}()
+	}
+
+	wg.Wait()
+}
+
+// update tracks the state of the given backends and forgets the removed ones.
+func (h *HealthChecker) update(backends []net.Addr) {
+	h.mu.Lock()
+
+	var added, removed []net.Addr
+	current := make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		current[backend.String()] = true
+		if _, ok := h.states[backend.String()]; !ok {
+			h.states[backend.String()] = &healthState{backend: backend, up: true}
+			added = append(added, backend)
+		}
+	}
+
+	for address, state := range h.states {
+		if !current[address] {
+			delete(h.states, address)
+			removed = append(removed, state.backend)
+		}
+	}
+
+	h.mu.Unlock()
+
+	if len(added) > 0 || len(removed) > 0 {
+		h.onUpdate(added, removed)
+	}
+}
+
+func (h *HealthChecker) report(backend net.Addr, err error) {
+	h.mu.Lock()
+
+	state, ok := h.states[backend.String()]
+	if !ok {
+		state = &healthState{backend: backend, up: true}
+		h.states[backend.String()] = state
+	}
+
+	if err == nil {
+		state.successes++
+		state.failures = 0
+	} else {
+		state.failures++
+		state.successes = 0
+	}
+
+	changed := false
+	switch {
+	case state.up && state.failures >= h.check.Fall:
+		state.up = false
+		changed = true
+	case !state.up && state.successes >= h.check.Rise:
+		state.up = true
+		changed = true
+	}
+	up := state.up
+
+	h.mu.Unlock()
+
+	if changed {
+		h.onChange(backend, up)
+	}
+}
+
+// probe checks once the given backend.
+func (h *HealthChecker) probe(ctx context.Context, backend net.Addr) error {
+	ctx, cancel := context.WithTimeout(ctx, h.check.Timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, h.protocol, backend.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline) //nolint:errcheck
+	}
+
+	if len(h.check.Send) > 0 {
+		if _, err = conn.Write(h.check.Send); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case len(h.check.Expect) > 0:
+		response := make([]byte, len(h.check.Expect))
+		if h.protocol == ProtocolUDP {
+			response = make([]byte, 65535) // A datagram is read at once.
+		}
+
+		n, err := io.ReadAtLeast(conn, response, len(h.check.Expect))
+		if err != nil {
+			return err
+		}
+
+		if !bytes.HasPrefix(response[:n], h.check.Expect) {
+			return fmt.Errorf("unexpected response: %q", response[:n])
+		}
+	case h.protocol == ProtocolUDP:
+		_, err = conn.Read(make([]byte, 65535))
+		return err
+	}
+
+	return nil
+}
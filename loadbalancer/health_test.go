@@ -0,0 +1,229 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthChecker_TCP(t *testing.T) {
+	alive, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer alive.Close()
+	go func() {
+		for {
+			c, err := alive.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead.Close() // Connections are refused.
+
+	lb := newRoundRobin(t, "tcp", alive.Addr().String(), dead.Addr().String())
+
+	var changes []string
+	h, err := loadbalancer.NewHealthChecker(lb, "tcp", loadbalancer.HealthCheck{
+		Timeout: time.Second,
+		Rise:    2,
+		Fall:    2,
+	})
+	require.NoError(t, err)
+	h.OnChange(func(backend net.Addr, up bool) {
+		changes = append(changes, backend.String()+" "+map[bool]string{true: "up", false: "down"}[up])
+	})
+
+	// Healthy until proven otherwise.
+	assert.True(t, h.Healthy(lb.Backends()[1]))
+
+	h.Check(context.Background())
+	assert.True(t, h.Healthy(lb.Backends()[1]), "fall threshold not reached")
+
+	h.Check(context.Background())
+	assert.True(t, h.Healthy(lb.Backends()[0]))
+	assert.False(t, h.Healthy(lb.Backends()[1]))
+	assert.Equal(t, []string{dead.Addr().String() + " down"}, changes)
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, alive.Addr().String(), h.Backend(nil).String())
+	}
+
+	// The backend comes back.
+	revived, err := net.Listen("tcp", dead.Addr().String())
+	require.NoError(t, err)
+	defer revived.Close()
+
+	h.Check(context.Background())
+	assert.False(t, h.Healthy(lb.Backends()[1]), "rise threshold not reached")
+
+	h.Check(context.Background())
+	assert.True(t, h.Healthy(lb.Backends()[1]))
+	assert.Equal(t, []string{dead.Addr().String() + " down", dead.Addr().String() + " up"}, changes)
+}
+
+func TestHealthChecker_AllDown(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead.Close()
+
+	lb := newRoundRobin(t, "tcp", dead.Addr().String())
+
+	h, err := loadbalancer.NewHealthChecker(lb, "tcp", loadbalancer.HealthCheck{Fall: 1})
+	require.NoError(t, err)
+
+	h.Check(context.Background())
+	assert.False(t, h.Healthy(lb.Backends()[0]))
+	assert.Equal(t, dead.Addr().String(), h.Backend(nil).String(), "the backends are still used when all of them are down")
+}
+
+func TestHealthChecker_Update(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead.Close()
+	_, port, _ := net.SplitHostPort(dead.Addr().String())
+
+	r := &resolver{
+		hosts: map[string][]string{
+			"backend": {"127.0.0.1"},
+		},
+	}
+	d, err := loadbalancer.NewDiscovery("", "tcp", "127.0.0.1:0", []loadbalancer.Backend{{Address: "backend:" + port}}, r, 0)
+	require.NoError(t, err)
+
+	h, err := loadbalancer.NewHealthChecker(d, "tcp", loadbalancer.HealthCheck{Timeout: time.Second, Fall: 1})
+	require.NoError(t, err)
+
+	var updates []string
+	h.OnUpdate(func(added, removed []net.Addr) {
+		for _, backend := range added {
+			updates = append(updates, "added "+backend.String())
+		}
+		for _, backend := range removed {
+			updates = append(updates, "removed "+backend.String())
+		}
+	})
+
+	h.Check(context.Background())
+	assert.Empty(t, updates, "the initial backends are known")
+	assert.False(t, h.Healthy(d.Backends()[0]))
+
+	r.set("backend", "127.0.0.2")
+	require.NoError(t, d.Refresh(context.Background()))
+	h.Check(context.Background())
+	assert.Equal(t, []string{"added 127.0.0.2:" + port, "removed 127.0.0.1:" + port}, updates)
+
+	// A removed backend comes back.
+	r.set("backend", "127.0.0.1")
+	require.NoError(t, d.Refresh(context.Background()))
+	updates = nil
+	h.Check(context.Background())
+	assert.Equal(t, []string{"added 127.0.0.1:" + port, "removed 127.0.0.2:" + port}, updates)
+}
+
+func TestHealthChecker_SendExpect(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+	go func() {
+		for {
+			c, err := server.Accept()
+			if err != nil {
+				return
+			}
+
+			buf := make([]byte, 64)
+			n, _ := c.Read(buf)
+			if string(buf[:n]) == "PING\r\n" {
+				c.Write([]byte("+PONG\r\n")) //nolint:errcheck
+			} else {
+				c.Write([]byte("-ERR\r\n")) //nolint:errcheck
+			}
+			c.Close()
+		}
+	}()
+
+	lb := newRoundRobin(t, "tcp", server.Addr().String())
+
+	h, err := loadbalancer.NewHealthChecker(lb, "tcp", loadbalancer.HealthCheck{
+		Fall:   1,
+		Send:   []byte("PING\r\n"),
+		Expect: []byte("+PONG"),
+	})
+	require.NoError(t, err)
+
+	h.Check(context.Background())
+	assert.True(t, h.Healthy(lb.Backends()[0]))
+
+	h, err = loadbalancer.NewHealthChecker(lb, "tcp", loadbalancer.HealthCheck{
+		Fall:   1,
+		Send:   []byte("HELLO\r\n"),
+		Expect: []byte("+PONG"),
+	})
+	require.NoError(t, err)
+
+	h.Check(context.Background())
+	assert.False(t, h.Healthy(lb.Backends()[0]))
+}
+
+func TestHealthChecker_UDP(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, from, err := server.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) == "ping" {
+				server.WriteToUDP([]byte("pong"), from) //nolint:errcheck
+			}
+		}
+	}()
+
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer silent.Close()
+
+	lb := newRoundRobin(t, "udp", server.LocalAddr().String(), silent.LocalAddr().String())
+
+	_, err = loadbalancer.NewHealthChecker(lb, "udp", loadbalancer.HealthCheck{})
+	assert.Error(t, err, "a payload is required")
+
+	h, err := loadbalancer.NewHealthChecker(lb, "udp", loadbalancer.HealthCheck{
+		Timeout: 200 * time.Millisecond,
+		Fall:    1,
+		Send:    []byte("ping"),
+		Expect:  []byte("pong"),
+	})
+	require.NoError(t, err)
+
+	h.Check(context.Background())
+	assert.True(t, h.Healthy(lb.Backends()[0]))
+	assert.False(t, h.Healthy(lb.Backends()[1]), "no answer")
+}
+
+func newRoundRobin(t *testing.T, protocol string, backends ...string) *loadbalancer.RoundRobin {
+	t.Helper()
+
+	dsn := url.URL{
+		Scheme:   protocol,
+		Host:     "127.0.0.1:5050",
+		RawQuery: url.Values{"backend": backends}.Encode(),
+	}
+
+	lb, err := loadbalancer.NewRoundRobin(dsn.String())
+	require.NoError(t, err)
+	return lb
+}
@@ -0,0 +1,124 @@
+package loadbalancer
+
+import (
+	"net"
+	"sync"
+)
+
+// A LeastConnections is a loadbalancer which forwards to the backend having the fewest active connections
+// relatively to its weight. The connections are reported by the proxy (see ConnectionTracker).
+// Ties are broken by walking through the backends one at a time.
+type LeastConnections struct {
+	frontend net.Addr
+	backends []net.Addr
+	weights  []int
+
+	mu      sync.Mutex
+	indexes map[string]int // Indexed by backend address
+	conns   []int
+	next    int
+}
+
+func newLeastConnections(protocol, frontend string, backends []Backend) (*LeastConnections, error) {
+	var err error
+
+	lb := &LeastConnections{
+		weights: weights(backends),
+		indexes: make(map[string]int, len(backends)),
+		conns:   make([]int, len(backends)),
+	}
+
+	lb.frontend, lb.backends, err = resolve(protocol, frontend, addresses(backends))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, backend := range lb.backends {
+		lb.indexes[backend.String()] = i
+	}
+
+	return lb, nil
+}
+
+// Frontend returns the listening address of the proxy.
+func (l *LeastConnections) Frontend() net.Addr {
+	return l.frontend
+}
+
+// Backend returns the next backend's endpoint on which the data is forwarded to.
+func (l *LeastConnections) Backend(client net.Addr) net.Addr {
+	return l.pick(client, nil)
+}
+
+// Backends returns all backend's endpoints on which the data can be forwarded to.
+func (l *LeastConnections) Backends() []net.Addr {
+	return l.backends
+}
+
+// Connected reports a new connection to the given backend.
+func (l *LeastConnections) Connected(backend net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if i, ok := l.indexes[backend.String()]; ok {
+		l.conns[i]++
+	}
+}
+
+// Disconnected reports the end of a connection to the given backend.
+func (l *LeastConnections) Disconnected(backend net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if i, ok := l.indexes[backend.String()]; ok && l.conns[i] > 0 {
+		l.conns[i]--
+	}
+}
+
+// Connections returns the number of active connections of the given backend.
+func (l *LeastConnections) Connections(backend net.Addr) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if i, ok := l.indexes[backend.String()]; ok {
+		return l.conns[i]
+	}
+	return 0
+}
+
+func (l *LeastConnections) pick(_ net.Addr, available func(net.Addr) bool) net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	best := -1
+	for n := range l.backends {
+		i := (l.next + n) % len(l.backends)
+		if available != nil && !available(l.backends[i]) {
+			continue
+		}
+
+		// conns[i]/weights[i] < conns[best]/weights[best]
+		if best < 0 || l.conns[i]*l.weights[best] < l.conns[best]*l.weights[i] {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return nil
+	}
+
+	l.next = best + 1
+	return l.backends[best]
+}
+
+// inherit takes over the active connections of the backends shared with the given loadbalancer.
+func (l *LeastConnections) inherit(prev *LeastConnections) {
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+
+	for address, i := range l.indexes {
+		if j, ok := prev.indexes[address]; ok {
+			l.conns[i] = prev.conns[j]
+		}
+	}
+}
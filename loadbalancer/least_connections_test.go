@@ -0,0 +1,101 @@
+package loadbalancer_test
+
+import (
+	"testing"
+
+	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeastConnectionsAsLoadbalancer(t *testing.T) {
+	var lb loadbalancer.Loadbalancer
+	var err error
+
+	lb, err = loadbalancer.New(loadbalancer.StrategyLeastConnections, "udp", "localhost:5050", []loadbalancer.Backend{
+		{Address: "localhost:5000"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:5050", lb.Frontend().String())
+	assert.Len(t, lb.Backends(), 1)
+	assert.Equal(t, "127.0.0.1:5000", lb.Backend(nil).String())
+	assert.Implements(t, (*loadbalancer.ConnectionTracker)(nil), lb)
+}
+
+func TestLeastConnections_Backend(t *testing.T) {
+	lb := newLeastConnections(t,
+		loadbalancer.Backend{Address: "127.0.0.1:5000"},
+		loadbalancer.Backend{Address: "127.0.0.1:5001"},
+		loadbalancer.Backend{Address: "127.0.0.1:5002"},
+	)
+	backends := lb.Backends()
+
+	// Without connections, the backends are used one at a time.
+	for i := 0; i < 3*len(backends); i++ {
+		assert.Equal(t, backends[i%len(backends)], lb.Backend(nil))
+	}
+
+	lb.Connected(backends[0])
+	lb.Connected(backends[0])
+	lb.Connected(backends[1])
+	assert.Equal(t, backends[2], lb.Backend(nil))
+	lb.Connected(backends[2])
+	assert.Equal(t, backends[1], lb.Backend(nil), "tie between 5001 and 5002, 5001 comes next")
+	lb.Connected(backends[1])
+	assert.Equal(t, backends[2], lb.Backend(nil))
+	lb.Connected(backends[2])
+	assert.Equal(t, 2, lb.Connections(backends[0]))
+
+	lb.Disconnected(backends[0])
+	lb.Disconnected(backends[0])
+	assert.Equal(t, backends[0], lb.Backend(nil))
+	assert.Equal(t, backends[0], lb.Backend(nil), "still the least loaded")
+
+	lb.Disconnected(backends[0]) // Spurious reports are ignored.
+	assert.Equal(t, 0, lb.Connections(backends[0]))
+}
+
+func TestLeastConnections_Weighted(t *testing.T) {
+	lb := newLeastConnections(t,
+		loadbalancer.Backend{Address: "127.0.0.1:5000", Weight: 3},
+		loadbalancer.Backend{Address: "127.0.0.1:5001"},
+	)
+	backends := lb.Backends()
+
+	// Connections are distributed 3 to 1.
+	for i := 0; i < 40; i++ {
+		lb.Connected(lb.Backend(nil))
+	}
+
+	assert.Equal(t, 30, lb.Connections(backends[0]))
+	assert.Equal(t, 10, lb.Connections(backends[1]))
+}
+
+func TestLeastConnections_HealthChecker(t *testing.T) {
+	lb := newLeastConnections(t,
+		loadbalancer.Backend{Address: "127.0.0.1:5000"},
+		loadbalancer.Backend{Address: "127.0.0.1:5001"},
+	)
+	backends := lb.Backends()
+
+	h, err := loadbalancer.NewHealthChecker(lb, "tcp", loadbalancer.HealthCheck{})
+	require.NoError(t, err)
+	e := loadbalancer.NewEjector(h, 1, 0)
+
+	assert.True(t, e.DialFailed(backends[0]))
+	for i := 0; i < 10; i++ {
+		backend := e.Backend(nil)
+		assert.Equal(t, backends[1], backend, "the least loaded backend is ejected")
+		e.Connected(backend) // Forwarded to the loadbalancer.
+	}
+
+	assert.Equal(t, 10, lb.Connections(backends[1]))
+}
+
+func newLeastConnections(t *testing.T, backends ...loadbalancer.Backend) *loadbalancer.LeastConnections {
+	t.Helper()
+
+	lb, err := loadbalancer.New(loadbalancer.StrategyLeastConnections, "tcp", "127.0.0.1:5050", backends)
+	require.NoError(t, err)
+	return lb.(*loadbalancer.LeastConnections)
+}
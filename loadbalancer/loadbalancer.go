@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"strconv"
+	"strings"
 )
 
 // Supported protocols.
@@ -12,16 +14,69 @@ const (
 	ProtocolUDP = "udp"
 )
 
+// Supported strategies.
+const (
+	StrategyRoundRobin         = "round_robin"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	StrategyLeastConnections   = "least_connections"
+	StrategySourceHash         = "source_hash"
+)
+
 // A Loadbalancer holds the primitives used to loadbalance the backends of a proxy frontend.
 type Loadbalancer interface {
 	// Frontend returns the listening address of the proxy.
 	Frontend() net.Addr
-	// Backend returns the next backend's endpoint on which the data is forwarded to.
-	Backend() net.Addr
+	// Backend returns the next backend's endpoint on which the data of the given client is forwarded to.
+	// The client is nil when unknown.
+	Backend(client net.Addr) net.Addr
 	// Backends returns all backend's endpoints on which the data can be forwarded to.
 	Backends() []net.Addr
 }
 
+// A ConnectionTracker is a Loadbalancer notified of the connections relayed to its backends.
+type ConnectionTracker interface {
+	// Connected reports a new connection to the given backend.
+	Connected(backend net.Addr)
+	// Disconnected reports the end of a connection to the given backend.
+	Disconnected(backend net.Addr)
+}
+
+// A Backend is an upstream address with its weight, written as `host:port;weight=3'.
+type Backend struct {
+	Address string
+	Weight  int // Relative share of the connections, 1 when zero.
+}
+
+// picker is implemented by the loadbalancers able to skip some backends.
+type picker interface {
+	// pick returns the next backend of the client satisfying the predicate (any backend when nil), nil when there is none.
+	pick(client net.Addr, available func(net.Addr) bool) net.Addr
+}
+
+// New returns a loadbalancer using the given strategy (round robin when empty).
+func New(strategy, protocol, frontend string, backends []Backend) (Loadbalancer, error) {
+	var lb Loadbalancer
+	var err error
+
+	switch strategy {
+	case "", StrategyRoundRobin:
+		lb, err = newRoundRobin(protocol, frontend, addresses(backends))
+	case StrategyWeightedRoundRobin:
+		lb, err = newWeightedRoundRobin(protocol, frontend, backends)
+	case StrategyLeastConnections:
+		lb, err = newLeastConnections(protocol, frontend, backends)
+	case StrategySourceHash:
+		lb, err = newSourceHash(protocol, frontend, backends)
+	default:
+		return nil, fmt.Errorf("unsupported strategy: %s", strategy)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return lb, nil
+}
+
 // ParseDSN returns the loadbalancer parameters extracted from the given DSN.
 func ParseDSN(dsn string) (protocol, frontend string, backends []string, err error) {
 	u, err := url.Parse(dsn)
@@ -29,7 +84,43 @@ func ParseDSN(dsn string) (protocol, frontend string, backends []string, err err
 		return "", "", nil, err
 	}
 
-	return u.Scheme, u.Host, u.Query()["backend"], err
+	// Semicolons are not query separators, they introduce the backend attributes.
+	q, err := url.ParseQuery(strings.ReplaceAll(u.RawQuery, ";", "%3B"))
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return u.Scheme, u.Host, q["backend"], nil
+}
+
+// ParseBackend parses a backend written as `host:port' or `host:port;weight=3'.
+func ParseBackend(s string) (Backend, error) {
+	attributes := strings.Split(s, ";")
+	backend := Backend{Address: attributes[0]}
+
+	for _, attribute := range attributes[1:] {
+		k, v, _ := strings.Cut(attribute, "=")
+		switch k {
+		case "weight":
+			weight, err := strconv.Atoi(v)
+			if err != nil || weight <= 0 {
+				return backend, fmt.Errorf("%s: invalid weight: %q", backend.Address, v)
+			}
+			backend.Weight = weight
+		default:
+			return backend, fmt.Errorf("%s: unknown attribute: %q", backend.Address, k)
+		}
+	}
+
+	return backend, nil
+}
+
+// String returns the representation of the backend parsed by ParseBackend.
+func (b Backend) String() string {
+	if b.Weight == 0 {
+		return b.Address
+	}
+	return b.Address + ";weight=" + strconv.Itoa(b.Weight)
 }
 
 // Resolve returns the resolved address of the given parameters.
@@ -43,3 +134,77 @@ func Resolve(protocol, address string) (net.Addr, error) {
 		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
 	}
 }
+
+// resolve resolves the frontend and backends addresses.
+func resolve(protocol, frontend string, backends []string) (net.Addr, []net.Addr, error) {
+	f, err := Resolve(protocol, frontend)
+	if err != nil {
+		return nil, nil, fmt.Errorf("frontend: %w", err)
+	}
+
+	addrs := make([]net.Addr, len(backends))
+	for i, backend := range backends {
+		addrs[i], err = Resolve(protocol, backend)
+		if err != nil {
+			return nil, nil, fmt.Errorf("backend: %w", err)
+		}
+	}
+
+	return f, addrs, nil
+}
+
+func addresses(backends []Backend) []string {
+	addresses := make([]string, len(backends))
+	for i, backend := range backends {
+		addresses[i] = backend.Address
+	}
+	return addresses
+}
+
+func weights(backends []Backend) []int {
+	weights := make([]int, len(backends))
+	for i, backend := range backends {
+		weights[i] = max(backend.Weight, 1)
+	}
+	return weights
+}
+
+// pick returns the next backend of the client satisfying the predicate, nil when there is none.
+func pick(lb Loadbalancer, client net.Addr, available func(net.Addr) bool) net.Addr {
+	if p, ok := lb.(picker); ok {
+		return p.pick(client, available)
+	}
+
+	for range lb.Backends() {
+		backend := lb.Backend(client)
+		if available == nil || available(backend) {
+			return backend
+		}
+	}
+	return nil
+}
+
+// both returns a predicate satisfied when both predicates are satisfied, nil predicates being always satisfied.
+func both(p1, p2 func(net.Addr) bool) func(net.Addr) bool {
+	if p1 == nil {
+		return p2
+	}
+
+	return func(backend net.Addr) bool {
+		return p1(backend) && p2(backend)
+	}
+}
+
+// connected forwards the connection report to the loadbalancer when it tracks the connections.
+func connected(lb Loadbalancer, backend net.Addr) {
+	if t, ok := lb.(ConnectionTracker); ok {
+		t.Connected(backend)
+	}
+}
+
+// disconnected forwards the disconnection report to the loadbalancer when it tracks the connections.
+func disconnected(lb Loadbalancer, backend net.Addr) {
+	if t, ok := lb.(ConnectionTracker); ok {
+		t.Disconnected(backend)
+	}
+}
@@ -1,7 +1,6 @@
 package loadbalancer
 
 import (
-	"fmt"
 	"net"
 	"sync/atomic"
 )
@@ -20,21 +19,28 @@ func NewRoundRobin(dsn string) (*RoundRobin, error) {
 		return nil, err
 	}
 
-	lb := &RoundRobin{
-		index:    -1,
-		backends: make([]net.Addr, len(backends)),
+	addresses := make([]string, len(backends))
+	for i, backend := range backends {
+		b, err := ParseBackend(backend)
+		if err != nil {
+			return nil, err
+		}
+		addresses[i] = b.Address
 	}
 
-	lb.frontend, err = Resolve(protocol, frontend)
-	if err != nil {
-		return nil, fmt.Errorf("frontend: %w", err)
+	return newRoundRobin(protocol, frontend, addresses)
+}
+
+func newRoundRobin(protocol, frontend string, backends []string) (*RoundRobin, error) {
+	var err error
+
+	lb := &RoundRobin{
+		index: -1,
 	}
 
-	for i, backend := range backends {
-		lb.backends[i], err = Resolve(protocol, backend)
-		if err != nil {
-			return nil, fmt.Errorf("backend: %w", err)
-		}
+	lb.frontend, lb.backends, err = resolve(protocol, frontend, backends)
+	if err != nil {
+		return nil, err
 	}
 
 	return lb, nil
@@ -46,9 +52,19 @@ func (l *RoundRobin) Frontend() net.Addr {
 }
 
 // Backend returns the next backend's endpoint on which the data is forwarded to.
-func (l *RoundRobin) Backend() net.Addr {
+func (l *RoundRobin) Backend(_ net.Addr) net.Addr {
 	index := atomic.AddInt32(&l.index, 1)
-	return l.backends[int(index)%len(l.backends)]
+	return l.backends[int(uint32(index))%len(l.backends)]
+}
+
+func (l *RoundRobin) pick(client net.Addr, available func(net.Addr) bool) net.Addr {
+	for range l.backends {
+		backend := l.Backend(client)
+		if available == nil || available(backend) {
+			return backend
+		}
+	}
+	return nil
 }
 
 // Backends returns all backend's endpoints on which the data can be forwarded to.
@@ -19,8 +19,8 @@ func TestRoundRobinAsLoadbalancer(t *testing.T) {
 	for _, backend := range lb.Backends() {
 		assert.Equal(t, "127.0.0.1:5000", backend.String())
 	}
-	assert.Equal(t, "127.0.0.1:5000", lb.Backend().String())
-	assert.Equal(t, "127.0.0.1:5000", lb.Backend().String())
+	assert.Equal(t, "127.0.0.1:5000", lb.Backend(nil).String())
+	assert.Equal(t, "127.0.0.1:5000", lb.Backend(nil).String())
 }
 
 func TestRoundRobin_Backend(t *testing.T) {
@@ -44,6 +44,6 @@ func TestRoundRobin_Backend(t *testing.T) {
 	lb, err := loadbalancer.NewRoundRobin(dsn.String())
 	assert.NoError(t, err)
 	for i := 0; i < 100*n; i++ {
-		assert.Equal(t, q["backend"][i%n], lb.Backend().String())
+		assert.Equal(t, q["backend"][i%n], lb.Backend(nil).String())
 	}
 }
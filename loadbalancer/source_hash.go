@@ -0,0 +1,105 @@
+package loadbalancer
+
+import (
+	"hash/fnv"
+	"math"
+	"net"
+)
+
+// A SourceHash is a loadbalancer which always forwards a client IP to the same backend,
+// using weighted rendezvous hashing: each backend scores every client and the highest score wins.
+// Adding or removing a backend only remaps the clients of this backend.
+// When the chosen backend is unavailable, the client is forwarded to its next highest scoring backend.
+type SourceHash struct {
+	frontend net.Addr
+	backends []net.Addr
+	weights  []int
+	seeds    []uint64 // Hash of each backend address
+}
+
+func newSourceHash(protocol, frontend string, backends []Backend) (*SourceHash, error) {
+	var err error
+
+	lb := &SourceHash{
+		weights: weights(backends),
+		seeds:   make([]uint64, len(backends)),
+	}
+
+	lb.frontend, lb.backends, err = resolve(protocol, frontend, addresses(backends))
+	if err != nil {
+		return nil, err
+	}
+
+	// The configured addresses are hashed, not the resolved ones, so the mapping survives IP changes.
+	for i, backend := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(backend.Address)) //nolint:errcheck
+		lb.seeds[i] = h.Sum64()
+	}
+
+	return lb, nil
+}
+
+// Frontend returns the listening address of the proxy.
+func (l *SourceHash) Frontend() net.Addr {
+	return l.frontend
+}
+
+// Backend returns the backend's endpoint of the given client.
+func (l *SourceHash) Backend(client net.Addr) net.Addr {
+	return l.pick(client, nil)
+}
+
+// Backends returns all backend's endpoints on which the data can be forwarded to.
+func (l *SourceHash) Backends() []net.Addr {
+	return l.backends
+}
+
+func (l *SourceHash) pick(client net.Addr, available func(net.Addr) bool) net.Addr {
+	key := clientHash(client)
+
+	best := -1
+	var score float64
+	for i, backend := range l.backends {
+		if available != nil && !available(backend) {
+			continue
+		}
+
+		// Weighted rendezvous hashing: -w/ln(u) with u uniformly distributed in ]0, 1[.
+		u := (float64(mix(key^l.seeds[i])>>11) + 0.5) / (1 << 53)
+		s := -float64(l.weights[i]) / math.Log(u)
+		if best < 0 || s > score {
+			best, score = i, s
+		}
+	}
+
+	if best < 0 {
+		return nil
+	}
+	return l.backends[best]
+}
+
+// clientHash returns the hash of the client IP, the port is ignored.
+func clientHash(client net.Addr) uint64 {
+	var ip net.IP
+	switch addr := client.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+
+	h := fnv.New64a()
+	h.Write(ip.To16()) //nolint:errcheck
+	return h.Sum64()
+}
+
+// mix is the finalizer of SplitMix64, it spreads the bits of similar hashes.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,114 @@
+package loadbalancer_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceHashAsLoadbalancer(t *testing.T) {
+	var lb loadbalancer.Loadbalancer
+	var err error
+
+	lb, err = loadbalancer.New(loadbalancer.StrategySourceHash, "udp", "localhost:5050", []loadbalancer.Backend{
+		{Address: "localhost:5000"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:5050", lb.Frontend().String())
+	assert.Len(t, lb.Backends(), 1)
+	assert.Equal(t, "127.0.0.1:5000", lb.Backend(nil).String())
+	assert.Equal(t, "127.0.0.1:5000", lb.Backend(client(1)).String())
+}
+
+func TestSourceHash_Backend(t *testing.T) {
+	lb := newSourceHash(t, "127.0.0.1:5000", "127.0.0.1:5001", "127.0.0.1:5002")
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		backend := lb.Backend(client(i))
+		counts[backend.String()]++
+
+		// The port and the protocol are ignored.
+		c := client(i).(*net.TCPAddr)
+		assert.Equal(t, backend, lb.Backend(&net.TCPAddr{IP: c.IP, Port: c.Port + 1}))
+		assert.Equal(t, backend, lb.Backend(&net.UDPAddr{IP: c.IP, Port: 27015}))
+	}
+
+	for backend, n := range counts {
+		assert.InDelta(t, 1000, n, 150, backend)
+	}
+}
+
+func TestSourceHash_Remapping(t *testing.T) {
+	lb3 := newSourceHash(t, "127.0.0.1:5000", "127.0.0.1:5001", "127.0.0.1:5002")
+	lb4 := newSourceHash(t, "127.0.0.1:5000", "127.0.0.1:5001", "127.0.0.1:5002", "127.0.0.1:5003")
+
+	moved := 0
+	for i := 0; i < 4000; i++ {
+		before, after := lb3.Backend(client(i)).String(), lb4.Backend(client(i)).String()
+		if before != after {
+			moved++
+			assert.Equal(t, "127.0.0.1:5003", after, "only moved to the added backend")
+		}
+	}
+
+	assert.InDelta(t, 1000, moved, 150, "a quarter of the clients is remapped")
+}
+
+func TestSourceHash_Weighted(t *testing.T) {
+	lb, err := loadbalancer.New(loadbalancer.StrategySourceHash, "tcp", "127.0.0.1:5050", []loadbalancer.Backend{
+		{Address: "127.0.0.1:5000", Weight: 3},
+		{Address: "127.0.0.1:5001"},
+	})
+	require.NoError(t, err)
+
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		counts[lb.Backend(client(i)).String()]++
+	}
+
+	assert.InDelta(t, 3000, counts["127.0.0.1:5000"], 200)
+	assert.InDelta(t, 1000, counts["127.0.0.1:5001"], 200)
+}
+
+func TestSourceHash_Ejected(t *testing.T) {
+	lb := newSourceHash(t, "127.0.0.1:5000", "127.0.0.1:5001", "127.0.0.1:5002")
+	e := loadbalancer.NewEjector(lb, 1, 0)
+
+	ejected := lb.Backends()[0]
+	e.DialFailed(ejected)
+
+	for i := 0; i < 1000; i++ {
+		before, after := lb.Backend(client(i)), e.Backend(client(i))
+		if before == ejected {
+			assert.NotEqual(t, ejected, after)
+		} else {
+			assert.Equal(t, before, after, "the clients of the other backends are not remapped")
+		}
+	}
+}
+
+func newSourceHash(t *testing.T, backends ...string) loadbalancer.Loadbalancer {
+	t.Helper()
+
+	var upstreams []loadbalancer.Backend
+	for _, backend := range backends {
+		upstreams = append(upstreams, loadbalancer.Backend{Address: backend})
+	}
+
+	lb, err := loadbalancer.New(loadbalancer.StrategySourceHash, "tcp", "127.0.0.1:5050", upstreams)
+	require.NoError(t, err)
+	return lb
+}
+
+// client returns the address of the nth client.
+func client(n int) net.Addr {
+	return &net.TCPAddr{
+		IP:   net.ParseIP(fmt.Sprintf("10.%d.%d.%d", n>>16&0xFF, n>>8&0xFF, n&0xFF)),
+		Port: 40000 + n%1000,
+	}
+}
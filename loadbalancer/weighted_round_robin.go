@@ -0,0 +1,75 @@
+package loadbalancer
+
+import (
+	"net"
+	"sync"
+)
+
+// A WeightedRoundRobin is a loadbalancer which walks through the available backends
+// proportionally to their weight, using the smooth weighted round robin of nginx
+// (e.g. weights 5, 1, 1 give a, a, b, a, c, a, a).
+type WeightedRoundRobin struct {
+	frontend net.Addr
+	backends []net.Addr
+	weights  []int
+
+	mu      sync.Mutex
+	current []int
+}
+
+func newWeightedRoundRobin(protocol, frontend string, backends []Backend) (*WeightedRoundRobin, error) {
+	var err error
+
+	lb := &WeightedRoundRobin{
+		weights: weights(backends),
+		current: make([]int, len(backends)),
+	}
+
+	lb.frontend, lb.backends, err = resolve(protocol, frontend, addresses(backends))
+	if err != nil {
+		return nil, err
+	}
+
+	return lb, nil
+}
+
+// Frontend returns the listening address of the proxy.
+func (l *WeightedRoundRobin) Frontend() net.Addr {
+	return l.frontend
+}
+
+// Backend returns the next backend's endpoint on which the data is forwarded to.
+func (l *WeightedRoundRobin) Backend(client net.Addr) net.Addr {
+	return l.pick(client, nil)
+}
+
+// Backends returns all backend's endpoints on which the data can be forwarded to.
+func (l *WeightedRoundRobin) Backends() []net.Addr {
+	return l.backends
+}
+
+func (l *WeightedRoundRobin) pick(_ net.Addr, available func(net.Addr) bool) net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	total := 0
+	best := -1
+	for i, backend := range l.backends {
+		if available != nil && !available(backend) {
+			continue
+		}
+
+		l.current[i] += l.weights[i]
+		total += l.weights[i]
+		if best < 0 || l.current[i] > l.current[best] {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return nil
+	}
+
+	l.current[best] -= total
+	return l.backends[best]
+}
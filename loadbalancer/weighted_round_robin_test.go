@@ -0,0 +1,66 @@
+package loadbalancer_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeightedRoundRobinAsLoadbalancer(t *testing.T) {
+	var lb loadbalancer.Loadbalancer
+	var err error
+
+	lb, err = loadbalancer.New(loadbalancer.StrategyWeightedRoundRobin, "udp", "localhost:5050", []loadbalancer.Backend{
+		{Address: "localhost:5000"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:5050", lb.Frontend().String())
+	assert.Len(t, lb.Backends(), 1)
+	assert.Equal(t, "127.0.0.1:5000", lb.Backend(nil).String())
+	assert.Equal(t, "127.0.0.1:5000", lb.Backend(nil).String())
+}
+
+func TestWeightedRoundRobin_Backend(t *testing.T) {
+	_, _, backends, err := loadbalancer.ParseDSN("tcp://127.0.0.1:5050?backend=127.0.0.1:5000;weight=5&backend=127.0.0.1:5001&backend=127.0.0.1:5002;weight=1")
+	require.NoError(t, err)
+
+	var upstreams []loadbalancer.Backend
+	for _, backend := range backends {
+		upstream, err := loadbalancer.ParseBackend(backend)
+		require.NoError(t, err)
+		upstreams = append(upstreams, upstream)
+	}
+
+	lb, err := loadbalancer.New(loadbalancer.StrategyWeightedRoundRobin, "tcp", "127.0.0.1:5050", upstreams)
+	require.NoError(t, err)
+
+	// Smooth weighted round robin spreads the heaviest backend.
+	expected := []string{"0", "0", "1", "0", "2", "0", "0"}
+	for i := 0; i < 100; i++ {
+		for _, e := range expected {
+			assert.Equal(t, "127.0.0.1:500"+e, lb.Backend(nil).String())
+		}
+	}
+}
+
+func TestParseBackend(t *testing.T) {
+	backend, err := loadbalancer.ParseBackend("localhost:5000")
+	assert.NoError(t, err)
+	assert.Equal(t, loadbalancer.Backend{Address: "localhost:5000"}, backend)
+	assert.Equal(t, "localhost:5000", backend.String())
+
+	backend, err = loadbalancer.ParseBackend("localhost:5000;weight=3")
+	assert.NoError(t, err)
+	assert.Equal(t, loadbalancer.Backend{Address: "localhost:5000", Weight: 3}, backend)
+	assert.Equal(t, "localhost:5000;weight=3", backend.String())
+
+	for _, s := range []string{"localhost:5000;weight=0", "localhost:5000;weight=heavy", "localhost:5000;backup"} {
+		_, err = loadbalancer.ParseBackend(s)
+		if assert.Error(t, err, s) {
+			assert.True(t, strings.HasPrefix(err.Error(), "localhost:5000: "))
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mdouchement/logger"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Supported log formats.
+const (
+	LogFormatText   = "text"
+	LogFormatJSON   = "json"
+	LogFormatLogfmt = "logfmt"
+)
+
+// Supported log outputs, any other value is the path of a file.
+const (
+	LogOutputStdout = "stdout"
+	LogOutputStderr = "stderr"
+	LogOutputSyslog = "syslog"
+)
+
+// KeyPrefix is the field holding the logger prefix (e.g. udp://0.0.0.0:27015) with the json and logfmt formats.
+const KeyPrefix = "prefix"
+
+// newFormatter returns the logrus formatter of the given log format (text when empty).
+func newFormatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case "", LogFormatText:
+		return &logger.LogrusTextFormatter{
+			DisableColors:   false,
+			ForceColors:     false, // Colored only when writing to a terminal.
+			ForceFormatting: true,
+			PrefixRE:        regexp.MustCompile(`^(\[.*?\])\s`),
+			FullTimestamp:   true,
+			TimestampFormat: "2006-01-02 15:04:05",
+		}, nil
+	case LogFormatJSON:
+		return &prefixFormatter{
+			Formatter: &logrus.JSONFormatter{
+				TimestampFormat: time.RFC3339Nano,
+			},
+		}, nil
+	case LogFormatLogfmt:
+		return &prefixFormatter{
+			Formatter: &logrus.TextFormatter{
+				DisableColors:   true,
+				FullTimestamp:   true,
+				TimestampFormat: time.RFC3339Nano,
+			},
+		}, nil
+	default:
+		return nil, errors.Errorf("unsupported format: %s", format)
+	}
+}
+
+// setupLogger applies the log format and output to the given logger.
+// The returned closer releases the output once the logger is no longer used.
+func setupLogger(logr *logrus.Logger, format, output string) (io.Closer, error) {
+	formatter, err := newFormatter(format)
+	if err != nil {
+		return nil, err
+	}
+
+	// The standard outputs are not wrapped, so the formatter can detect a terminal.
+	var w io.Writer
+	var closer io.Closer
+	switch output {
+	case LogOutputStdout:
+		w = os.Stdout
+		closer = nopCloser{w}
+	case "", LogOutputStderr:
+		w = os.Stderr
+		closer = nopCloser{w}
+	case LogOutputSyslog:
+		hook, err := newSyslogHook()
+		if err != nil {
+			return nil, errors.Wrap(err, "syslog")
+		}
+		logr.AddHook(hook)
+		w = io.Discard
+		closer = nopCloser{w}
+	default:
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = f, f
+	}
+
+	logr.SetFormatter(formatter)
+	logr.SetOutput(w)
+	return closer, nil
+}
+
+// A prefixFormatter emits the logger prefix as a field instead of the internal one of the logger package.
+type prefixFormatter struct {
+	logrus.Formatter
+}
+
+// Format implements logrus.Formatter.
+func (f *prefixFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if prefix, ok := entry.Data[logger.KeyPrefix]; ok {
+		delete(entry.Data, logger.KeyPrefix)
+		if p, ok := prefix.(string); ok {
+			entry.Data[KeyPrefix] = strings.Trim(p, "[]")
+		}
+	}
+	return f.Formatter.Format(entry)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdouchement/logger"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFormatter(t *testing.T) {
+	for _, format := range []string{"", LogFormatText, LogFormatJSON, LogFormatLogfmt} {
+		_, err := newFormatter(format)
+		assert.NoError(t, err, format)
+	}
+
+	_, err := newFormatter("xml")
+	assert.Error(t, err)
+}
+
+func TestNewFormatter_Prefix(t *testing.T) {
+	var b bytes.Buffer
+	logr := logrus.New()
+	logr.SetOutput(&b)
+
+	formatter, err := newFormatter(LogFormatJSON)
+	require.NoError(t, err)
+	logr.SetFormatter(formatter)
+
+	logger.WrapLogrus(logr).WithPrefixf("[%s://%s]", "udp", "0.0.0.0:27015").WithField("backend", "10.0.0.1:27015").Info("Backend is up")
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(b.Bytes(), &line))
+	assert.Equal(t, "udp://0.0.0.0:27015", line[KeyPrefix])
+	assert.Equal(t, "10.0.0.1:27015", line["backend"])
+	assert.Equal(t, "Backend is up", line["msg"])
+	assert.NotContains(t, line, logger.KeyPrefix)
+
+	b.Reset()
+	formatter, err = newFormatter(LogFormatLogfmt)
+	require.NoError(t, err)
+	logr.SetFormatter(formatter)
+
+	logger.WrapLogrus(logr).WithPrefixf("[%s://%s]", "tcp", "0.0.0.0:22").Info("Listening")
+	assert.Contains(t, b.String(), `prefix="tcp://0.0.0.0:22"`)
+	assert.NotContains(t, b.String(), "\x1b[")
+}
+
+func TestSetupLogger_Output(t *testing.T) {
+	for output, expected := range map[string]io.Writer{
+		"":              os.Stderr, // Like logrus.New()
+		LogOutputStderr: os.Stderr,
+		LogOutputStdout: os.Stdout,
+	} {
+		logr := logrus.New()
+		closer, err := setupLogger(logr, "", output)
+		require.NoError(t, err, output)
+		assert.Same(t, expected, logr.Out, "%s: the file is kept for the terminal detection", output)
+		assert.NoError(t, closer.Close())
+	}
+
+	filename := filepath.Join(t.TempDir(), "geoblock-proxy.log")
+	logr := logrus.New()
+	closer, err := setupLogger(logr, LogFormatLogfmt, filename)
+	require.NoError(t, err)
+	logr.Info("hello")
+	require.NoError(t, closer.Close())
+
+	payload, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Contains(t, string(payload), "msg=hello")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mdouchement/geoblock-proxy/banlist"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+type (
+	explanation struct {
+		IP        string       `json:"ip"`
+		Policy    string       `json:"policy"`
+		Databases []dbAnswer   `json:"databases"`
+		Country   string       `json:"country"`
+		ASN       string       `json:"asn"`
+		Decision  string       `json:"decision"` // e.g. blocked_cidr, allowed_country, default_action
+		Rule      *ruleSummary `json:"rule"`     // Null when the default action applied
+		Verdict   string       `json:"verdict"`  // allowed or blocked
+		Error     string       `json:"error,omitempty"`
+	}
+
+	dbAnswer struct {
+		Database string `json:"database"`
+		Country  string `json:"country,omitempty"`
+		ASN      string `json:"asn,omitempty"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	ruleSummary struct {
+		Type  RuleType `json:"type"`
+		Value string   `json:"value"`
+	}
+)
+
+func newLookupCommand(c *controller) *cobra.Command {
+	var policy string
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:           "lookup IP [IP...]",
+		Short:         "Explains the decision taken for the given IPs",
+		Args:          cobra.MinimumNArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, evaluators, err := c.load()
+			if err != nil {
+				return err
+			}
+			for _, evaluator := range evaluators {
+				defer evaluator.Close() //nolint:errcheck
+			}
+
+			bans, err := banlist.Open(config.BanFile)
+			if err != nil {
+				return errors.Wrap(err, "could not open ban file")
+			}
+
+			evaluator, ok := evaluators[policy]
+			if !ok {
+				return errors.Errorf("unknown policy %s", policy)
+			}
+			evaluator.SetBans(bans)
+
+			var failures int
+			explanations := make([]explanation, len(args))
+			for i, ip := range args {
+				explanations[i] = explain(evaluator, ip)
+				if explanations[i].Error != "" {
+					failures++
+				}
+			}
+
+			if asJSON {
+				encoder := json.NewEncoder(cmd.OutOrStdout())
+				encoder.SetIndent("", "  ")
+				err = encoder.Encode(explanations)
+			} else {
+				printExplanations(cmd.OutOrStdout(), explanations)
+			}
+
+			if err == nil && failures > 0 {
+				err = errors.Errorf("could not evaluate %d IP(s)", failures)
+			}
+			return err
+		},
+	}
+	cmd.Flags().StringVarP(&policy, "policy", "p", DefaultPolicy, "Policy used to evaluate the IPs")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Output as JSON")
+
+	return cmd
+}
+
+func explain(e *Evaluator, ip string) explanation {
+	v, err := e.Explain(ip)
+
+	x := explanation{
+		IP:        ip,
+		Policy:    e.Name(),
+		Databases: make([]dbAnswer, len(v.Answers)),
+		Country:   strings.ToUpper(v.Country),
+		ASN:       FormatASN(v.ASN),
+		Decision:  "default_action",
+		Verdict:   "blocked",
+	}
+
+	for i, a := range v.Answers {
+		x.Databases[i] = dbAnswer{
+			Database: a.Database,
+			Country:  strings.ToUpper(a.Country),
+			ASN:      FormatASN(a.ASN),
+		}
+		if a.Err != nil {
+			x.Databases[i].Error = a.Err.Error()
+		}
+	}
+
+	if err != nil {
+		x.Decision = "error"
+		x.Error = err.Error()
+		return x
+	}
+
+	if v.Allowed {
+		x.Verdict = "allowed"
+	}
+
+	if v.Rule != nil {
+		x.Decision = x.Verdict + "_" + string(v.Rule.Type)
+		x.Rule = &ruleSummary{Type: v.Rule.Type, Value: v.Rule.Value}
+	}
+
+	return x
+}
+
+func printExplanations(w io.Writer, explanations []explanation) {
+	for _, x := range explanations {
+		fmt.Fprintf(w, "%s (policy %s)\n", x.IP, x.Policy)
+
+		for _, db := range x.Databases {
+			answer := strings.TrimSpace(db.Country + " " + db.ASN)
+			if db.Error != "" {
+				answer = "error: " + db.Error
+			}
+			fmt.Fprintf(w, "  %s: %s\n", db.Database, answer)
+		}
+
+		if x.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n\n", x.Error)
+			continue
+		}
+
+		if x.Country != "" {
+			fmt.Fprintf(w, "  country: %s\n", x.Country)
+		}
+		if x.ASN != "" {
+			fmt.Fprintf(w, "  asn: %s\n", x.ASN)
+		}
+
+		if x.Rule != nil {
+			fmt.Fprintf(w, "  decision: %s (%s %s)\n", x.Decision, x.Rule.Type, x.Rule.Value)
+		} else {
+			fmt.Fprintf(w, "  decision: %s\n", x.Decision)
+		}
+		fmt.Fprintf(w, "  verdict: %s\n\n", x.Verdict)
+	}
+}
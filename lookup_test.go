@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	e, err := NewEvaluator("ssh", Policy{
+		DefaultAction: DefaultActionBlock,
+		Allowlist:     []Rule{{Type: RuleTypeCountry, Value: "FR"}},
+	}, "")
+	require.NoError(t, err)
+	e.AddLookup("country.mmdb", &fakeLookup{country: "fr"}, false)
+
+	x := explain(e, "192.0.2.1")
+	assert.Equal(t, explanation{
+		IP:        "192.0.2.1",
+		Policy:    "ssh",
+		Databases: []dbAnswer{{Database: "country.mmdb", Country: "FR"}},
+		Country:   "FR",
+		Decision:  "allowed_country",
+		Rule:      &ruleSummary{Type: RuleTypeCountry, Value: "FR"},
+		Verdict:   "allowed",
+	}, x)
+
+	var w bytes.Buffer
+	require.NoError(t, json.NewEncoder(&w).Encode(x))
+	assert.JSONEq(t, `{
+		"ip": "192.0.2.1",
+		"policy": "ssh",
+		"databases": [{"database": "country.mmdb", "country": "FR"}],
+		"country": "FR",
+		"asn": "",
+		"decision": "allowed_country",
+		"rule": {"type": "country", "value": "FR"},
+		"verdict": "allowed"
+	}`, w.String())
+
+	x = explain(e, "not-an-ip")
+	assert.Equal(t, "error", x.Decision)
+	assert.NotEmpty(t, x.Error)
+
+	e, err = NewEvaluator("ssh", Policy{DefaultAction: DefaultActionBlock}, "")
+	require.NoError(t, err)
+	e.AddLookup("unknown.mmdb", &fakeLookup{country: "-"}, false)
+	e.AddLookup("country.mmdb", &fakeLookup{country: "us"}, false)
+
+	x = explain(e, "192.0.2.1")
+	assert.Equal(t, "default_action", x.Decision)
+	assert.Nil(t, x.Rule)
+	assert.Equal(t, "blocked", x.Verdict)
+
+	w.Reset()
+	printExplanations(&w, []explanation{x})
+	assert.Equal(t, `192.0.2.1 (policy ssh)
+  unknown.mmdb: -
+  country.mmdb: US
+  country: US
+  decision: default_action
+  verdict: blocked
+
+`, w.String())
+}
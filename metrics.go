@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/accesslog"
+	"github.com/mdouchement/geoblock-proxy/proxy"
+	"github.com/mdouchement/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// An observer exports the activity of an endpoint proxy as metrics and access log entries.
+type observer struct {
+	c        *controller
+	endpoint string
+	protocol string
+}
+
+// observer returns the proxy observer of the given endpoint.
+func (c *controller) observer(endpoint Endpoint) *observer {
+	return &observer{
+		c:        c,
+		endpoint: endpoint.Frontend(),
+		protocol: endpoint.Protocol,
+	}
+}
+
+// deleteMetrics removes the series of the given endpoint.
+func (c *controller) deleteMetrics(endpoint string) {
+	labels := prometheus.Labels{"endpoint": endpoint}
+
+	c.backendUp.DeletePartialMatch(labels)
+	c.connections.DeletePartialMatch(labels)
+	c.connectionDuration.DeletePartialMatch(labels)
+	c.traffic.DeletePartialMatch(labels)
+	c.dialDuration.DeletePartialMatch(labels)
+	c.dialFailures.DeletePartialMatch(labels)
+	c.lookupDuration.DeletePartialMatch(labels)
+	c.lookupErrors.DeletePartialMatch(labels)
+}
+
+// Dialed reports a connection attempt to the given backend.
+func (o *observer) Dialed(backend net.Addr, duration time.Duration, err error) {
+	if err != nil {
+		o.c.dialFailures.WithLabelValues(o.endpoint, o.protocol, backend.String()).Inc()
+		return
+	}
+	o.c.dialDuration.WithLabelValues(o.endpoint, o.protocol, backend.String()).Observe(duration.Seconds())
+}
+
+// Opened reports a new connection to the given backend.
+func (o *observer) Opened(backend net.Addr) {
+	o.c.connections.WithLabelValues(o.endpoint, o.protocol, backend.String()).Inc()
+}
+
+// Closed reports the end of a connection to the given backend.
+func (o *observer) Closed(backend net.Addr, duration time.Duration) {
+	o.c.connections.WithLabelValues(o.endpoint, o.protocol, backend.String()).Dec()
+	o.c.connectionDuration.WithLabelValues(o.endpoint, o.protocol, backend.String()).Observe(duration.Seconds())
+}
+
+// Transferred reports the bytes exchanged with the clients of the given backend.
+func (o *observer) Transferred(backend net.Addr, in, out int64) {
+	if in > 0 {
+		o.c.traffic.WithLabelValues(o.endpoint, o.protocol, backend.String(), "in").Add(float64(in))
+	}
+	if out > 0 {
+		o.c.traffic.WithLabelValues(o.endpoint, o.protocol, backend.String(), "out").Add(float64(out))
+	}
+}
+
+// Ended writes the access log entry of the connection.
+func (o *observer) Ended(record proxy.Record) {
+	if o.c.accessLog == nil {
+		return
+	}
+
+	e := accesslog.Entry{
+		Time:     record.Start,
+		Endpoint: o.endpoint,
+		Client:   record.Client.String(),
+		Country:  record.Decision.Country,
+		Decision: accesslog.DecisionBlock,
+		Rule:     record.Decision.Rule,
+		BytesIn:  record.In,
+		BytesOut: record.Out,
+		Duration: record.Duration,
+	}
+	if record.Decision.Allowed {
+		e.Decision = accesslog.DecisionAllow
+	}
+	if record.Backend != nil {
+		e.Backend = record.Backend.String()
+	}
+	if record.Err != nil {
+		e.Error = record.Err.Error()
+	}
+
+	if err := o.c.accessLog.Log(e); err != nil {
+		logger.LogWith(o.c.ctx).WithError(err).Warn("Could not write access log")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/mdouchement/logger"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestController_MetricsOnReload(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	a := freeAddr(t)
+	c := testController(t, configuration(backend, a))
+	name := "tcp://" + a
+
+	connections := func() float64 {
+		return testutil.ToFloat64(c.connections.WithLabelValues(name, "tcp", backend.Addr().String()))
+	}
+
+	drained := func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		return len(c.retired) == 0
+	}
+
+	conn, err := net.Dial("tcp", a)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), connections())
+
+	// The endpoint is replaced with other options, its series are kept while the relay drains.
+	writeConfiguration(t, c.cfg, configuration(backend)+"- tcp://"+a+"?backend="+backend.Addr().String()+"&policy=default\n")
+	require.NoError(t, c.reload())
+	assert.Equal(t, float64(1), connections())
+
+	conn.Close()
+	assert.Eventually(t, drained, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(0), connections(), "the gauge does not go negative")
+
+	// The series are removed once the endpoint is gone.
+	writeConfiguration(t, c.cfg, configuration(backend))
+	require.NoError(t, c.reload())
+	assert.Eventually(t, drained, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, testutil.CollectAndCount(c.connections))
+	assert.Zero(t, testutil.CollectAndCount(c.traffic))
+}
+
+func TestController_WatchHealthDiscovery(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Addr().String())
+
+	logr := logrus.New()
+	logr.SetOutput(io.Discard)
+	c := newController()
+	c.ctx = logger.WithLogger(context.Background(), logger.WrapLogrus(logr))
+
+	r := &resolver{ips: []string{"127.0.0.1"}}
+	d, err := loadbalancer.NewDiscovery("", "tcp", "127.0.0.1:0", []loadbalancer.Backend{{Address: "backend:" + port}}, r, 0)
+	require.NoError(t, err)
+	h, err := loadbalancer.NewHealthChecker(d, "tcp", loadbalancer.HealthCheck{Timeout: time.Second})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.watchHealth(ctx, "tcp://127.0.0.1:0", h)
+
+	up := func(ip string) float64 {
+		return testutil.ToFloat64(c.backendUp.WithLabelValues("tcp://127.0.0.1:0", ip+":"+port))
+	}
+	assert.Equal(t, float64(1), up("127.0.0.1"))
+
+	// The series follow the resolved backends.
+	r.set("127.0.0.2")
+	require.NoError(t, d.Refresh(context.Background()))
+	h.Check(context.Background())
+	assert.Eventually(t, func() bool {
+		return testutil.CollectAndCount(c.backendUp) == 1 && up("127.0.0.2") == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// A resolver resolves any host to its IPs.
+type resolver struct {
+	mu  sync.Mutex
+	ips []string
+}
+
+func (r *resolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	addrs := make([]net.IPAddr, len(r.ips))
+	for i, ip := range r.ips {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addrs, nil
+}
+
+func (r *resolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *resolver) set(ips ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ips = ips
+}
@@ -0,0 +1,142 @@
+package netset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/iptrie"
+)
+
+type (
+	// A File is a set of CIDR blocks read from a FireHOL-style netset file.
+	// The file contains one CIDR or IP per line, `#' starts a comment.
+	File struct {
+		path    string
+		mu      sync.Mutex
+		modtime time.Time
+		set     atomic.Pointer[set]
+	}
+
+	// Stats holds the result of the last load of a File.
+	Stats struct {
+		Entries int
+		Errors  []error // Lines that could not be parsed.
+	}
+
+	set struct {
+		trie  *iptrie.Trie
+		stats Stats
+	}
+)
+
+// Open reads the given netset file.
+func Open(path string) (*File, error) {
+	f := &File{path: path}
+
+	if _, err := f.Refresh(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Path returns the path of the file.
+func (f *File) Path() string {
+	return f.path
+}
+
+// Contains reports whether one of the file's blocks contains the given IP.
+func (f *File) Contains(ip net.IP) bool {
+	return f.set.Load().trie.Contains(ip)
+}
+
+// Stats returns the result of the last successful load.
+func (f *File) Stats() Stats {
+	return f.set.Load().stats
+}
+
+// Refresh re-reads the file when its modification time has changed.
+// It returns true when the file has been re-read.
+// On error, the previous blocks are kept.
+func (f *File) Refresh() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	if f.set.Load() != nil && fi.ModTime().Equal(f.modtime) {
+		return false, nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	s, err := parse(file)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	f.modtime = fi.ModTime()
+	f.set.Store(s)
+	return true, nil
+}
+
+func parse(r io.Reader) (*set, error) {
+	s := &set{
+		trie: iptrie.New(),
+	}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		block, err := ParseBlock(line)
+		if err != nil {
+			s.stats.Errors = append(s.stats.Errors, fmt.Errorf("line %d: %w", n, err))
+			continue
+		}
+
+		s.trie.Insert(block)
+		s.stats.Entries++
+	}
+
+	return s, scanner.Err()
+}
+
+// ParseBlock parses a CIDR or a single IP address (as a /32 or /128 block).
+func ParseBlock(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, block, err := net.ParseCIDR(s)
+		return block, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", s)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
@@ -0,0 +1,78 @@
+package netset_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/netset"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firehol_level1.netset")
+	write(t, path, `#
+# firehol_level1
+#
+192.0.2.0/24
+198.51.100.42 # single IP
+2001:db8::/32
+
+not-an-ip
+10.0.0.0/33
+`)
+
+	f, err := netset.Open(path)
+	require.NoError(t, err)
+	assert.Equal(t, path, f.Path())
+
+	stats := f.Stats()
+	assert.Equal(t, 3, stats.Entries)
+	require.Len(t, stats.Errors, 2)
+	assert.Contains(t, stats.Errors[0].Error(), "line 8")
+	assert.Contains(t, stats.Errors[1].Error(), "line 9")
+
+	assert.True(t, f.Contains(net.ParseIP("192.0.2.1")))
+	assert.True(t, f.Contains(net.ParseIP("198.51.100.42")))
+	assert.False(t, f.Contains(net.ParseIP("198.51.100.43")))
+	assert.True(t, f.Contains(net.ParseIP("2001:db8::1")))
+
+	//
+
+	refreshed, err := f.Refresh()
+	assert.NoError(t, err)
+	assert.False(t, refreshed, "file has not changed")
+
+	write(t, path, "203.0.113.0/24\n")
+	mtime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, mtime, mtime))
+
+	refreshed, err = f.Refresh()
+	assert.NoError(t, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, 1, f.Stats().Entries)
+	assert.Empty(t, f.Stats().Errors)
+	assert.False(t, f.Contains(net.ParseIP("192.0.2.1")))
+	assert.True(t, f.Contains(net.ParseIP("203.0.113.1")))
+
+	//
+
+	require.NoError(t, os.Remove(path))
+
+	_, err = f.Refresh()
+	assert.Error(t, err)
+	assert.True(t, f.Contains(net.ParseIP("203.0.113.1")), "previous blocks must be kept")
+}
+
+func TestOpen(t *testing.T) {
+	_, err := netset.Open(filepath.Join(t.TempDir(), "missing.netset"))
+	assert.Error(t, err)
+}
+
+func write(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
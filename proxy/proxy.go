@@ -2,7 +2,11 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // Imported/Inspired from https://github.com/moby/libnetwork/blob/28576a4038783dfd6f300f83e3076740179ef035/cmd/proxy/udp_proxy.go
@@ -21,13 +25,118 @@ const (
 type Addresser interface {
 	// Frontend returns the listening address of the proxy.
 	Frontend() net.Addr
-	// Backend returns the upstream connection protected by the proxy
-	Backend() net.Addr
+	// Backend returns the upstream connection protected by the proxy for the given client (nil when unknown).
+	Backend(client net.Addr) net.Addr
+}
+
+// A BackendPicker is an Addresser able to skip some backends (e.g. the ones already tried for a client).
+type BackendPicker interface {
+	// PickBackend returns the backend of the client satisfying the predicate, nil when there is none.
+	PickBackend(client net.Addr, available func(net.Addr) bool) net.Addr
+}
+
+// A DialReporter is an Addresser notified of the connection results to the backends (e.g. to eject the failing ones).
+type DialReporter interface {
+	// DialSucceeded reports a successful connection to the given backend.
+	DialSucceeded(backend net.Addr)
+	// DialFailed reports a failed connection to the given backend and returns true when the backend has been ejected.
+	DialFailed(backend net.Addr) bool
+}
+
+// A ConnectionReporter is an Addresser notified of the connections relayed to the backends (e.g. to balance the load).
+// A connection is a TCP relay or an UDP flow.
+type ConnectionReporter interface {
+	// Connected reports a new connection to the given backend.
+	Connected(backend net.Addr)
+	// Disconnected reports the end of a connection to the given backend.
+	Disconnected(backend net.Addr)
+}
+
+// An Observer is notified of the proxy activity (e.g. to export metrics).
+// A connection is a TCP relay or an UDP flow.
+type Observer interface {
+	// Dialed reports a connection attempt to the given backend with its duration, err is nil when it succeeded.
+	Dialed(backend net.Addr, duration time.Duration, err error)
+	// Opened reports a new connection to the given backend.
+	Opened(backend net.Addr)
+	// Closed reports the end of a connection to the given backend with its duration.
+	Closed(backend net.Addr, duration time.Duration)
+	// Transferred reports the bytes received from the client (in) and sent back to the client (out).
+	// TCP connections are reported as the data is relayed, UDP flows for each datagram.
+	Transferred(backend net.Addr, in, out int64)
+	// Ended reports a connection which has ended or has been rejected (e.g. to write an access log).
+	// Each rejected UDP datagram is reported.
+	Ended(record Record)
+}
+
+// A Record summarizes a connection.
+type Record struct {
+	Start    time.Time
+	Client   net.Addr // Address of the client, the one received from a trusted proxy when any.
+	Frontend net.Addr
+	Decision Decision
+	Backend  net.Addr // nil when the connection has been rejected or no backend has been reached.
+	In       int64    // Bytes received from the client.
+	Out      int64    // Bytes sent to the client.
+	Duration time.Duration
+	Err      error // Error which ended the connection, nil when it has been closed normally.
+}
+
+// ErrKilled is the error of the connections closed by Proxy.Kill.
+var ErrKilled = errors.New("connection killed")
+
+// A Connection describes an active connection (a TCP relay or an UDP flow).
+type Connection struct {
+	ID       uint64 // Unique among all the proxies.
+	Start    time.Time
+	Client   net.Addr // Address of the client, the one received from a trusted proxy when any.
+	Frontend net.Addr
+	Country  string
+	Backend  net.Addr
+	In       int64 // Bytes received from the client so far.
+	Out      int64 // Bytes sent to the client so far.
+}
+
+var lastConnectionID atomic.Uint64
+
+// nextConnectionID returns a new connection ID.
+func nextConnectionID() uint64 {
+	return lastConnectionID.Add(1)
 }
 
 // AcceptableConnection is called when a proxy got a new connection.
-// When the handler returns false, the connection is closed.
-type AcceptableConnection func(ctx context.Context, ip net.IP) bool
+// When the handler does not allow the connection, it is closed.
+type AcceptableConnection func(ctx context.Context, ip net.IP) Decision
+
+// A Decision is the answer of an AcceptableConnection.
+type Decision struct {
+	Allowed bool
+	// Route provides the backends of the connection (e.g. according to the client location),
+	// the proxy ones are used when nil.
+	Route Addresser
+	// Country and Rule describe the evaluation of the client, they are only reported to the Observer.
+	Country string
+	Rule    string
+}
+
+// Options holds the optional settings of a proxy.
+type Options struct {
+	// DialTimeout is the maximum duration to connect a TCP backend (no timeout when zero).
+	DialTimeout time.Duration
+	// DialAttempts is the maximum number of backends tried to connect a TCP client (1 when zero).
+	DialAttempts int
+	// UDPConnTrackTimeout is the duration after which an idle UDP flow is forgotten (UDPConnTrackTimeout when zero).
+	UDPConnTrackTimeout time.Duration
+	// ProxyProtocol is the PROXY protocol version sent to the backends (disabled when zero).
+	// UDP only supports the version 2 which is prepended to each datagram.
+	ProxyProtocol int
+	// TrustedProxies are the networks of the load balancers chained in front of the proxy (TCP only).
+	// Connections from these networks must start with a PROXY protocol header (v1 or v2)
+	// whose client address is used instead of the connection one.
+	TrustedProxies []*net.IPNet
+	// Observer is notified of the proxy activity (none when nil).
+	Observer Observer
+}
 
 // Proxy defines the behavior of a proxy. It forwards traffic back and forth
 // between two endpoints : the frontend and the backend.
@@ -36,26 +145,88 @@ type AcceptableConnection func(ctx context.Context, ip net.IP) bool
 // to the backend (container) at 172.17.42.108:4000.
 type Proxy interface {
 	// Run starts forwarding traffic back and forth between the front
-	// and back-end addresses.
-	Run()
+	// and back-end addresses. It blocks until the proxy is closed or the context is done
+	// and returns the error which stopped the proxy otherwise.
+	Run(ctx context.Context) error
 	// Close stops forwarding traffic and close both ends of the Proxy.
 	Close()
+	// Shutdown stops accepting new connections and waits for the active ones to finish
+	// until the context is done, then closes the remaining ones.
+	Shutdown(ctx context.Context) error
 	// FrontendAddr returns the address on which the proxy is listening.
 	FrontendAddr() net.Addr
 	// BackendAddr returns the proxied address.
 	BackendAddr() net.Addr
+	// Connections returns the active connections.
+	Connections() []Connection
+	// Kill closes the active connection with the given ID, it returns false when the connection is unknown.
+	Kill(id uint64) bool
 }
 
 // NewProxy creates a Proxy according to the specified frontend and backend.
-func NewProxy(ctx context.Context, addresser Addresser, h AcceptableConnection) (Proxy, error) {
+func NewProxy(ctx context.Context, addresser Addresser, h AcceptableConnection, opts Options) (Proxy, error) {
 	switch addresser.Frontend().(type) {
 	case *net.UDPAddr:
-		return NewUDPProxy(ctx, addresser, h)
+		return NewUDPProxy(ctx, addresser, h, opts)
 	case *net.TCPAddr:
-		return NewTCPProxy(ctx, addresser, h)
+		return NewTCPProxy(ctx, addresser, h, opts)
 	// case *sctp.SCTPAddr:
 	// 	return NewSCTPProxy(frontend.(*sctp.SCTPAddr), backend.(*sctp.SCTPAddr), h)
 	default:
 		panic("Unsupported protocol")
 	}
 }
+
+// Backoff bounds of the temporary errors.
+const (
+	minRetryDelay = 5 * time.Millisecond
+	maxRetryDelay = time.Second
+)
+
+// backoff returns the next delay of an exponential backoff.
+func backoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minRetryDelay
+	}
+	return min(2*delay, maxRetryDelay)
+}
+
+// sleep waits the given delay and returns false when the context is done before.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// isTemporaryError returns true when the error is worth retrying (e.g. file descriptors exhaustion).
+func isTemporaryError(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// nopObserver is the Observer used when none is provided.
+type nopObserver struct{}
+
+func (nopObserver) Dialed(net.Addr, time.Duration, error) {}
+func (nopObserver) Opened(net.Addr)                       {}
+func (nopObserver) Closed(net.Addr, time.Duration)        {}
+func (nopObserver) Transferred(net.Addr, int64, int64)    {}
+func (nopObserver) Ended(Record)                          {}
+
+func observer(opts Options) Observer {
+	if opts.Observer == nil {
+		return nopObserver{}
+	}
+	return opts.Observer
+}
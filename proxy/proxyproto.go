@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Supported PROXY protocol versions.
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A ProxyHeader holds the connection addresses conveyed by the PROXY protocol.
+type ProxyHeader struct {
+	Version     int
+	Source      net.Addr // The client address
+	Destination net.Addr // The proxy frontend address
+}
+
+// Format returns the wire representation of the header.
+// Version 1 only supports TCP.
+func (h ProxyHeader) Format() ([]byte, error) {
+	protocol, src, sport, err := splitAddr(h.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	dprotocol, dst, dport, err := splitAddr(h.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	if protocol != dprotocol {
+		return nil, fmt.Errorf("proxy protocol: mismatching networks: %s and %s", protocol, dprotocol)
+	}
+
+	// Both addresses must belong to the same family.
+	src4, dst4 := src.To4(), dst.To4()
+	v4 := src4 != nil && dst4 != nil
+	if v4 {
+		src, dst = src4, dst4
+	} else {
+		src, dst = src.To16(), dst.To16()
+	}
+
+	switch h.Version {
+	case ProxyProtocolV1:
+		if protocol != "tcp" {
+			return nil, fmt.Errorf("proxy protocol: version 1 does not support %s", protocol)
+		}
+
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, formatIP(src, v4), formatIP(dst, v4), sport, dport), nil
+	case ProxyProtocolV2:
+		var b bytes.Buffer
+		b.Write(proxyProtocolV2Signature)
+		b.WriteByte(0x21) // Version 2, PROXY command
+
+		family := byte(0x20) // AF_INET6
+		if v4 {
+			family = 0x10 // AF_INET
+		}
+		if protocol == "tcp" {
+			family |= 0x01 // STREAM
+		} else {
+			family |= 0x02 // DGRAM
+		}
+		b.WriteByte(family)
+
+		binary.Write(&b, binary.BigEndian, uint16(2*len(src)+4)) //nolint:errcheck
+		b.Write(src)
+		b.Write(dst)
+		binary.Write(&b, binary.BigEndian, uint16(sport)) //nolint:errcheck
+		binary.Write(&b, binary.BigEndian, uint16(dport)) //nolint:errcheck
+		return b.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("proxy protocol: unsupported version: %d", h.Version)
+	}
+}
+
+func splitAddr(addr net.Addr) (string, net.IP, int, error) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return "tcp", a.IP, a.Port, nil
+	case *net.UDPAddr:
+		return "udp", a.IP, a.Port, nil
+	default:
+		return "", nil, 0, fmt.Errorf("proxy protocol: unsupported address: %v", addr)
+	}
+}
+
+// formatIP returns the textual representation of the IP in the header family,
+// IPv4 addresses are written in their IPv4-mapped IPv6 form in a TCP6 header.
+func formatIP(ip net.IP, v4 bool) string {
+	if ip4 := ip.To4(); !v4 && ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header from the beginning of a stream.
+// The Source and Destination of the returned header are nil when the sender does not
+// convey the client address (v1 UNKNOWN, v2 LOCAL command or unsupported address family),
+// the connection addresses should then be used.
+func ReadProxyHeader(r *bufio.Reader) (ProxyHeader, error) {
+	signature, err := r.Peek(len(proxyProtocolV2Signature)) // Shorter than any valid header.
+	if err != nil {
+		return ProxyHeader{}, fmt.Errorf("proxy protocol: read signature: %w", err)
+	}
+
+	switch {
+	case bytes.Equal(signature, proxyProtocolV2Signature):
+		return readProxyHeaderV2(r)
+	case bytes.HasPrefix(signature, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	default:
+		return ProxyHeader{}, errors.New("proxy protocol: missing header")
+	}
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (ProxyHeader, error) {
+	const maxLength = 107 // Defined by the specification, CRLF included.
+
+	var line []byte
+	for len(line) < maxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return ProxyHeader{}, fmt.Errorf("proxy protocol: read v1 header: %w", err)
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ProxyHeader{}, errors.New("proxy protocol: v1 header too long or not terminated by CRLF")
+	}
+
+	h := ProxyHeader{Version: ProxyProtocolV1}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return h, fmt.Errorf("proxy protocol: invalid v1 header: %q", line)
+	}
+
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	if src == nil || dst == nil {
+		return h, fmt.Errorf("proxy protocol: invalid v1 addresses: %q", line)
+	}
+
+	sport, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return h, fmt.Errorf("proxy protocol: invalid v1 source port: %w", err)
+	}
+
+	dport, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return h, fmt.Errorf("proxy protocol: invalid v1 destination port: %w", err)
+	}
+
+	h.Source = &net.TCPAddr{IP: src, Port: int(sport)}
+	h.Destination = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return h, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (ProxyHeader, error) {
+	preamble := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, preamble); err != nil {
+		return ProxyHeader{}, fmt.Errorf("proxy protocol: read v2 header: %w", err)
+	}
+
+	h := ProxyHeader{Version: ProxyProtocolV2}
+
+	command := preamble[12]
+	if command>>4 != 0x2 {
+		return h, fmt.Errorf("proxy protocol: unsupported version: %d", command>>4)
+	}
+
+	// The payload holds the addresses followed by optional TLVs which are ignored.
+	payload := make([]byte, binary.BigEndian.Uint16(preamble[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return h, fmt.Errorf("proxy protocol: read v2 addresses: %w", err)
+	}
+
+	switch command & 0x0F {
+	case 0x0: // LOCAL, e.g. health checks of the load balancer.
+		return h, nil
+	case 0x1: // PROXY
+	default:
+		return h, fmt.Errorf("proxy protocol: unsupported command: %d", command&0x0F)
+	}
+
+	size := 0
+	switch preamble[13] >> 4 {
+	case 0x1: // AF_INET
+		size = net.IPv4len
+	case 0x2: // AF_INET6
+		size = net.IPv6len
+	default: // AF_UNSPEC or AF_UNIX
+		return h, nil
+	}
+
+	if len(payload) < 2*size+4 {
+		return h, errors.New("proxy protocol: v2 addresses too short")
+	}
+
+	src := net.IP(append([]byte{}, payload[:size]...))
+	dst := net.IP(append([]byte{}, payload[size:2*size]...))
+	sport := int(binary.BigEndian.Uint16(payload[2*size:]))
+	dport := int(binary.BigEndian.Uint16(payload[2*size+2:]))
+
+	switch preamble[13] & 0x0F {
+	case 0x1: // STREAM
+		h.Source = &net.TCPAddr{IP: src, Port: sport}
+		h.Destination = &net.TCPAddr{IP: dst, Port: dport}
+	case 0x2: // DGRAM
+		h.Source = &net.UDPAddr{IP: src, Port: sport}
+		h.Destination = &net.UDPAddr{IP: dst, Port: dport}
+	}
+
+	return h, nil
+}
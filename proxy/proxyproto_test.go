@@ -0,0 +1,418 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/proxy"
+	"github.com/mdouchement/logger"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHeader_FormatV1(t *testing.T) {
+	tests := []struct {
+		src, dst string
+		expected string
+	}{
+		{src: "192.0.2.1:56324", dst: "198.51.100.1:443", expected: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"},
+		{src: "[2001:db8::1]:56324", dst: "[2001:db8::2]:443", expected: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"},
+		{src: "192.0.2.1:56324", dst: "[2001:db8::2]:443", expected: "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n"},
+	}
+
+	for _, test := range tests {
+		header, err := proxy.ProxyHeader{
+			Version:     proxy.ProxyProtocolV1,
+			Source:      tcpAddr(t, test.src),
+			Destination: tcpAddr(t, test.dst),
+		}.Format()
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(header))
+	}
+
+	_, err := proxy.ProxyHeader{
+		Version:     proxy.ProxyProtocolV1,
+		Source:      udpAddr(t, "192.0.2.1:56324"),
+		Destination: udpAddr(t, "198.51.100.1:443"),
+	}.Format()
+	assert.Error(t, err, "v1 does not support UDP")
+}
+
+func TestProxyHeader_FormatV2(t *testing.T) {
+	header, err := proxy.ProxyHeader{
+		Version:     proxy.ProxyProtocolV2,
+		Source:      tcpAddr(t, "192.0.2.1:56324"),
+		Destination: tcpAddr(t, "198.51.100.1:443"),
+	}.Format()
+	require.NoError(t, err)
+
+	src, dst, family := decodeV2(t, header)
+	assert.Equal(t, byte(0x11), family) // TCP over IPv4
+	assert.Equal(t, "192.0.2.1:56324", src)
+	assert.Equal(t, "198.51.100.1:443", dst)
+
+	header, err = proxy.ProxyHeader{
+		Version:     proxy.ProxyProtocolV2,
+		Source:      udpAddr(t, "[2001:db8::1]:56324"),
+		Destination: udpAddr(t, "[2001:db8::2]:27015"),
+	}.Format()
+	require.NoError(t, err)
+
+	src, dst, family = decodeV2(t, header)
+	assert.Equal(t, byte(0x22), family) // UDP over IPv6
+	assert.Equal(t, "[2001:db8::1]:56324", src)
+	assert.Equal(t, "[2001:db8::2]:27015", dst)
+
+	_, err = proxy.ProxyHeader{
+		Version:     proxy.ProxyProtocolV2,
+		Source:      tcpAddr(t, "192.0.2.1:56324"),
+		Destination: udpAddr(t, "198.51.100.1:443"),
+	}.Format()
+	assert.Error(t, err, "mismatching networks")
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []proxy.ProxyHeader{
+		{Version: proxy.ProxyProtocolV1, Source: tcpAddr(t, "192.0.2.1:56324"), Destination: tcpAddr(t, "198.51.100.1:443")},
+		{Version: proxy.ProxyProtocolV1, Source: tcpAddr(t, "[2001:db8::1]:56324"), Destination: tcpAddr(t, "[2001:db8::2]:443")},
+		{Version: proxy.ProxyProtocolV2, Source: tcpAddr(t, "192.0.2.1:56324"), Destination: tcpAddr(t, "198.51.100.1:443")},
+		{Version: proxy.ProxyProtocolV2, Source: udpAddr(t, "[2001:db8::1]:56324"), Destination: udpAddr(t, "[2001:db8::2]:27015")},
+	}
+
+	for _, test := range tests {
+		header, err := test.Format()
+		require.NoError(t, err)
+
+		r := bufio.NewReader(strings.NewReader(string(header) + "payload"))
+		h, err := proxy.ReadProxyHeader(r)
+		assert.NoError(t, err)
+		assert.Equal(t, test.Version, h.Version)
+		assert.Equal(t, test.Source.String(), h.Source.String())
+		assert.Equal(t, test.Destination.String(), h.Destination.String())
+		assert.Equal(t, test.Source.Network(), h.Source.Network())
+
+		payload, _ := io.ReadAll(r)
+		assert.Equal(t, "payload", string(payload))
+	}
+}
+
+func TestReadProxyHeader_WithoutAddresses(t *testing.T) {
+	local := []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00") // v2 LOCAL command
+	unknown := []byte("PROXY UNKNOWN\r\n")
+
+	for _, header := range [][]byte{local, unknown} {
+		h, err := proxy.ReadProxyHeader(bufio.NewReader(strings.NewReader(string(header) + "payload")))
+		assert.NoError(t, err)
+		assert.Nil(t, h.Source)
+		assert.Nil(t, h.Destination)
+	}
+}
+
+func TestReadProxyHeader_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"missing header":     "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"not terminated":     "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+		"too long":           "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n",
+		"invalid v1 header":  "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"invalid v1 address": "PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n",
+		"unsupported":        "\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00",
+		"too short":          "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x01\x02\x03\x04",
+	}
+
+	for name, header := range tests {
+		_, err := proxy.ReadProxyHeader(bufio.NewReader(strings.NewReader(header)))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestTCPProxy_ProxyProtocol(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	p, err := proxy.NewTCPProxy(testContext(), &addresser{
+		frontend: tcpAddr(t, "127.0.0.1:0"),
+		backend:  backend.Addr(),
+	}, acceptAll, proxy.Options{ProxyProtocol: proxy.ProxyProtocolV1})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	client, err := net.Dial("tcp", p.FrontendAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("hello\n"))
+	require.NoError(t, err)
+
+	conn, err := backend.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	r := bufio.NewReader(conn)
+	header, err := r.ReadString('\n')
+	require.NoError(t, err)
+
+	fields := strings.Fields(header)
+	require.Len(t, fields, 6)
+	assert.Equal(t, []string{"PROXY", "TCP4", "127.0.0.1", "127.0.0.1"}, fields[:4])
+	assert.Equal(t, client.LocalAddr().(*net.TCPAddr).Port, atoi(t, fields[4]))
+	assert.Equal(t, p.FrontendAddr().(*net.TCPAddr).Port, atoi(t, fields[5]))
+
+	payload, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", payload)
+}
+
+func TestUDPProxy_ProxyProtocol(t *testing.T) {
+	backend, err := net.ListenUDP("udp", udpAddr(t, "127.0.0.1:0"))
+	require.NoError(t, err)
+	defer backend.Close()
+
+	p, err := proxy.NewUDPProxy(testContext(), &addresser{
+		frontend: udpAddr(t, "127.0.0.1:0"),
+		backend:  backend.LocalAddr(),
+	}, acceptAll, proxy.Options{ProxyProtocol: proxy.ProxyProtocolV2})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	client, err := net.Dial("udp", p.FrontendAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	for _, datagram := range []string{"ping-1", "ping-2"} {
+		_, err = client.Write([]byte(datagram))
+		require.NoError(t, err)
+
+		backend.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+		buf := make([]byte, 1024)
+		n, err := backend.Read(buf)
+		require.NoError(t, err)
+
+		length := 16 + 12 // Signature + version/family/length + IPv4 addresses & ports
+		require.Greater(t, n, length)
+
+		src, dst, family := decodeV2(t, buf[:length])
+		assert.Equal(t, byte(0x12), family) // UDP over IPv4
+		assert.Equal(t, client.LocalAddr().String(), src)
+		assert.Equal(t, p.FrontendAddr().String(), dst)
+		assert.Equal(t, datagram, string(buf[length:n]))
+	}
+
+	_, err = proxy.NewUDPProxy(testContext(), &addresser{
+		frontend: udpAddr(t, "127.0.0.1:0"),
+		backend:  backend.LocalAddr(),
+	}, acceptAll, proxy.Options{ProxyProtocol: proxy.ProxyProtocolV1})
+	assert.Error(t, err, "v1 does not support UDP")
+}
+
+func TestTCPProxy_TrustedProxies(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	clients := make(chan net.IP, 1)
+	p, err := proxy.NewTCPProxy(testContext(), &addresser{
+		frontend: tcpAddr(t, "127.0.0.1:0"),
+		backend:  backend.Addr(),
+	}, func(_ context.Context, ip net.IP) proxy.Decision {
+		clients <- ip
+		return proxy.Decision{Allowed: true}
+	}, proxy.Options{
+		ProxyProtocol:  proxy.ProxyProtocolV1,
+		TrustedProxies: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+	})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	client, err := net.Dial("tcp", p.FrontendAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	// The header and the payload are sent in the same segment.
+	_, err = client.Write([]byte("PROXY TCP4 203.0.113.7 198.51.100.1 56324 443\r\nhello\n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "203.0.113.7", (<-clients).String())
+
+	conn, err := backend.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	r := bufio.NewReader(conn)
+	header, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "PROXY TCP4 203.0.113.7 198.51.100.1 56324 443\r\n", header, "re-emitted client address")
+
+	payload, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", payload)
+}
+
+func TestTCPProxy_UntrustedProxy(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	clients := make(chan net.IP, 1)
+	p, err := proxy.NewTCPProxy(testContext(), &addresser{
+		frontend: tcpAddr(t, "127.0.0.1:0"),
+		backend:  backend.Addr(),
+	}, func(_ context.Context, ip net.IP) proxy.Decision {
+		clients <- ip
+		return proxy.Decision{Allowed: true}
+	}, proxy.Options{
+		TrustedProxies: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+	})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	client, err := net.Dial("tcp", p.FrontendAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	spoofed := "PROXY TCP4 203.0.113.7 198.51.100.1 56324 443\r\n"
+	_, err = client.Write([]byte(spoofed))
+	require.NoError(t, err)
+
+	assert.Equal(t, "127.0.0.1", (<-clients).String())
+
+	conn, err := backend.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	header, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, spoofed, header, "forwarded as payload")
+}
+
+func TestTCPProxy_TrustedProxyDatagramHeader(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	var evaluated atomic.Bool
+	p, err := proxy.NewTCPProxy(testContext(), &addresser{
+		frontend: tcpAddr(t, "127.0.0.1:0"),
+		backend:  backend.Addr(),
+	}, func(context.Context, net.IP) proxy.Decision {
+		evaluated.Store(true)
+		return proxy.Decision{Allowed: true}
+	}, proxy.Options{
+		TrustedProxies: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+	})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	header, err := proxy.ProxyHeader{
+		Version:     proxy.ProxyProtocolV2,
+		Source:      udpAddr(t, "203.0.113.7:56324"),
+		Destination: udpAddr(t, "198.51.100.1:443"),
+	}.Format()
+	require.NoError(t, err)
+
+	client, err := net.Dial("tcp", p.FrontendAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	_, err = client.Write(append(header, "hello\n"...))
+	require.NoError(t, err)
+
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "the connection is closed")
+	assert.False(t, evaluated.Load(), "the DGRAM header is rejected")
+
+	// The proxy is still serving.
+	client, err = net.Dial("tcp", p.FrontendAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("PROXY TCP4 203.0.113.7 198.51.100.1 56324 443\r\n"))
+	require.NoError(t, err)
+
+	conn, err := backend.Accept()
+	require.NoError(t, err)
+	conn.Close()
+	assert.True(t, evaluated.Load())
+}
+
+// decodeV2 decodes a PROXY protocol v2 header according to the specification.
+func decodeV2(t *testing.T, header []byte) (src, dst string, family byte) {
+	t.Helper()
+
+	require.GreaterOrEqual(t, len(header), 16)
+	require.Equal(t, []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}, header[:12])
+	require.Equal(t, byte(0x21), header[12], "version 2 and PROXY command")
+
+	family = header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	require.Len(t, header[16:], length)
+
+	body := header[16:]
+	size := net.IPv4len
+	if family>>4 == 0x2 {
+		size = net.IPv6len
+	}
+	require.Equal(t, 2*size+4, length)
+
+	sport := binary.BigEndian.Uint16(body[2*size:])
+	dport := binary.BigEndian.Uint16(body[2*size+2:])
+
+	src = net.JoinHostPort(net.IP(body[:size]).String(), strconv.Itoa(int(sport)))
+	dst = net.JoinHostPort(net.IP(body[size:2*size]).String(), strconv.Itoa(int(dport)))
+	return src, dst, family
+}
+
+//
+// Helpers
+//
+
+type addresser struct {
+	frontend net.Addr
+	backend  net.Addr
+}
+
+func (a *addresser) Frontend() net.Addr        { return a.frontend }
+func (a *addresser) Backend(net.Addr) net.Addr { return a.backend }
+
+func acceptAll(context.Context, net.IP) proxy.Decision { return proxy.Decision{Allowed: true} }
+
+func testContext() context.Context {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	return logger.WithLogger(context.Background(), logger.WrapLogrus(l))
+}
+
+func tcpAddr(t *testing.T, s string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	require.NoError(t, err)
+	return addr
+}
+
+func udpAddr(t *testing.T, s string) *net.UDPAddr {
+	addr, err := net.ResolveUDPAddr("udp", s)
+	require.NoError(t, err)
+	return addr
+}
+
+func atoi(t *testing.T, s string) int {
+	v, err := strconv.Atoi(s)
+	require.NoError(t, err)
+	return v
+}
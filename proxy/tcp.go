@@ -1,30 +1,68 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
+	"fmt"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mdouchement/logger"
 	"github.com/pkg/errors"
 )
 
+// ProxyHeaderTimeout is the maximum duration to receive the PROXY protocol header of a trusted connection.
+const ProxyHeaderTimeout = 5 * time.Second
+
 // TCPProxy is a proxy for TCP connections. It implements the Proxy interface to
 // handle TCP traffic forwarding between the frontend and backend addresses.
 type TCPProxy struct {
 	ctx        context.Context
+	cancel     context.CancelFunc // Aborts the pending dials
 	listener   *net.TCPListener
 	addresser  Addresser
 	acceptable AcceptableConnection
+	dialer     net.Dialer
+	attempts   int
+	pp         int
+	trusted    []*net.IPNet
+	observer   Observer
+
+	mu       sync.Mutex
+	closing  bool
+	active   sync.WaitGroup        // Handled connections
+	conns    map[net.Conn]struct{} // Client and backend connections
+	sessions map[uint64]*session   // Relayed connections
+}
+
+// A session is a relayed TCP connection.
+type session struct {
+	id       uint64
+	start    time.Time
+	client   net.Addr
+	frontend net.Addr
+	country  string
+	local    net.Conn
+	remote   net.Conn
+	in       atomic.Int64 // Bytes received from the client
+	out      atomic.Int64 // Bytes sent to the client
+	killed   atomic.Bool
 }
 
 // NewTCPProxy creates a new TCPProxy.
-func NewTCPProxy(ctx context.Context, addresser Addresser, h AcceptableConnection) (*TCPProxy, error) {
+func NewTCPProxy(ctx context.Context, addresser Addresser, h AcceptableConnection, opts Options) (*TCPProxy, error) {
 	log := logger.LogWith(ctx)
 
+	switch opts.ProxyProtocol {
+	case 0, ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		return nil, fmt.Errorf("proxy protocol: unsupported version: %d", opts.ProxyProtocol)
+	}
+
 	// detect version of hostIP to bind only to correct version
 	frontend := addresser.Frontend().(*net.TCPAddr)
 	fipv := ipv4
@@ -33,7 +71,7 @@ func NewTCPProxy(ctx context.Context, addresser Addresser, h AcceptableConnectio
 	}
 	scheme := "tcp" + string(fipv)
 
-	backend := addresser.Backend().(*net.TCPAddr)
+	backend := addresser.Backend(nil).(*net.TCPAddr)
 	bipv := ipv4
 	if backend.IP.To4() == nil {
 		bipv = ipv6
@@ -45,69 +83,297 @@ func NewTCPProxy(ctx context.Context, addresser Addresser, h AcceptableConnectio
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+
 	// If the port in frontend was 0 then ListenTCP will have a picked
 	// a port to listen on, hence the call to Addr to get that actual port:
 	return &TCPProxy{
-		ctx:        ctx,
+		ctx:        logger.WithLogger(ctx, log.WithPrefixf("[%s://%s]", scheme, frontend)),
+		cancel:     cancel,
 		listener:   listener,
 		addresser:  addresser,
 		acceptable: h,
+		dialer: net.Dialer{
+			Timeout: opts.DialTimeout,
+		},
+		attempts: max(opts.DialAttempts, 1),
+		pp:       opts.ProxyProtocol,
+		trusted:  opts.TrustedProxies,
+		observer: observer(opts),
+		conns:    make(map[net.Conn]struct{}),
+		sessions: make(map[uint64]*session),
 	}, nil
 }
 
 // FrontendAddr returns the TCP address on which the proxy is listening.
 func (p *TCPProxy) FrontendAddr() net.Addr {
-	return p.addresser.Frontend()
+	return p.listener.Addr()
 }
 
 // BackendAddr returns the proxied TCP address.
 func (p *TCPProxy) BackendAddr() net.Addr {
-	return p.addresser.Backend()
+	return p.addresser.Backend(nil)
 }
 
 // Run starts forwarding the traffic using TCP.
-func (p *TCPProxy) Run() {
+// It returns nil once the proxy is closed or the context is done, otherwise the error which stopped it.
+func (p *TCPProxy) Run(ctx context.Context) error {
 	log := logger.LogWith(p.ctx)
 
+	stop := context.AfterFunc(ctx, p.Close)
+	defer stop()
+
+	var delay time.Duration
 	for {
 		c, err := p.listener.Accept()
 		if err != nil {
-			log.Errorf("Could not accept %s", err)
+			if isClosedError(err) {
+				log.WithError(err).Debugf("Stopping proxy on tcp/%v", p.addresser.Frontend())
+				return nil
+			}
+
+			if !isTemporaryError(err) {
+				return fmt.Errorf("accept: %w", err)
+			}
+
+			delay = backoff(delay)
+			log.Errorf("Could not accept, retrying in %s: %s", delay, err)
+			if !sleep(ctx, delay) {
+				return nil
+			}
 			continue
 		}
+		delay = 0
 		// c.(*net.TCPConn).SetKeepAlive(true)
 
-		if !p.acceptable(p.ctx, c.RemoteAddr().(*net.TCPAddr).IP) {
+		p.mu.Lock()
+		if p.closing {
+			p.mu.Unlock()
 			c.Close()
-			continue
+			return nil
+		}
+		p.active.Add(1)
+		p.mu.Unlock()
+
+		go func() {
+			defer p.active.Done()
+			p.handle(c)
+		}()
+	}
+}
+
+func (p *TCPProxy) handle(local net.Conn) {
+	log := logger.LogWith(p.ctx)
+
+	p.track(local)
+	defer p.untrack(local)
+
+	client, frontend := local.RemoteAddr(), local.LocalAddr()
+	if p.isTrusted(client) {
+		header, conn, err := p.readProxyHeader(local)
+		if err != nil {
+			log.Warnf("Could not read PROXY protocol header from %s: %s", client, err)
+			local.Close()
+			return
+		}
+		local = conn
+
+		if _, ok := header.Source.(*net.TCPAddr); header.Source != nil && !ok {
+			log.Warnf("Could not accept PROXY protocol header from %s: unsupported %s transport", client, header.Source.Network())
+			local.Close()
+			return
 		}
 
-		go func(local net.Conn) {
-			backend := p.addresser.Backend().(*net.TCPAddr)
-			log.Infof("Forwarding %s://%s to %s://%s", p.FrontendAddr().Network(), p.FrontendAddr().String(), backend.Network(), backend.String())
+		if header.Source != nil {
+			log.Debugf("Connection from %s on behalf of %s", client, header.Source)
+			client, frontend = header.Source, header.Destination
+		}
+	}
 
-			remote, err := net.DialTCP("tcp", nil, backend)
-			if err != nil {
-				log.Errorf("Could not connect to backend: %s", err)
-				return
-			}
-			// remote.SetKeepAlive(true)
+	record := Record{Start: time.Now(), Client: client, Frontend: frontend}
+	defer func() {
+		record.Duration = time.Since(record.Start)
+		p.observer.Ended(record)
+	}()
+
+	decision := p.acceptable(p.ctx, client.(*net.TCPAddr).IP)
+	record.Decision = decision
+	if !decision.Allowed {
+		local.Close()
+		return
+	}
+
+	addresser := p.addresser
+	if decision.Route != nil {
+		addresser = decision.Route
+	}
+
+	remote, err := p.dial(addresser, client)
+	if err != nil {
+		log.Errorf("Could not connect to backend: %s", err)
+		record.Err = err
+		local.Close()
+		return
+	}
+	// remote.SetKeepAlive(true)
+
+	p.track(remote)
+	defer p.untrack(remote)
+
+	backend := remote.RemoteAddr()
+	record.Backend = backend
+	if reporter, ok := addresser.(ConnectionReporter); ok {
+		reporter.Connected(backend)
+		defer reporter.Disconnected(backend)
+	}
+
+	p.observer.Opened(backend)
+	defer func(start time.Time) {
+		p.observer.Closed(backend, time.Since(start))
+	}(time.Now())
+
+	if p.pp > 0 {
+		err = p.writeProxyHeader(remote, client, frontend)
+		if err != nil {
+			log.Errorf("Could not send PROXY protocol header: %s", err)
+			record.Err = err
+			local.Close()
+			remote.Close()
+			return
+		}
+	}
+
+	s := &session{
+		id:       nextConnectionID(),
+		start:    record.Start,
+		client:   client,
+		frontend: frontend,
+		country:  decision.Country,
+		local:    local,
+		remote:   remote,
+	}
+	p.register(s)
+	defer p.unregister(s)
+
+	record.In, record.Out, err = p.relay(s, backend)
+	switch {
+	case s.killed.Load():
+		log.Infof("Connection of %v killed", client)
+		record.Err = ErrKilled
+	case err != nil && !IsIgnorableError(err):
+		log.Errorf("Could not pipe the TCP connection: %s", err)
+		record.Err = err
+	}
 
-			err = p.relay(local, remote)
-			if err != nil && !IsIgnorableError(err) {
-				log.Errorf("Could not pipe the TCP connection: %s", err)
+	log.WithError(err).Debugf("Connection closed for %v", client)
+}
+
+// dial connects a backend of the client, the next backends are tried when the connection fails.
+// The backends already tried are skipped when the addresser is a BackendPicker.
+func (p *TCPProxy) dial(addresser Addresser, client net.Addr) (net.Conn, error) {
+	log := logger.LogWith(p.ctx)
+	reporter, _ := addresser.(DialReporter)
+	picker, _ := addresser.(BackendPicker)
+
+	tried := make(map[string]bool, p.attempts)
+	untried := func(backend net.Addr) bool {
+		return !tried[backend.String()]
+	}
+
+	err := errors.New("no backend available")
+	for attempt := 1; attempt <= p.attempts; attempt++ {
+		var next net.Addr
+		if picker != nil {
+			next = picker.PickBackend(client, untried)
+		} else {
+			next = addresser.Backend(client)
+		}
+
+		backend, ok := next.(*net.TCPAddr)
+		if !ok {
+			break // All the backends have been tried.
+		}
+		tried[backend.String()] = true
+
+		log.Infof("Forwarding %s://%s to %s://%s", p.FrontendAddr().Network(), p.FrontendAddr().String(), backend.Network(), backend.String())
+
+		var remote net.Conn
+		start := time.Now()
+		remote, err = p.dialer.DialContext(p.ctx, "tcp", backend.String())
+		p.observer.Dialed(backend, time.Since(start), err)
+		if err == nil {
+			if reporter != nil {
+				reporter.DialSucceeded(backend)
 			}
+			return remote, nil
+		}
 
-			log.WithError(err).Debugf("Connection closed for %v", local.RemoteAddr())
-		}(c)
+		if reporter != nil && reporter.DialFailed(backend) {
+			log.Warnf("Backend %s is ejected after consecutive connection failures", backend)
+		}
+
+		if attempt < p.attempts {
+			log.Warnf("Could not connect to backend %s, trying another one: %s", backend, err)
+		}
 	}
+
+	return nil, err
 }
 
-func (p *TCPProxy) relay(local, remote net.Conn) error {
+// isTrusted returns true when the address belongs to a trusted load balancer.
+func (p *TCPProxy) isTrusted(addr net.Addr) bool {
+	ip := addr.(*net.TCPAddr).IP
+	for _, block := range p.trusted {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads the PROXY protocol header sent by a trusted load balancer.
+// The returned connection must be used instead of the given one as it may hold buffered data.
+func (p *TCPProxy) readProxyHeader(c net.Conn) (ProxyHeader, net.Conn, error) {
+	//nolint:errcheck
+	c.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+
+	r := bufio.NewReader(c)
+	header, err := ReadProxyHeader(r)
+	if err != nil {
+		return header, c, err
+	}
+
+	//nolint:errcheck
+	c.SetReadDeadline(time.Time{})
+
+	if r.Buffered() > 0 {
+		return header, &bufferedConn{Conn: c, r: r}, nil
+	}
+	return header, c, nil
+}
+
+func (p *TCPProxy) writeProxyHeader(remote net.Conn, client, frontend net.Addr) error {
+	header, err := ProxyHeader{
+		Version:     p.pp,
+		Source:      client,
+		Destination: frontend,
+	}.Format()
+	if err != nil {
+		return err
+	}
+
+	_, err = remote.Write(header)
+	return err
+}
+
+// relay pipes the connections of the session and returns the number of bytes received from the client (in) and sent to it (out).
+// The bytes are reported to the observer as they are relayed.
+func (p *TCPProxy) relay(s *session, backend net.Addr) (in, out int64, err error) {
+	local, remote := s.local, s.remote
 	defer local.Close()
 	defer remote.Close()
 
-	var err, err1 error
+	var err1 error
 	var wg sync.WaitGroup
 	const delay = time.Second
 
@@ -115,28 +381,156 @@ func (p *TCPProxy) relay(local, remote net.Conn) error {
 	go func() {
 		defer wg.Done()
 
-		_, err1 = io.Copy(remote, local)
+		in, err1 = io.Copy(remote, &countingReader{r: local, n: &s.in, report: func(n int64) {
+			p.observer.Transferred(backend, n, 0)
+		}})
 		//nolint:errcheck
 		remote.SetDeadline(time.Now().Add(delay)) // wake up the other goroutine blocking on remote
 	}()
 
-	_, err = io.Copy(local, remote)
+	out, err = io.Copy(local, &countingReader{r: remote, n: &s.out, report: func(n int64) {
+		p.observer.Transferred(backend, 0, n)
+	}})
 	//nolint:errcheck
 	local.SetDeadline(time.Now().Add(delay)) // wake up the other goroutine blocking on local
 
 	wg.Wait()
 
 	if err1 != nil {
-		return err1
+		return in, out, err1
 	}
-	return err
+	return in, out, err
+}
+
+// Connections returns the relayed connections.
+func (p *TCPProxy) Connections() []Connection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	connections := make([]Connection, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		connections = append(connections, Connection{
+			ID:       s.id,
+			Start:    s.start,
+			Client:   s.client,
+			Frontend: s.frontend,
+			Country:  s.country,
+			Backend:  s.remote.RemoteAddr(),
+			In:       s.in.Load(),
+			Out:      s.out.Load(),
+		})
+	}
+	return connections
+}
+
+// Kill closes the relayed connection with the given ID.
+func (p *TCPProxy) Kill(id uint64) bool {
+	p.mu.Lock()
+	s, ok := p.sessions[id]
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	s.killed.Store(true)
+	s.local.Close()
+	s.remote.Close()
+	return true
 }
 
-// Close stops forwarding the traffic.
+// Close stops accepting new connections, the established ones are still relayed.
 func (p *TCPProxy) Close() {
+	p.mu.Lock()
+	p.closing = true
+	p.mu.Unlock()
+
 	p.listener.Close()
 }
 
+// Shutdown stops accepting new connections and waits for the established ones to be closed.
+// When the context is done before, the remaining connections are closed and the context error is returned.
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.Close()
+
+	drained := make(chan struct{})
+	go func() {
+		p.active.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	p.cancel()
+
+	p.mu.Lock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+
+	<-drained
+	return ctx.Err()
+}
+
+// track registers a handled connection so it can be closed by Shutdown.
+func (p *TCPProxy) track(c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.conns[c] = struct{}{}
+}
+
+func (p *TCPProxy) untrack(c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.conns, c)
+}
+
+func (p *TCPProxy) register(s *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sessions[s.id] = s
+}
+
+func (p *TCPProxy) unregister(s *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.sessions, s.id)
+}
+
+// A countingReader counts and reports the bytes read.
+type countingReader struct {
+	r      io.Reader
+	n      *atomic.Int64
+	report func(n int64)
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.n.Add(int64(n))
+		r.report(int64(n))
+	}
+	return n, err
+}
+
+// A bufferedConn is a connection whose first bytes have already been buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
 // IsIgnorableError returns true if the net error is ignorable.
 func IsIgnorableError(err error) bool {
 	err = errors.Cause(err)
@@ -0,0 +1,617 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/loadbalancer"
+	"github.com/mdouchement/geoblock-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPProxy_DialRetry(t *testing.T) {
+	backend1 := echoServer(t)
+	backend2 := echoServer(t)
+	defer backend2.Close()
+
+	lb, err := loadbalancer.New(loadbalancer.StrategyRoundRobin, "tcp", "127.0.0.1:0", []loadbalancer.Backend{
+		{Address: backend1.Addr().String()},
+		{Address: backend2.Addr().String()},
+	})
+	require.NoError(t, err)
+	ejector := loadbalancer.NewEjector(lb, 2, time.Minute)
+
+	p, err := proxy.NewTCPProxy(testContext(), ejector, acceptAll, proxy.Options{
+		DialTimeout:  time.Second,
+		DialAttempts: 2,
+	})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	for i := 0; i < 4; i++ {
+		assertEcho(t, p.FrontendAddr(), "before")
+	}
+
+	backend1.Close() // Kill the first backend.
+
+	for i := 0; i < 4; i++ {
+		assertEcho(t, p.FrontendAddr(), "after")
+	}
+
+	assert.True(t, ejector.Ejected(lb.Backends()[0]), "consecutive failures")
+	assert.False(t, ejector.Ejected(lb.Backends()[1]))
+}
+
+func TestTCPProxy_DialRetrySourceHash(t *testing.T) {
+	backends := []net.Listener{echoServer(t), echoServer(t), echoServer(t)}
+	for _, backend := range backends {
+		defer backend.Close()
+	}
+
+	lb, err := loadbalancer.New(loadbalancer.StrategySourceHash, "tcp", "127.0.0.1:0", []loadbalancer.Backend{
+		{Address: backends[0].Addr().String()},
+		{Address: backends[1].Addr().String()},
+		{Address: backends[2].Addr().String()},
+	})
+	require.NoError(t, err)
+
+	// Kill the backend of the client, it is never ejected.
+	dead := lb.Backend(tcpAddr(t, "127.0.0.1:0"))
+	for _, backend := range backends {
+		if backend.Addr().String() == dead.String() {
+			backend.Close()
+		}
+	}
+
+	observer := &recorder{}
+	p, err := proxy.NewTCPProxy(testContext(), loadbalancer.NewEjector(lb, 100, time.Minute), acceptAll, proxy.Options{
+		DialTimeout:  time.Second,
+		DialAttempts: 3,
+		Observer:     observer,
+	})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	for i := 0; i < 4; i++ {
+		assertEcho(t, p.FrontendAddr(), "retried")
+	}
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+
+	var failures int
+	for _, event := range observer.log {
+		if event == "dialed "+dead.String()+" failed" {
+			failures++
+		}
+	}
+	assert.Equal(t, 4, failures, "the dead backend is tried once per client")
+}
+
+func TestTCPProxy_AllBackendsDown(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	lb, err := loadbalancer.New(loadbalancer.StrategyRoundRobin, "tcp", "127.0.0.1:0", []loadbalancer.Backend{
+		{Address: backend.Addr().String()},
+	})
+	require.NoError(t, err)
+
+	// The echoed payload does not match the expected one.
+	health, err := loadbalancer.NewHealthChecker(lb, "tcp", loadbalancer.HealthCheck{
+		Timeout: time.Second,
+		Fall:    1,
+		Send:    []byte("ping"),
+		Expect:  []byte("pong"),
+	})
+	require.NoError(t, err)
+	health.Check(context.Background())
+	require.False(t, health.Healthy(lb.Backends()[0]))
+
+	p, err := proxy.NewTCPProxy(testContext(), loadbalancer.NewEjector(health, 0, 0), acceptAll, proxy.Options{
+		DialTimeout: time.Second,
+	})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	assertEcho(t, p.FrontendAddr(), "the backends are still used when all of them are down")
+}
+
+func TestTCPProxy_DialFailure(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead.Close()
+
+	p, err := proxy.NewTCPProxy(testContext(), &addresser{
+		frontend: tcpAddr(t, "127.0.0.1:0"),
+		backend:  dead.Addr(),
+	}, acceptAll, proxy.Options{DialAttempts: 3})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	client, err := net.Dial("tcp", p.FrontendAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	// The client connection is closed when no backend is reachable.
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestTCPProxy_Route(t *testing.T) {
+	paris := nameServer(t, "paris")
+	defer paris.Close()
+	frankfurt := nameServer(t, "frankfurt")
+	defer frankfurt.Close()
+
+	var routed atomic.Bool
+	routed.Store(true)
+	p, err := proxy.NewTCPProxy(testContext(), &addresser{
+		frontend: tcpAddr(t, "127.0.0.1:0"),
+		backend:  paris.Addr(),
+	}, func(context.Context, net.IP) proxy.Decision {
+		if !routed.Load() {
+			return proxy.Decision{Allowed: true}
+		}
+		return proxy.Decision{Allowed: true, Route: &addresser{backend: frankfurt.Addr()}}
+	}, proxy.Options{})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	assert.Equal(t, "frankfurt", readName(t, p.FrontendAddr()))
+	routed.Store(false)
+	assert.Equal(t, "paris", readName(t, p.FrontendAddr()))
+}
+
+func TestTCPProxy_RunStops(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	newProxy := func() *proxy.TCPProxy {
+		p, err := proxy.NewTCPProxy(testContext(), &addresser{
+			frontend: tcpAddr(t, "127.0.0.1:0"),
+			backend:  backend.Addr(),
+		}, acceptAll, proxy.Options{})
+		require.NoError(t, err)
+		return p
+	}
+
+	p := newProxy()
+	stopped := run(p, context.Background())
+	assertEcho(t, p.FrontendAddr(), "hello")
+
+	p.Close()
+	assertStopped(t, stopped)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p = newProxy()
+	stopped = run(p, ctx)
+	assertEcho(t, p.FrontendAddr(), "hello")
+
+	cancel()
+	assertStopped(t, stopped)
+	_, err := net.Dial("tcp", p.FrontendAddr().String())
+	assert.Error(t, err, "the listener is closed")
+}
+
+func TestTCPProxy_Shutdown(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	p, err := proxy.NewTCPProxy(testContext(), &addresser{
+		frontend: tcpAddr(t, "127.0.0.1:0"),
+		backend:  backend.Addr(),
+	}, acceptAll, proxy.Options{})
+	require.NoError(t, err)
+	stopped := run(p, context.Background())
+
+	client, err := net.Dial("tcp", p.FrontendAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+	r := bufio.NewReader(client)
+
+	echo := func(message string) {
+		t.Helper()
+
+		_, err := client.Write([]byte(message + "\n"))
+		require.NoError(t, err)
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, message, strings.TrimSpace(line))
+	}
+	echo("before")
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- p.Shutdown(context.Background())
+	}()
+
+	assertStopped(t, stopped)
+
+	// The new connections are refused while the established one is still relayed.
+	_, err = net.Dial("tcp", p.FrontendAddr().String())
+	assert.Error(t, err)
+	echo("draining")
+
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the end of the connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	client.Close()
+	select {
+	case err := <-shutdown:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return after the end of the connection")
+	}
+}
+
+func TestTCPProxy_ShutdownTimeout(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	p, err := proxy.NewTCPProxy(testContext(), &addresser{
+		frontend: tcpAddr(t, "127.0.0.1:0"),
+		backend:  backend.Addr(),
+	}, acceptAll, proxy.Options{})
+	require.NoError(t, err)
+	go p.Run(context.Background())
+
+	client, err := net.Dial("tcp", p.FrontendAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	_, err = client.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(client).ReadString('\n')
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, p.Shutdown(ctx), context.DeadlineExceeded)
+
+	// The remaining connection has been closed.
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestTCPProxy_Observer(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead.Close()
+
+	lb, err := loadbalancer.New(loadbalancer.StrategyRoundRobin, "tcp", "127.0.0.1:0", []loadbalancer.Backend{
+		{Address: backend.Addr().String()},
+		{Address: dead.Addr().String()}, // Dialed first as NewTCPProxy logs the first backend.
+	})
+	require.NoError(t, err)
+
+	o := &recorder{}
+	p, err := proxy.NewTCPProxy(testContext(), lb, acceptAll, proxy.Options{
+		DialAttempts: 2,
+		Observer:     o,
+	})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	assertEcho(t, p.FrontendAddr(), "hello")
+
+	assert.Eventually(t, func() bool {
+		return o.events() == 5
+	}, 5*time.Second, 10*time.Millisecond)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	assert.Equal(t, []string{
+		"dialed " + dead.Addr().String() + " failed",
+		"dialed " + backend.Addr().String(),
+		"opened " + backend.Addr().String(),
+		"closed " + backend.Addr().String(),
+	}, o.log)
+	assert.Equal(t, int64(len("hello\n")), o.in)
+	assert.Equal(t, int64(len("hello\n")), o.out)
+
+	record := o.records[0]
+	assert.True(t, record.Decision.Allowed)
+	assert.Equal(t, p.FrontendAddr().String(), record.Frontend.String())
+	assert.Equal(t, backend.Addr().String(), record.Backend.String())
+	assert.Equal(t, int64(len("hello\n")), record.In)
+	assert.Equal(t, int64(len("hello\n")), record.Out)
+	assert.Positive(t, record.Duration)
+	assert.NoError(t, record.Err)
+}
+
+func TestTCPProxy_ObserverTransferred(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	o := &recorder{}
+	p, err := proxy.NewTCPProxy(testContext(), &addresser{
+		frontend: tcpAddr(t, "127.0.0.1:0"),
+		backend:  backend.Addr(),
+	}, acceptAll, proxy.Options{Observer: o})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	client, err := net.Dial("tcp", p.FrontendAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	r := bufio.NewReader(client)
+	for _, message := range []string{"hello\n", "world\n"} {
+		_, err = client.Write([]byte(message))
+		require.NoError(t, err)
+		_, err = r.ReadString('\n')
+		require.NoError(t, err)
+	}
+
+	// The bytes are reported while the connection is still open.
+	assert.Eventually(t, func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+
+		return o.in == 12 && o.out == 12
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestTCPProxy_ObserverRejected(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	o := &recorder{}
+	p, err := proxy.NewTCPProxy(testContext(), &addresser{
+		frontend: tcpAddr(t, "127.0.0.1:0"),
+		backend:  backend.Addr(),
+	}, func(context.Context, net.IP) proxy.Decision {
+		return proxy.Decision{Country: "fr", Rule: "country FR"}
+	}, proxy.Options{Observer: o})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	client, err := net.Dial("tcp", p.FrontendAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	assert.Eventually(t, func() bool {
+		return o.events() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	assert.Empty(t, o.log, "no backend is dialed")
+
+	record := o.records[0]
+	assert.False(t, record.Decision.Allowed)
+	assert.Equal(t, "fr", record.Decision.Country)
+	assert.Equal(t, client.LocalAddr().String(), record.Client.String())
+	assert.Nil(t, record.Backend)
+}
+
+func TestTCPProxy_Kill(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	o := &recorder{}
+	p, err := proxy.NewTCPProxy(testContext(), &addresser{
+		frontend: tcpAddr(t, "127.0.0.1:0"),
+		backend:  backend.Addr(),
+	}, func(context.Context, net.IP) proxy.Decision {
+		return proxy.Decision{Allowed: true, Country: "FR"}
+	}, proxy.Options{Observer: o})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	client, err := net.Dial("tcp", p.FrontendAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	_, err = client.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(client).ReadString('\n')
+	require.NoError(t, err)
+
+	var connections []proxy.Connection
+	assert.Eventually(t, func() bool {
+		connections = p.Connections()
+		return len(connections) == 1 && connections[0].Out == int64(len("hello\n"))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	c := connections[0]
+	assert.Equal(t, client.LocalAddr().String(), c.Client.String())
+	assert.Equal(t, p.FrontendAddr().String(), c.Frontend.String())
+	assert.Equal(t, backend.Addr().String(), c.Backend.String())
+	assert.Equal(t, "FR", c.Country)
+	assert.Equal(t, int64(len("hello\n")), c.In)
+
+	assert.False(t, p.Kill(c.ID+1))
+	assert.True(t, p.Kill(c.ID))
+
+	_, err = client.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	assert.Eventually(t, func() bool {
+		return len(p.Connections()) == 0 && o.events() == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	assert.ErrorIs(t, o.records[0].Err, proxy.ErrKilled)
+}
+
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				io.Copy(c, c) //nolint:errcheck
+			}()
+		}
+	}()
+
+	return l
+}
+
+func assertEcho(t *testing.T, addr net.Addr, message string) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	_, err = c.Write([]byte(message + "\n"))
+	require.NoError(t, err)
+
+	response, err := bufio.NewReader(c).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, message+"\n", response)
+}
+
+// nameServer returns a server sending its name to the clients.
+func nameServer(t *testing.T, name string) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			c.Write([]byte(name + "\n")) //nolint:errcheck
+			c.Close()
+		}
+	}()
+
+	return l
+}
+
+func readName(t *testing.T, addr net.Addr) string {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+
+	name, err := bufio.NewReader(c).ReadString('\n')
+	require.NoError(t, err)
+	return strings.TrimSpace(name)
+}
+
+// run runs the proxy in background, the returned channel receives the result of Run.
+func run(p proxy.Proxy, ctx context.Context) <-chan error {
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- p.Run(ctx)
+	}()
+	return stopped
+}
+
+func assertStopped(t *testing.T, stopped <-chan error) {
+	t.Helper()
+
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
+
+// A recorder is an Observer recording the proxy activity.
+type recorder struct {
+	mu      sync.Mutex
+	log     []string
+	in      int64
+	out     int64
+	records []proxy.Record
+}
+
+func (r *recorder) Dialed(backend net.Addr, _ time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.log = append(r.log, "dialed "+backend.String()+" failed")
+		return
+	}
+	r.log = append(r.log, "dialed "+backend.String())
+}
+
+func (r *recorder) Opened(backend net.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.log = append(r.log, "opened "+backend.String())
+}
+
+func (r *recorder) Closed(backend net.Addr, _ time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.log = append(r.log, "closed "+backend.String())
+}
+
+func (r *recorder) Transferred(_ net.Addr, in, out int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.in += in
+	r.out += out
+}
+
+func (r *recorder) Ended(record proxy.Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records = append(r.records, record)
+}
+
+// events returns the number of reported events.
+func (r *recorder) events() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.log) + len(r.records)
+}
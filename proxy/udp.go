@@ -3,9 +3,12 @@ package proxy
 import (
 	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -30,13 +33,26 @@ type UDPProxy struct {
 	addresser  Addresser
 	tracking   connTrackMap
 	mutex      sync.Mutex
+	draining   bool           // No new flow is tracked
+	flows      sync.WaitGroup // Tracked flows
 	acceptable AcceptableConnection
+	timeout    time.Duration
+	pp         int
+	observer   Observer
 }
 
 // NewUDPProxy creates a new UDPProxy.
-func NewUDPProxy(ctx context.Context, addresser Addresser, h AcceptableConnection) (*UDPProxy, error) {
+func NewUDPProxy(ctx context.Context, addresser Addresser, h AcceptableConnection, opts Options) (*UDPProxy, error) {
 	log := logger.LogWith(ctx)
 
+	if opts.ProxyProtocol != 0 && opts.ProxyProtocol != ProxyProtocolV2 {
+		return nil, fmt.Errorf("proxy protocol: version %d is not supported over UDP", opts.ProxyProtocol)
+	}
+
+	if len(opts.TrustedProxies) > 0 {
+		return nil, errors.New("proxy protocol: trusted proxies are not supported over UDP")
+	}
+
 	// detect version of hostIP to bind only to correct version
 	frontend := addresser.Frontend().(*net.UDPAddr)
 	fipv := ipv4
@@ -45,7 +61,7 @@ func NewUDPProxy(ctx context.Context, addresser Addresser, h AcceptableConnectio
 	}
 	scheme := "udp" + string(fipv)
 
-	backend := addresser.Backend().(*net.UDPAddr)
+	backend := addresser.Backend(nil).(*net.UDPAddr)
 	bipv := ipv4
 	if backend.IP.To4() == nil {
 		bipv = ipv6
@@ -57,51 +73,86 @@ func NewUDPProxy(ctx context.Context, addresser Addresser, h AcceptableConnectio
 		return nil, err
 	}
 
+	if opts.UDPConnTrackTimeout <= 0 {
+		opts.UDPConnTrackTimeout = UDPConnTrackTimeout
+	}
+
 	return &UDPProxy{
 		ctx:        logger.WithLogger(ctx, log.WithPrefixf("[%s://%s]", scheme, frontend)),
 		listener:   listener,
 		addresser:  addresser,
 		tracking:   make(connTrackMap),
 		acceptable: h,
+		timeout:    opts.UDPConnTrackTimeout,
+		pp:         opts.ProxyProtocol,
+		observer:   observer(opts),
 	}, nil
 }
 
 // FrontendAddr returns the UDP address on which the proxy is listening.
 func (p *UDPProxy) FrontendAddr() net.Addr {
-	return p.addresser.Frontend()
+	return p.listener.LocalAddr()
 }
 
 // BackendAddr returns the proxied UDP address.
 func (p *UDPProxy) BackendAddr() net.Addr {
-	return p.addresser.Backend()
+	return p.addresser.Backend(nil)
 }
 
 // Run starts forwarding the traffic using UDP.
-func (p *UDPProxy) Run() {
+// It returns nil once the proxy is closed or the context is done, otherwise the error which stopped it.
+func (p *UDPProxy) Run(ctx context.Context) error {
 	log := logger.LogWith(p.ctx)
 
+	stop := context.AfterFunc(ctx, p.Close)
+	defer stop()
+
 	buf := make([]byte, UDPBufSize)
+	var packet []byte
+	var delay time.Duration
 	for {
 		read, from, err := p.listener.ReadFromUDP(buf)
 		if err != nil {
 			// NOTE: Apparently ReadFrom doesn't return
 			// ECONNREFUSED like Read do (see comment in
 			// UDPProxy.replyLoop)
-			if !isClosedError(err) {
-				log.Warnf("Stopping proxy on udp/%v (%s)", p.addresser.Frontend(), err)
-				break
+			if isClosedError(err) {
+				log.WithError(err).Debugf("Stopping proxy on udp/%v", p.addresser.Frontend())
+				return nil
 			}
 
-			log.WithError(err).Debugf("Connection closed for %v", from)
-			break
-		}
+			if !isTemporaryError(err) {
+				return fmt.Errorf("read: %w", err)
+			}
 
-		if !p.acceptable(p.ctx, from.IP) {
+			delay = backoff(delay)
+			log.Warnf("Could not read datagram, retrying in %s: %s", delay, err)
+			if !sleep(ctx, delay) {
+				return nil
+			}
 			continue
 		}
+		delay = 0
+
+		decision := p.acceptable(p.ctx, from.IP)
+		if !decision.Allowed {
+			p.observer.Ended(Record{
+				Start:    time.Now(),
+				Client:   from,
+				Frontend: p.FrontendAddr(),
+				Decision: decision,
+				In:       int64(read),
+			})
+			continue
+		}
+
+		addresser := p.addresser
+		if decision.Route != nil {
+			addresser = decision.Route
+		}
 
 		// Handle asynchronously this connection after the first synchronous datagram.
-		var proxyConn *net.UDPConn
+		var f *flow
 
 		next := func() bool { // Use of anonymous function in order to properly defer the unlock
 			fromKey := newConnTrackKey(from)
@@ -109,19 +160,39 @@ func (p *UDPProxy) Run() {
 			defer p.mutex.Unlock()
 
 			var hit bool
-			proxyConn, hit = p.tracking[fromKey]
+			f, hit = p.tracking[fromKey]
 			if !hit {
-				backend := p.addresser.Backend().(*net.UDPAddr)
+				if p.draining {
+					return true
+				}
+
+				backend := addresser.Backend(from).(*net.UDPAddr)
 				log.Infof("Forwarding %s://%s to %s://%s", p.FrontendAddr().Network(), p.FrontendAddr().String(), backend.Network(), backend.String())
 
-				proxyConn, err = net.DialUDP("udp", nil, backend)
+				start := time.Now()
+				proxyConn, err := net.DialUDP("udp", nil, backend)
+				p.observer.Dialed(backend, time.Since(start), err)
 				if err != nil {
 					log.Warnf("Can't proxy a datagram to udp/%s: %s\n", backend, err)
+					p.observer.Ended(Record{
+						Start:    start,
+						Client:   from,
+						Frontend: p.FrontendAddr(),
+						Decision: decision,
+						In:       int64(read),
+						Err:      err,
+					})
 					return true
 				}
 
-				p.tracking[fromKey] = proxyConn
-				go p.replyLoop(proxyConn, from, fromKey)
+				f = &flow{id: nextConnectionID(), conn: proxyConn, client: from, decision: decision, start: start}
+				p.tracking[fromKey] = f
+				p.flows.Add(1)
+				if reporter, ok := addresser.(ConnectionReporter); ok {
+					reporter.Connected(backend)
+				}
+				p.observer.Opened(backend)
+				go p.replyLoop(addresser, f, from, fromKey)
 			}
 
 			return false
@@ -131,38 +202,90 @@ func (p *UDPProxy) Run() {
 			continue
 		}
 
+		packet = buf[:read]
+		if p.pp > 0 {
+			packet, err = p.withProxyHeader(packet, from)
+			if err != nil {
+				log.Warnf("Can't proxy a datagram to udp/%s: %s\n", f.conn.RemoteAddr().String(), err)
+				continue
+			}
+		}
+
 		// Send the datagram synchronously to the backend then replyLoop will handle all the traffic for this connection.
-		for i := 0; i != read; {
-			written, err := proxyConn.Write(buf[i:read])
+		for i := 0; i != len(packet); {
+			written, err := f.conn.Write(packet[i:])
 			if err != nil {
-				log.Warnf("Can't proxy a datagram to udp/%s: %s\n", proxyConn.RemoteAddr().String(), err)
+				log.Warnf("Can't proxy a datagram to udp/%s: %s\n", f.conn.RemoteAddr().String(), err)
 				break
 			}
 
 			i += written
 		}
+		f.in.Add(int64(read))
+		p.observer.Transferred(f.conn.RemoteAddr(), int64(read), 0)
 	}
 }
 
-func (p *UDPProxy) replyLoop(c *net.UDPConn, addr *net.UDPAddr, key connTrackKey) {
+// withProxyHeader returns the datagram prefixed by the PROXY protocol header.
+func (p *UDPProxy) withProxyHeader(datagram []byte, from *net.UDPAddr) ([]byte, error) {
+	header, err := ProxyHeader{
+		Version:     p.pp,
+		Source:      from,
+		Destination: p.listener.LocalAddr(),
+	}.Format()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, datagram...), nil
+}
+
+func (p *UDPProxy) replyLoop(addresser Addresser, f *flow, addr *net.UDPAddr, key connTrackKey) {
 	log := logger.LogWith(p.ctx)
+	c := f.conn
+	backend := c.RemoteAddr()
 
+	defer p.flows.Done()
 	defer func() {
 		p.mutex.Lock()
 		defer p.mutex.Unlock()
 
-		c, ok := p.tracking[key]
-		if ok {
+		// A killed flow may have been replaced by a new flow of the client.
+		if p.tracking[key] == f {
 			delete(p.tracking, key)
 			c.Close()
 		}
+
+		if reporter, ok := addresser.(ConnectionReporter); ok {
+			reporter.Disconnected(backend)
+		}
+
+		var err error
+		if f.killed.Load() {
+			log.Infof("Connection of %v killed", addr)
+			err = ErrKilled
+		}
+
+		duration := time.Since(f.start)
+		p.observer.Closed(backend, duration)
+		p.observer.Ended(Record{
+			Start:    f.start,
+			Client:   addr,
+			Frontend: p.FrontendAddr(),
+			Decision: f.decision,
+			Backend:  backend,
+			In:       f.in.Load(),
+			Out:      f.out.Load(),
+			Duration: duration,
+			Err:      err,
+		})
 	}()
 
 	buf := make([]byte, UDPBufSize)
 	reset := true
 	for {
 		if reset {
-			c.SetReadDeadline(time.Now().Add(UDPConnTrackTimeout)) //nolint:errcheck
+			c.SetReadDeadline(time.Now().Add(p.timeout)) //nolint:errcheck
 		}
 
 		read, err := c.Read(buf)
@@ -171,7 +294,7 @@ func (p *UDPProxy) replyLoop(c *net.UDPConn, addr *net.UDPAddr, key connTrackKey
 				// This will happen if the last write failed
 				// (e.g: nothing is actually listening on the
 				// proxied port on the container), ignore it
-				// and continue until UDPConnTrackTimeout
+				// and continue until the conntrack timeout
 				// expires:
 				reset = false
 				continue
@@ -191,9 +314,74 @@ func (p *UDPProxy) replyLoop(c *net.UDPConn, addr *net.UDPAddr, key connTrackKey
 
 			i += written
 		}
+		f.out.Add(int64(read))
+		p.observer.Transferred(backend, 0, int64(read))
 	}
 }
 
+// Connections returns the tracked flows.
+func (p *UDPProxy) Connections() []Connection {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	connections := make([]Connection, 0, len(p.tracking))
+	for _, f := range p.tracking {
+		connections = append(connections, Connection{
+			ID:       f.id,
+			Start:    f.start,
+			Client:   f.client,
+			Frontend: p.FrontendAddr(),
+			Country:  f.decision.Country,
+			Backend:  f.conn.RemoteAddr(),
+			In:       f.in.Load(),
+			Out:      f.out.Load(),
+		})
+	}
+	return connections
+}
+
+// Kill forgets the tracked flow with the given ID, the next datagrams of the client start a new flow.
+func (p *UDPProxy) Kill(id uint64) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for key, f := range p.tracking {
+		if f.id == id {
+			f.killed.Store(true)
+			delete(p.tracking, key)
+			f.conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// Shutdown stops tracking new flows and waits for the tracked ones to expire before closing the proxy.
+// The datagrams of the tracked flows are still forwarded meanwhile.
+// When the context is done before, the proxy is closed and the context error is returned.
+func (p *UDPProxy) Shutdown(ctx context.Context) error {
+	p.mutex.Lock()
+	p.draining = true
+	p.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.flows.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	p.Close()
+	<-drained
+	return err
+}
+
 // Close stops forwarding the traffic.
 func (p *UDPProxy) Close() {
 	p.listener.Close()
@@ -201,8 +389,8 @@ func (p *UDPProxy) Close() {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	for _, c := range p.tracking {
-		c.Close()
+	for _, f := range p.tracking {
+		f.conn.Close()
 	}
 }
 
@@ -213,7 +401,7 @@ func isClosedError(err error) bool {
 	 * https://code.google.com/p/go/issues/detail?id=4337
 	 * https://groups.google.com/forum/#!msg/golang-nuts/0_aaCvBmOcM/SptmDyX1XJMJ
 	 */
-	return strings.HasSuffix(err.Error(), "use of closed network connection")
+	return errors.Is(err, net.ErrClosed) || strings.HasSuffix(err.Error(), "use of closed network connection")
 }
 
 //
@@ -221,7 +409,19 @@ func isClosedError(err error) bool {
 //
 
 type (
-	connTrackMap map[connTrackKey]*net.UDPConn
+	connTrackMap map[connTrackKey]*flow
+
+	// A flow is a tracked UDP connection.
+	flow struct {
+		id       uint64
+		conn     *net.UDPConn
+		client   *net.UDPAddr
+		decision Decision
+		start    time.Time
+		in       atomic.Int64 // Bytes received from the client
+		out      atomic.Int64 // Bytes sent to the client
+		killed   atomic.Bool
+	}
 
 	// A connTrackKey (net.Addr) where the IP is split into two fields so you can use it as a key in a map.
 	connTrackKey struct {
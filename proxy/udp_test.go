@@ -0,0 +1,288 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/geoblock-proxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPProxy_RunStops(t *testing.T) {
+	backend := udpEchoServer(t)
+	defer backend.Close()
+
+	newProxy := func() *proxy.UDPProxy {
+		p, err := proxy.NewUDPProxy(testContext(), &addresser{
+			frontend: udpAddr(t, "127.0.0.1:0"),
+			backend:  backend.LocalAddr(),
+		}, acceptAll, proxy.Options{})
+		require.NoError(t, err)
+		return p
+	}
+
+	p := newProxy()
+	stopped := run(p, context.Background())
+	client := udpClient(t, p.FrontendAddr())
+	defer client.Close()
+	assert.True(t, udpEcho(client, "hello"))
+
+	p.Close()
+	assertStopped(t, stopped)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p = newProxy()
+	stopped = run(p, ctx)
+
+	cancel()
+	assertStopped(t, stopped)
+}
+
+func TestUDPProxy_Shutdown(t *testing.T) {
+	backend := udpEchoServer(t)
+	defer backend.Close()
+
+	p, err := proxy.NewUDPProxy(testContext(), &addresser{
+		frontend: udpAddr(t, "127.0.0.1:0"),
+		backend:  backend.LocalAddr(),
+	}, acceptAll, proxy.Options{UDPConnTrackTimeout: 500 * time.Millisecond})
+	require.NoError(t, err)
+	stopped := run(p, context.Background())
+
+	tracked := udpClient(t, p.FrontendAddr())
+	defer tracked.Close()
+	assert.True(t, udpEcho(tracked, "before"))
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- p.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The tracked flow is still forwarded while the new ones are dropped.
+	assert.True(t, udpEcho(tracked, "draining"))
+
+	untracked := udpClient(t, p.FrontendAddr())
+	defer untracked.Close()
+	assert.False(t, udpEcho(untracked, "draining"))
+
+	// The proxy stops once the tracked flow has expired.
+	select {
+	case err := <-shutdown:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return after the expiration of the flow")
+	}
+
+	assertStopped(t, stopped)
+}
+
+func TestUDPProxy_ShutdownTimeout(t *testing.T) {
+	backend := udpEchoServer(t)
+	defer backend.Close()
+
+	p, err := proxy.NewUDPProxy(testContext(), &addresser{
+		frontend: udpAddr(t, "127.0.0.1:0"),
+		backend:  backend.LocalAddr(),
+	}, acceptAll, proxy.Options{})
+	require.NoError(t, err)
+	go p.Run(context.Background())
+
+	client := udpClient(t, p.FrontendAddr())
+	defer client.Close()
+	assert.True(t, udpEcho(client, "hello"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, p.Shutdown(ctx), context.DeadlineExceeded)
+	assert.False(t, udpEcho(client, "closed"))
+}
+
+func TestUDPProxy_Observer(t *testing.T) {
+	backend := udpEchoServer(t)
+	defer backend.Close()
+
+	o := &recorder{}
+	p, err := proxy.NewUDPProxy(testContext(), &addresser{
+		frontend: udpAddr(t, "127.0.0.1:0"),
+		backend:  backend.LocalAddr(),
+	}, acceptAll, proxy.Options{
+		UDPConnTrackTimeout: 200 * time.Millisecond,
+		Observer:            o,
+	})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	client := udpClient(t, p.FrontendAddr())
+	defer client.Close()
+	assert.True(t, udpEcho(client, "ping-1"))
+	assert.True(t, udpEcho(client, "ping-2"))
+
+	// The flow expires.
+	assert.Eventually(t, func() bool {
+		return o.events() == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	assert.Equal(t, []string{
+		"dialed " + backend.LocalAddr().String(),
+		"opened " + backend.LocalAddr().String(),
+		"closed " + backend.LocalAddr().String(),
+	}, o.log)
+	assert.Equal(t, int64(12), o.in)
+	assert.Equal(t, int64(12), o.out)
+
+	record := o.records[0]
+	assert.True(t, record.Decision.Allowed)
+	assert.Equal(t, client.LocalAddr().String(), record.Client.String())
+	assert.Equal(t, backend.LocalAddr().String(), record.Backend.String())
+	assert.Equal(t, int64(12), record.In)
+	assert.Equal(t, int64(12), record.Out)
+}
+
+func TestUDPProxy_Kill(t *testing.T) {
+	backend := udpEchoServer(t)
+	defer backend.Close()
+
+	o := &recorder{}
+	p, err := proxy.NewUDPProxy(testContext(), &addresser{
+		frontend: udpAddr(t, "127.0.0.1:0"),
+		backend:  backend.LocalAddr(),
+	}, acceptAll, proxy.Options{Observer: o})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	client := udpClient(t, p.FrontendAddr())
+	defer client.Close()
+	assert.True(t, udpEcho(client, "ping"))
+
+	var connections []proxy.Connection
+	assert.Eventually(t, func() bool {
+		connections = p.Connections()
+		return len(connections) == 1 && connections[0].Out == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	c := connections[0]
+	assert.Equal(t, client.LocalAddr().String(), c.Client.String())
+	assert.Equal(t, backend.LocalAddr().String(), c.Backend.String())
+	assert.Equal(t, int64(4), c.In)
+
+	assert.False(t, p.Kill(c.ID+1))
+	assert.True(t, p.Kill(c.ID))
+	assert.Empty(t, p.Connections())
+
+	assert.Eventually(t, func() bool {
+		return o.events() == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	o.mu.Lock()
+	assert.ErrorIs(t, o.records[0].Err, proxy.ErrKilled)
+	o.mu.Unlock()
+
+	// The next datagrams start a new flow.
+	assert.True(t, udpEcho(client, "ping"))
+	require.Len(t, p.Connections(), 1)
+	assert.NotEqual(t, c.ID, p.Connections()[0].ID)
+}
+
+func TestUDPProxy_KillThenResend(t *testing.T) {
+	backend := udpEchoServer(t)
+	defer backend.Close()
+
+	o := &gatedRecorder{gate: make(chan struct{})}
+	p, err := proxy.NewUDPProxy(testContext(), &addresser{
+		frontend: udpAddr(t, "127.0.0.1:0"),
+		backend:  backend.LocalAddr(),
+	}, acceptAll, proxy.Options{Observer: o})
+	require.NoError(t, err)
+	defer p.Close()
+	go p.Run(context.Background())
+
+	client := udpClient(t, p.FrontendAddr())
+	defer client.Close()
+
+	// The reply loop of the first flow is blocked until the client has started a new flow.
+	assert.True(t, udpEcho(client, "ping"))
+	connections := p.Connections()
+	require.Len(t, connections, 1)
+	assert.True(t, p.Kill(connections[0].ID))
+
+	assert.True(t, udpEcho(client, "ping"))
+	close(o.gate)
+
+	assert.Eventually(t, func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+
+		return len(o.records) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	o.mu.Lock()
+	assert.ErrorIs(t, o.records[0].Err, proxy.ErrKilled)
+	o.mu.Unlock()
+
+	connections = p.Connections()
+	require.Len(t, connections, 1, "the killed flow does not forget the new one")
+	assert.True(t, p.Kill(connections[0].ID))
+}
+
+// A gatedRecorder is a recorder blocking the first reply until its gate is closed.
+type gatedRecorder struct {
+	recorder
+	gate    chan struct{}
+	replied atomic.Bool
+}
+
+func (r *gatedRecorder) Transferred(backend net.Addr, in, out int64) {
+	if out > 0 && !r.replied.Swap(true) {
+		<-r.gate
+	}
+	r.recorder.Transferred(backend, in, out)
+}
+
+func udpEchoServer(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	c, err := net.ListenUDP("udp", udpAddr(t, "127.0.0.1:0"))
+	require.NoError(t, err)
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := c.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			c.WriteToUDP(buf[:n], from) //nolint:errcheck
+		}
+	}()
+
+	return c
+}
+
+func udpClient(t *testing.T, addr net.Addr) net.Conn {
+	t.Helper()
+
+	c, err := net.Dial("udp", addr.String())
+	require.NoError(t, err)
+	return c
+}
+
+// udpEcho returns true when the datagram is echoed back.
+func udpEcho(c net.Conn, message string) bool {
+	if _, err := c.Write([]byte(message)); err != nil {
+		return false
+	}
+
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond)) //nolint:errcheck
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	return err == nil && string(buf[:n]) == message
+}
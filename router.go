@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/mdouchement/geoblock-proxy/iptrie"
+	"github.com/mdouchement/geoblock-proxy/proxy"
+)
+
+type (
+	// A router selects the backends of the connections according to the location of the clients.
+	router struct {
+		routes []route
+	}
+
+	route struct {
+		cidr      *iptrie.Trie
+		countries map[string]bool
+		backends  proxy.Addresser
+	}
+)
+
+// add appends a route forwarding the matching clients to the given backends.
+func (r *router) add(rt Route, backends proxy.Addresser) error {
+	blocks, err := rt.Blocks()
+	if err != nil {
+		return err
+	}
+
+	x := route{
+		cidr:      iptrie.New(),
+		countries: make(map[string]bool, len(rt.Countries)),
+		backends:  backends,
+	}
+
+	for _, block := range blocks {
+		x.cidr.Insert(block)
+	}
+
+	for _, country := range rt.Countries {
+		x.countries[strings.ToLower(country)] = true // The lookups answer lowercased countries.
+	}
+
+	r.routes = append(r.routes, x)
+	return nil
+}
+
+// match returns the backends of the first route matching the client, nil when none matches.
+func (r *router) match(ip net.IP, country string) proxy.Addresser {
+	if r == nil {
+		return nil
+	}
+
+	country = strings.ToLower(country)
+	for _, x := range r.routes {
+		if x.cidr.Contains(ip) || x.countries[country] {
+			return x.backends
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type backends string
+
+func (b backends) Frontend() net.Addr {
+	return nil
+}
+
+func (b backends) Backend(net.Addr) net.Addr {
+	return nil
+}
+
+func TestRouter_Match(t *testing.T) {
+	var r *router
+	assert.Nil(t, r.match(net.ParseIP("10.0.0.1"), "fr"), "no route")
+
+	r = &router{}
+	require.NoError(t, r.add(Route{Countries: []string{"FR", "be"}}, backends("europe")))
+	require.NoError(t, r.add(Route{CIDRs: []string{"10.0.0.0/8"}, Countries: []string{"us"}}, backends("private")))
+	require.NoError(t, r.add(Route{CIDRs: []string{"10.1.0.0/16"}}, backends("unreachable")))
+	assert.Error(t, r.add(Route{CIDRs: []string{"10.0"}}, backends("invalid")))
+
+	tests := []struct {
+		ip       string
+		country  string
+		expected any
+	}{
+		{ip: "1.2.3.4", country: "fr", expected: backends("europe")},
+		{ip: "1.2.3.4", country: "BE", expected: backends("europe")},
+		{ip: "1.2.3.4", country: "us", expected: backends("private")},
+		{ip: "10.1.2.3", country: "", expected: backends("private")},
+		{ip: "10.1.2.3", country: "fr", expected: backends("europe")}, // The first matching route wins.
+		{ip: "1.2.3.4", country: "de", expected: nil},
+		{ip: "1.2.3.4", country: "", expected: nil},
+	}
+
+	for _, test := range tests {
+		route := r.match(net.ParseIP(test.ip), test.country)
+		if test.expected == nil {
+			assert.Nil(t, route, "%s %s", test.ip, test.country)
+			continue
+		}
+		assert.Equal(t, test.expected, route, "%s %s", test.ip, test.country)
+	}
+}
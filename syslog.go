@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/syslog"
+
+	"github.com/sirupsen/logrus"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// newSyslogHook returns a hook sending the logs to the local syslog daemon.
+func newSyslogHook() (logrus.Hook, error) {
+	return lsyslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, "geoblock-proxy")
+}
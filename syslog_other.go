@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newSyslogHook returns an error, syslog is not supported on this platform.
+func newSyslogHook() (logrus.Hook, error) {
+	return nil, errors.New("not supported on this platform")
+}